@@ -0,0 +1,76 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/logging"
+)
+
+const (
+	adminRoute = "/admin"
+
+	// backupNextSinceTrailer is the trailer carrying the since version
+	// of the next incremental backup.
+	backupNextSinceTrailer = "X-Backup-Next-Since"
+)
+
+// Backuper streams backups of the database.
+type Backuper interface {
+	Backup(w io.Writer, since uint64) (uint64, error)
+}
+
+// adminResource implements the administrative operations.
+type adminResource struct {
+	backuper Backuper
+}
+
+func (rs *adminResource) router() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(requirePrincipal, requireScope(auth.ScopeAdmin))
+	r.Get("/backup", rs.backup)
+	return r
+}
+
+// backup streams an online backup of entries changed at or after the since
+// query parameter, or a full backup without it. The since version of the next
+// incremental backup is sent in the trailer, known only once the backup is done.
+func (rs *adminResource) backup(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		if since, err = strconv.ParseUint(param, 10, 64); err != nil {
+			renderError(w, r, ErrBadRequest)
+			return
+		}
+	}
+	// backups of large databases outlast the write timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/admin/backup",
+			"details":  "SetWriteDeadline",
+			"error":    err,
+		}).Warn("Backup is limited by the write timeout")
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", backupNextSinceTrailer)
+	next, err := rs.backuper.Backup(w, since)
+	if err != nil {
+		// the status was sent with the first bytes, so the backup is only
+		// recognisable as failed by the missing trailer
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/admin/backup",
+			"details":  "Backup",
+			"error":    err,
+		}).Error("Backup failed")
+		return
+	}
+	w.Header().Set(backupNextSinceTrailer, strconv.FormatUint(next, 10))
+	logging.FromContext(r.Context()).WithField("location", "api/admin/backup").Infof("Backup since version %d completed, next since %d", since, next)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/service"
+)
+
+type fakeBackuper struct {
+	since uint64
+	err   error
+}
+
+func (b *fakeBackuper) Backup(w io.Writer, since uint64) (uint64, error) {
+	b.since = since
+	if b.err != nil {
+		return 0, b.err
+	}
+	_, err := w.Write([]byte("backup"))
+	return 42, err
+}
+
+func TestBackup(t *testing.T) {
+	withPrincipal := func(req *http.Request, scopes ...string) *http.Request {
+		return req.WithContext(auth.NewContext(req.Context(), &auth.Principal{Subject: "caller", Scopes: scopes}))
+	}
+	get := func(path string) *http.Request {
+		req, _ := http.NewRequest("GET", path, nil)
+		return req
+	}
+
+	cases := []struct {
+		name          string
+		req           *http.Request
+		backupErr     error
+		expectedCode  int
+		expectedSince uint64
+		expectedNext  string
+	}{
+		{"Full backup", withPrincipal(get("/backup"), auth.ScopeAdmin), nil, http.StatusOK, 0, "42"},
+		{"Incremental backup", withPrincipal(get("/backup?since=7"), auth.ScopeAdmin), nil, http.StatusOK, 7, "42"},
+		{"Invalid since", withPrincipal(get("/backup?since=x"), auth.ScopeAdmin), nil, http.StatusBadRequest, 0, ""},
+		{"Missing admin scope", withPrincipal(get("/backup"), auth.ScopePaymentsWrite), nil, http.StatusForbidden, 0, ""},
+		{"Authentication disabled", get("/backup"), nil, http.StatusForbidden, 0, ""},
+		{"Failed backup", withPrincipal(get("/backup"), auth.ScopeAdmin), errors.New("failed"), http.StatusOK, 0, ""},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			backuper := &fakeBackuper{err: testCase.backupErr}
+			recorder := httptest.NewRecorder()
+
+			(&adminResource{backuper}).router().ServeHTTP(recorder, testCase.req)
+
+			result := recorder.Result()
+			assert.Equal(t, testCase.expectedCode, result.StatusCode)
+			assert.Equal(t, testCase.expectedSince, backuper.since)
+			assert.Equal(t, testCase.expectedNext, result.Trailer.Get(backupNextSinceTrailer))
+			if testCase.expectedNext != "" {
+				body, _ := ioutil.ReadAll(result.Body)
+				assert.Equal(t, "backup", string(body))
+			}
+		})
+	}
+}
+
+// slowBackuper writes its backup after the delay.
+type slowBackuper struct {
+	delay time.Duration
+}
+
+func (b *slowBackuper) Backup(w io.Writer, since uint64) (uint64, error) {
+	time.Sleep(b.delay)
+	_, err := w.Write([]byte("backup"))
+	return 42, err
+}
+
+func TestBackupTimeouts(t *testing.T) {
+	api, err := NewAPI(service.NewPaymentsService(nil), WithBackup(&slowBackuper{300 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := auth.NewContext(r.Context(), &auth.Principal{Subject: "admin", Scopes: []string{auth.ScopeAdmin}})
+		api.Router().ServeHTTP(w, r.WithContext(ctx))
+	})
+	srv := httptest.NewUnstartedServer(admin)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/admin/backup")
+
+	if assert.Nil(t, err) {
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, readErr)
+		assert.Equal(t, "backup", string(body))
+		assert.Equal(t, "42", resp.Trailer.Get(backupNextSinceTrailer), "Backups must outlast the write timeout")
+	}
+}
+
+func TestBackupWithAuthenticationDisabled(t *testing.T) {
+	backuper := &fakeBackuper{since: 1}
+	api, err := NewAPI(service.NewPaymentsService(nil), WithBackup(backuper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/backup", nil)
+
+	api.Router().ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, uint64(1), backuper.since, "Backup must not be taken")
+}
@@ -1,8 +1,12 @@
 package api
 
 import (
+	"net/http"
 	"time"
 
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/health"
+	"github.com/mysza/paymentsapi/metrics"
 	"github.com/mysza/paymentsapi/service"
 
 	"github.com/go-chi/chi"
@@ -11,7 +15,12 @@ import (
 )
 
 const (
-	paymentsRoute = "/payments"
+	paymentsRoute  = "/payments"
+	livenessRoute  = "/healthz"
+	readinessRoute = "/readyz"
+
+	// requestTimeout limits the handling of requests other than backups
+	requestTimeout = 15 * time.Second
 )
 
 // API provides the application HTTP API
@@ -20,17 +29,100 @@ type API struct {
 	router   *chi.Mux
 }
 
-// NewAPI creates a new API instance
-func NewAPI(repo service.PaymentsRepository) (*API, error) {
-	payments := NewPaymentResource(repo)
+// Option configures optional behaviour of the API.
+type Option func(*options)
+
+type options struct {
+	authenticators []func(http.Handler) http.Handler
+	metrics        *metrics.Registry
+	readiness      *health.Registry
+	backuper       Backuper
+}
+
+// WithMetrics instruments the HTTP requests and exposes
+// the metrics of the registry at /metrics.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = registry
+	}
+}
+
+// WithHealth exposes the liveness of the process at /healthz and
+// the readiness checks of the registry at /readyz.
+func WithHealth(readiness *health.Registry) Option {
+	return func(o *options) {
+		o.readiness = readiness
+	}
+}
+
+// WithBackup exposes online backups at /admin/backup
+// to callers granted the admin scope. With authentication disabled
+// there are no such callers, and backups are forbidden.
+func WithBackup(backuper Backuper) Option {
+	return func(o *options) {
+		o.backuper = backuper
+	}
+}
+
+// WithVerifier enables authentication of requests with bearer tokens.
+func WithVerifier(verifier *auth.Verifier) Option {
+	return func(o *options) {
+		o.authenticators = append(o.authenticators, authenticate(verifier))
+	}
+}
+
+// WithClientCertIdentity identifies callers presenting verified client certificates,
+// granting them the given scopes and roles.
+func WithClientCertIdentity(scopes, roles []string) Option {
+	return func(o *options) {
+		// client certificates must be examined before bearer tokens are required
+		o.authenticators = append([]func(http.Handler) http.Handler{clientCertIdentity(scopes, roles)}, o.authenticators...)
+	}
+}
+
+// NewAPI creates a new API instance. Unless configured with
+// authentication options, requests are not authenticated.
+func NewAPI(service *service.PaymentsService, opts ...Option) (*API, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	payments := NewPaymentResource(service)
 	router := chi.NewRouter()
 	router.Use(middleware.Recoverer)
+	if o.metrics != nil {
+		router.Use(newHTTPMetrics(o.metrics).instrument)
+	}
 	router.Use(middleware.RequestID)
-	router.Use(middleware.DefaultCompress)
-	router.Use(middleware.Timeout(15 * time.Second))
-	router.Use(middleware.Logger)
+	router.Use(trace)
+	router.Use(accessLog)
 	router.Use(render.SetContentType(render.ContentTypeJSON))
-	router.Mount(paymentsRoute, payments.router())
+	router.Group(func(r chi.Router) {
+		r.Use(middleware.DefaultCompress)
+		r.Use(middleware.Timeout(requestTimeout))
+		if o.metrics != nil {
+			r.Method(http.MethodGet, metricsRoute, o.metrics.Handler())
+		}
+		if o.readiness != nil {
+			r.Method(http.MethodGet, livenessRoute, health.LivenessHandler())
+			r.Method(http.MethodGet, readinessRoute, o.readiness.Handler())
+		}
+		r.Group(func(r chi.Router) {
+			r.Use(o.authenticators...)
+			r.Use(logCaller)
+			r.Mount(paymentsRoute, payments.router())
+			r.Mount(calendarsRoute, (&calendarResource{service}).router())
+		})
+	})
+	if o.backuper != nil {
+		// backups stream for as long as the database takes, so they are
+		// neither timed out nor compressed, which would buffer them
+		router.Group(func(r chi.Router) {
+			r.Use(o.authenticators...)
+			r.Use(logCaller)
+			r.Mount(adminRoute, (&adminResource{o.backuper}).router())
+		})
+	}
 	return &API{payments, router}, nil
 }
 
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/logging"
+)
+
+// authenticate is a middleware validating the bearer token of each request
+// and storing the resulting principal in the request context. Requests
+// already identified by a client certificate need no bearer token.
+func authenticate(verifier *auth.Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if _, identified := auth.FromContext(r.Context()); identified && header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				renderError(w, r, ErrUnauthorized)
+				return
+			}
+			principal, err := verifier.Verify(strings.TrimSpace(header[7:]))
+			if err != nil {
+				logging.FromContext(r.Context()).WithFields(logrus.Fields{
+					"location": "api/auth/authenticate",
+					"details":  "verifier.Verify",
+					"error":    err,
+				}).Warn("Rejected bearer token")
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				renderError(w, r, ErrUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// requireScope is a middleware rejecting requests of principals not granted
+// the given scope. Requests without a principal are only possible with
+// authentication disabled, and are let through.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if principal, ok := auth.FromContext(r.Context()); ok && !principal.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				renderError(w, r, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// requirePrincipal is a middleware rejecting requests without a principal,
+// i.e. all requests with authentication disabled, for operations which must
+// never be open to anonymous callers.
+func requirePrincipal(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := auth.FromContext(r.Context()); !ok {
+			renderError(w, r, ErrForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/repository/memory"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+type staticKeys map[string]crypto.PublicKey
+
+func (k staticKeys) Key(kid string) (crypto.PublicKey, error) {
+	if key, ok := k[kid]; ok {
+		return key, nil
+	}
+	return nil, auth.ErrKeyNotFound
+}
+
+func signToken(t *testing.T, key *ecdsa.PrivateKey, scope string) string {
+	return signOrganisationToken(t, key, scope, "")
+}
+
+func signOrganisationToken(t *testing.T, key *ecdsa.PrivateKey, scope, organisation string) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "test"})
+	body, _ := json.Marshal(map[string]interface{}{
+		"sub":    "user-1",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"scope":  scope,
+		"org_id": organisation,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthentication(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	verifier := auth.NewVerifier(staticKeys{"test": &key.PublicKey}, auth.VerifierConfig{})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := authenticate(verifier)(requireScope(auth.ScopePaymentsWrite)(ok))
+
+	cases := []struct {
+		name          string
+		authorization string
+		expectedCode  int
+	}{
+		{"No token", "", http.StatusUnauthorized},
+		{"Invalid token", "Bearer invalid", http.StatusUnauthorized},
+		{"Missing scope", "Bearer " + signToken(t, key, auth.ScopePaymentsRead), http.StatusForbidden},
+		{"Granted scope", "Bearer " + signToken(t, key, auth.ScopePaymentsWrite), http.StatusOK},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/", nil)
+			if testCase.authorization != "" {
+				request.Header.Set("Authorization", testCase.authorization)
+			}
+
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(t, testCase.expectedCode, recorder.Code)
+		})
+	}
+}
+
+func TestOrganisationIsolation(t *testing.T) {
+	assert := assert.New(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	verifier := auth.NewVerifier(staticKeys{"test": &key.PublicKey}, auth.VerifierConfig{})
+	api, _ := NewAPI(service.NewPaymentsService(memory.New()), WithVerifier(verifier))
+	scopes := auth.ScopePaymentsRead + " " + auth.ScopePaymentsWrite
+	own := "Bearer " + signOrganisationToken(t, key, scopes, "org-a")
+	other := "Bearer " + signOrganisationToken(t, key, scopes, "org-b")
+	none := "Bearer " + signToken(t, key, scopes)
+	do := func(method, path, authorization string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		request, _ := http.NewRequest(method, path, bytes.NewReader(encoded))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		api.Router().ServeHTTP(recorder, request)
+		return recorder
+	}
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	payment.ID = ""
+	payment.OrganisationID = "org-b"
+
+	added := do("POST", "/payments", own, payment)
+	location := added.Header().Get("Location")
+	var read paymentResponse
+	json.NewDecoder(do("GET", location, own, nil).Body).Decode(&read)
+	var listed paymentListResponse
+	json.NewDecoder(do("GET", "/payments", other, nil).Body).Decode(&listed)
+
+	assert.Equal(http.StatusCreated, added.Code)
+	assert.Equal("org-a", read.OrganisationID, "Payments belong to the organisation of the caller adding them")
+	assert.Empty(listed.Data)
+	assert.Equal(http.StatusNotFound, do("GET", location, other, nil).Code)
+	assert.Equal(http.StatusNotFound, do("DELETE", location, other, nil).Code)
+	assert.Equal(http.StatusNotFound, do("GET", location, none, nil).Code)
+	assert.Equal(http.StatusForbidden, do("POST", "/payments", none, payment).Code)
+	assert.Equal(http.StatusNoContent, do("DELETE", location, own, nil).Code)
+}
+
+func TestPermissionDenied(t *testing.T) {
+	assert := assert.New(t)
+	policy, _ := service.NewRolePolicy(service.DefaultRoles)
+	paymentResource := NewPaymentResource(service.NewPaymentsService(new(mocks.PaymentsRepository), service.WithPolicy(policy)))
+	request := createHTTPRequest("DELETE", "/some-id", nil, &httpRequestContext{"paymentID", "some-id"})
+	request = request.WithContext(auth.NewContext(request.Context(), &auth.Principal{Subject: "user-1", Roles: []string{"viewer"}}))
+	recorder := httptest.NewRecorder()
+
+	http.HandlerFunc(paymentResource.delete).ServeHTTP(recorder, request)
+
+	assert.Equal(http.StatusForbidden, recorder.Code)
+	assert.Equal("application/problem+json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(`{"type": "about:blank", "title": "Forbidden", "status": 403, "detail": "Not allowed to delete payments"}`, recorder.Body.String())
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/calendar"
+	"github.com/mysza/paymentsapi/logging"
+	"github.com/mysza/paymentsapi/service"
+)
+
+const calendarsRoute = "/calendars"
+
+// calendarResource implements the business-day calendars of payment schemes.
+type calendarResource struct {
+	service *service.PaymentsService
+}
+
+func (rs *calendarResource) router() *chi.Mux {
+	r := chi.NewRouter()
+	r.With(requireScope(auth.ScopePaymentsRead)).Get("/{scheme}/business-days", rs.businessDays)
+	return r
+}
+
+// businessDaysResponse is the response payload for the business days of a scheme.
+type businessDaysResponse struct {
+	Scheme       string   `json:"scheme"`
+	Calendar     string   `json:"calendar,omitempty"` // Calendar is empty for schemes processing payments every day
+	BusinessDays []string `json:"business_days"`
+}
+
+// businessDays lists the business days of the scheme between the from and to
+// query parameters, inclusive.
+func (rs *calendarResource) businessDays(w http.ResponseWriter, r *http.Request) {
+	scheme := chi.URLParam(r, "scheme")
+	from, fromErr := time.Parse(calendar.DateLayout, r.URL.Query().Get("from"))
+	to, toErr := time.Parse(calendar.DateLayout, r.URL.Query().Get("to"))
+	if fromErr != nil || toErr != nil {
+		renderError(w, r, ErrBadRequest)
+		return
+	}
+	name, days, err := rs.service.BusinessDays(r.Context(), scheme, from, to)
+	if err != nil {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/calendar/businessDays",
+			"details":  "service.BusinessDays",
+			"error":    err,
+		}).Warn("Error getting business days by service")
+		renderError(w, r, serviceErrResponse(err))
+		return
+	}
+	response := &businessDaysResponse{Scheme: scheme, Calendar: name, BusinessDays: []string{}}
+	for _, day := range days {
+		response.BusinessDays = append(response.BusinessDays, day.Format(calendar.DateLayout))
+	}
+	respond(w, r, response)
+}
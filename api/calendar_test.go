@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/calendar"
+	"github.com/mysza/paymentsapi/service"
+)
+
+func TestBusinessDays(t *testing.T) {
+	calendars, err := calendar.Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := service.NewPaymentsService(nil, service.WithCalendars(service.CalendarConfig{
+		Calendars: calendars,
+		Schemes:   service.DefaultCalendarSchemes,
+	}))
+	api, _ := NewAPI(ps)
+
+	cases := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expectedDays []string
+	}{
+		{"Business days of the scheme", "/calendars/Bacs/business-days?from=2018-12-24&to=2018-12-27", http.StatusOK, []string{"2018-12-24", "2018-12-27"}},
+		{"Schemes without calendars", "/calendars/FPS/business-days?from=2018-12-24&to=2018-12-25", http.StatusOK, []string{"2018-12-24", "2018-12-25"}},
+		{"Unknown scheme", "/calendars/SWIFT/business-days?from=2018-12-24&to=2018-12-27", http.StatusNotFound, nil},
+		{"Invalid dates", "/calendars/Bacs/business-days?from=24/12/2018&to=2018-12-27", http.StatusBadRequest, nil},
+		{"Dates out of order", "/calendars/Bacs/business-days?from=2018-12-27&to=2018-12-24", http.StatusBadRequest, nil},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", testCase.path, nil)
+
+			api.Router().ServeHTTP(recorder, req)
+
+			assert.Equal(t, testCase.expectedCode, recorder.Code)
+			if testCase.expectedDays != nil {
+				var body businessDaysResponse
+				json.NewDecoder(recorder.Body).Decode(&body)
+				assert.Equal(t, testCase.expectedDays, body.BusinessDays)
+			}
+		})
+	}
+}
@@ -1,16 +1,23 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 
 	"github.com/go-chi/render"
+
+	"github.com/mysza/paymentsapi/service"
 )
 
 // ErrResponse renderer type for handling all sorts of errors.
 type ErrResponse struct {
-	Error      error  `json:"-"`      // low-level runtime error
-	StatusCode int    `json:"-"`      // http response status code
-	StatusText string `json:"status"` // user-level status message
+	Error      error  `json:"-"`               // low-level runtime error
+	StatusCode int    `json:"-"`               // http response status code
+	StatusText string `json:"status"`          // user-level status message
+	ErrorText  string `json:"error,omitempty"` // application-level error message
+
+	Violations []service.Violation `json:"violations,omitempty"` // rules violated by the payment, by field
 }
 
 // Render sets the application-specific error code in AppCode.
@@ -19,13 +26,121 @@ func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// problemTypeBlank is the type of problems described by their status alone.
+const problemTypeBlank = "about:blank"
+
+// Problem is a problem details body (RFC 7807), responded with as
+// application/problem+json.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Render sets the status of the problem.
+func (p *Problem) Render(w http.ResponseWriter, r *http.Request) error {
+	render.Status(r, p.Status)
+	return nil
+}
+
+// renderError renders the error response like render.Render, responding
+// with respond so that problems are written as such.
+func renderError(w http.ResponseWriter, r *http.Request, v render.Renderer) {
+	if err := v.Render(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respond(w, r, v)
+}
+
+// respond writes problems as application/problem+json, and other values
+// with the default responder.
+func respond(w http.ResponseWriter, r *http.Request, v interface{}) {
+	problem, ok := v.(*Problem)
+	if !ok {
+		render.DefaultResponder(w, r, v)
+		return
+	}
+	body, err := json.Marshal(problem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	w.Write(body)
+}
+
 var (
 	// ErrBadRequest return status 400 Bad Request for malformed request body.
 	ErrBadRequest = &ErrResponse{StatusCode: http.StatusBadRequest, StatusText: http.StatusText(http.StatusBadRequest)}
 
+	// ErrUnauthorized returns status 401 Unauthorized for missing or invalid credentials.
+	ErrUnauthorized = &ErrResponse{StatusCode: http.StatusUnauthorized, StatusText: http.StatusText(http.StatusUnauthorized)}
+
+	// ErrForbidden returns status 403 Forbidden with a problem body when the caller lacks the scope.
+	ErrForbidden = &Problem{Type: problemTypeBlank, Title: http.StatusText(http.StatusForbidden), Status: http.StatusForbidden}
+
 	// ErrNotFound returns status 404 Not Found for invalid resource request.
 	ErrNotFound = &ErrResponse{StatusCode: http.StatusNotFound, StatusText: http.StatusText(http.StatusNotFound)}
 
+	// ErrGatewayTimeout returns status 504 Gateway Timeout when the request timed out.
+	ErrGatewayTimeout = &ErrResponse{StatusCode: http.StatusGatewayTimeout, StatusText: http.StatusText(http.StatusGatewayTimeout)}
+
 	// ErrInternalServerError returns status 500 Internal Server Error.
 	ErrInternalServerError = &ErrResponse{StatusCode: http.StatusInternalServerError, StatusText: http.StatusText(http.StatusInternalServerError)}
 )
+
+// ErrPermissionDenied returns status 403 Forbidden with a problem body
+// explaining which permission was missing.
+func ErrPermissionDenied(err error) *Problem {
+	return &Problem{
+		Type:   problemTypeBlank,
+		Title:  http.StatusText(http.StatusForbidden),
+		Status: http.StatusForbidden,
+		Detail: err.Error(),
+	}
+}
+
+// ErrStateConflict returns status 409 Conflict explaining why the request conflicts with the resource state.
+func ErrStateConflict(err error) *ErrResponse {
+	return &ErrResponse{
+		Error:      err,
+		StatusCode: http.StatusConflict,
+		StatusText: http.StatusText(http.StatusConflict),
+		ErrorText:  err.Error(),
+	}
+}
+
+// ErrInvalidPayment returns status 400 Bad Request listing the rules violated by the payment.
+func ErrInvalidPayment(err *service.ValidationError) *ErrResponse {
+	return &ErrResponse{
+		Error:      err,
+		StatusCode: http.StatusBadRequest,
+		StatusText: http.StatusText(http.StatusBadRequest),
+		ErrorText:  "Payment violates validation rules",
+		Violations: err.Violations,
+	}
+}
+
+// serviceErrResponse maps errors returned by the service to responses.
+func serviceErrResponse(err error) render.Renderer {
+	if err == context.DeadlineExceeded {
+		return ErrGatewayTimeout
+	}
+	switch err := err.(type) {
+	case *service.InputError:
+		return ErrBadRequest
+	case *service.ValidationError:
+		return ErrInvalidPayment(err)
+	case *service.NotFoundError:
+		return ErrNotFound
+	case *service.ForbiddenError:
+		return ErrPermissionDenied(err)
+	case *service.ConflictError:
+		return ErrStateConflict(err)
+	default:
+		return ErrInternalServerError
+	}
+}
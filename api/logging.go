@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/sirupsen/logrus"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/logging"
+)
+
+// accessLog is a middleware storing a logger correlated with the request in
+// its context, and logging every request once it is handled.
+func accessLog(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		fields := logrus.Fields{"request_id": middleware.GetReqID(r.Context())}
+		if sc := oteltrace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		ctx := logging.NewContext(r.Context(), logrus.WithFields(fields))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		r = r.WithContext(ctx)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		logging.FromContext(ctx).WithFields(logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       routePattern(r),
+			"status":      status,
+			"bytes":       ww.BytesWritten(),
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"remote_addr": r.RemoteAddr,
+		}).Info("Request handled")
+	}
+	return http.HandlerFunc(fn)
+}
+
+// logCaller is a middleware adding the identity of the authenticated caller
+// to the request logger.
+func logCaller(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := auth.FromContext(r.Context()); ok {
+			logging.AddFields(r.Context(), logrus.Fields{
+				"tenant":  principal.OrganisationID,
+				"subject": principal.Subject,
+			})
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/logging"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+func TestAccessLog(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	repo := new(mocks.PaymentsRepository)
+	repo.On("Get", mock.Anything, "missing").Return(nil, errors.New("not found"))
+	api, _ := NewAPI(service.NewPaymentsService(repo))
+
+	api.Router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/payments/missing", nil))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var handlerEntry, accessEntry map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &handlerEntry)
+	json.Unmarshal([]byte(lines[len(lines)-1]), &accessEntry)
+	assert.NotEmpty(accessEntry["request_id"])
+	assert.Equal(accessEntry["request_id"], handlerEntry["request_id"])
+	assert.Equal("missing", handlerEntry["payment_id"])
+	assert.Equal("Request handled", accessEntry["msg"])
+	assert.Equal("missing", accessEntry["payment_id"])
+	assert.Equal("/payments/{paymentID}", accessEntry["route"])
+	assert.Equal(float64(404), accessEntry["status"])
+	assert.NotZero(accessEntry["bytes"])
+	assert.Contains(accessEntry, "duration_ms")
+}
+
+func TestServiceErrorsAreScrubbed(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	logrus.SetFormatter(logging.NewRedactingFormatter(&logrus.JSONFormatter{}))
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	payment.ID = ""
+	name := payment.Attributes.Beneficiary.Name
+	repo := new(mocks.PaymentsRepository)
+	repo.On("Add", mock.Anything, mock.Anything).Return("", fmt.Errorf("beneficiary %q rejected", name))
+	api, _ := NewAPI(service.NewPaymentsService(repo))
+
+	api.Router().ServeHTTP(httptest.NewRecorder(), createHTTPRequest("POST", "/payments", payment, nil))
+
+	assert.Contains(out.String(), "Error adding by service")
+	assert.Contains(out.String(), `beneficiary \"[REDACTED]\" rejected`)
+	assert.NotContains(out.String(), name)
+}
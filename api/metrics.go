@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+
+	"github.com/mysza/paymentsapi/metrics"
+)
+
+const (
+	metricsRoute = "/metrics"
+)
+
+type httpMetrics struct {
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+func newHTTPMetrics(registry *metrics.Registry) *httpMetrics {
+	m := &httpMetrics{
+		requests: metrics.NewCounterVec(
+			"http_requests_total",
+			"Number of HTTP requests, by method, route pattern and status code.",
+			"method", "route", "status"),
+		duration: metrics.NewHistogramVec(
+			"http_request_duration_seconds",
+			"Latency of HTTP requests, by method, route pattern and status code.",
+			metrics.DefaultBuckets,
+			"method", "route", "status"),
+	}
+	registry.Register(m.requests, m.duration)
+	return m
+}
+
+// instrument is a middleware counting requests and measuring their latency.
+// Requests are labelled with the matched route pattern rather than the path,
+// so that payment IDs do not create new series.
+func (m *httpMetrics) instrument(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := routePattern(r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requests.Inc(r.Method, route, strconv.Itoa(status))
+		m.duration.Observe(time.Since(start).Seconds(), r.Method, route, strconv.Itoa(status))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// routePattern returns the route pattern matched by the request,
+// to be called once the request has been routed.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return "unmatched"
+}
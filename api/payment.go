@@ -1,14 +1,18 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+	"github.com/mysza/paymentsapi/auth"
 	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/logging"
 	"github.com/mysza/paymentsapi/service"
 )
 
@@ -24,154 +28,222 @@ type PaymentResource struct {
 }
 
 // NewPaymentResource creates and returns a payments resource.
-func NewPaymentResource(repo service.PaymentsRepository) *PaymentResource {
-	service := service.NewPaymentsService(repo)
+func NewPaymentResource(service *service.PaymentsService) *PaymentResource {
 	return &PaymentResource{service}
 }
 
 func (rs *PaymentResource) router() *chi.Mux {
 	r := chi.NewRouter()
-	r.Get("/", rs.getAll)
-	r.Post("/", rs.add)
-	r.Put("/", rs.update)
-	r.Get("/{paymentID}", rs.get)
-	r.Delete("/{paymentID}", rs.delete)
+	r.With(requireScope(auth.ScopePaymentsRead)).Get("/", rs.getAll)
+	r.With(requireScope(auth.ScopePaymentsWrite)).Post("/", rs.add)
+	r.With(requireScope(auth.ScopePaymentsWrite)).Put("/", rs.update)
+	r.With(requireScope(auth.ScopePaymentsRead)).Post("/quote", rs.quote)
+	r.With(requireScope(auth.ScopePaymentsRead)).Get("/{paymentID}", rs.get)
+	r.With(requireScope(auth.ScopePaymentsWrite)).Delete("/{paymentID}", rs.delete)
+	r.With(requireScope(auth.ScopePaymentsWrite)).Post("/{paymentID}/approvals", rs.approve)
+	r.With(requireScope(auth.ScopePaymentsRead)).Get("/{paymentID}/events", rs.history)
 	return r
 }
 
 func (rs *PaymentResource) getAll(w http.ResponseWriter, r *http.Request) {
-	payments, err := rs.service.GetAll()
+	payments, err := rs.service.GetAll(r.Context())
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/getAll",
 			"details":  "service.GetAll",
 			"error":    err,
 		}).Warn("Error getting payments from repository")
-		render.Render(w, r, &ErrResponse{
-			Error:      err,
-			StatusCode: http.StatusInternalServerError,
-			StatusText: http.StatusText(http.StatusInternalServerError),
-		})
+		renderError(w, r, serviceErrResponse(err))
+		return
 	}
-	render.Respond(w, r, newPaymentListResponse(payments))
+	respond(w, r, newPaymentListResponse(payments, maskAccounts(r)))
 }
 
 func (rs *PaymentResource) add(w http.ResponseWriter, r *http.Request) {
 	input := &paymentRequest{}
 	if err := render.Bind(r, input); err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/add",
 			"details":  "render.Bind",
 			"error":    err,
 		}).Warn("Error binding to the input")
-		render.Render(w, r, ErrBadRequest)
+		renderError(w, r, ErrBadRequest)
 		return
 	}
-	id, err := rs.service.Add(input.Payment)
+	logging.FromContext(r.Context()).WithField("payment", input.Payment).Debug("Adding payment")
+	id, err := rs.service.Add(r.Context(), input.Payment)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/add",
 			"details":  "service.Add",
 			"error":    err,
 		}).Warn("Error adding by service")
-		render.Render(w, r, ErrBadRequest)
+		renderError(w, r, serviceErrResponse(err))
 		return
 	}
+	logging.AddFields(r.Context(), logrus.Fields{"payment_id": id})
 	w.Header().Set("Location", fmt.Sprintf("/payments/%v", id))
-	logrus.WithField("location", "api/payment/add").Infof("Added new Payment with ID: %s", id)
+	logging.FromContext(r.Context()).WithField("location", "api/payment/add").Infof("Added new Payment with ID: %s", id)
 	w.WriteHeader(http.StatusCreated)
 }
 
 func (rs *PaymentResource) update(w http.ResponseWriter, r *http.Request) {
 	input := &paymentRequest{}
 	if err := render.Bind(r, input); err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/update",
 			"details":  "render.Bind",
 			"error":    err,
 		}).Warn("Error binding to the input")
-		render.Render(w, r, ErrBadRequest)
+		renderError(w, r, ErrBadRequest)
+		return
 	}
-	err := rs.service.Update(input.Payment)
+	logging.AddFields(r.Context(), logrus.Fields{"payment_id": input.ID})
+	logging.FromContext(r.Context()).WithField("payment", input.Payment).Debug("Updating payment")
+	err := rs.service.Update(r.Context(), input.Payment)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/update",
 			"details":  "service.Update",
 			"error":    err,
 		}).Warn("Error updating by service")
-		switch err.(type) {
-		case *service.InputError:
-			render.Render(w, r, ErrBadRequest)
-		case *service.NotFoundError:
-			render.Render(w, r, ErrNotFound)
-		default:
-			render.Render(w, r, ErrInternalServerError)
-		}
+		renderError(w, r, serviceErrResponse(err))
+		return
 	}
-	logrus.WithField("location", "api/payment/update").Infof("Updated Payment with ID: %s", input.ID)
+	logging.FromContext(r.Context()).WithField("location", "api/payment/update").Infof("Updated Payment with ID: %s", input.ID)
 	render.NoContent(w, r)
 }
 
+// quote responds with the payment completed with its charges, as they would
+// be calculated if it was added, without adding it.
+func (rs *PaymentResource) quote(w http.ResponseWriter, r *http.Request) {
+	input := &paymentRequest{}
+	if err := render.Bind(r, input); err != nil {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/payment/quote",
+			"details":  "render.Bind",
+			"error":    err,
+		}).Warn("Error binding to the input")
+		renderError(w, r, ErrBadRequest)
+		return
+	}
+	payment, err := rs.service.Quote(r.Context(), input.Payment)
+	if err != nil {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/payment/quote",
+			"details":  "service.Quote",
+			"error":    err,
+		}).Warn("Error quoting by service")
+		renderError(w, r, serviceErrResponse(err))
+		return
+	}
+	respond(w, r, newPaymentResponse(payment, maskAccounts(r)))
+}
+
 func (rs *PaymentResource) get(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "paymentID")
-	payment, err := rs.service.Get(id)
+	logging.AddFields(r.Context(), logrus.Fields{"payment_id": id})
+	payment, err := rs.service.Get(r.Context(), id)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/get",
 			"details":  "service.Get",
-			"id":       id,
 			"error":    err,
 		}).Warn("Error getting by service")
-		switch err.(type) {
-		case *service.InputError:
-			render.Render(w, r, ErrBadRequest)
-		case *service.NotFoundError:
-			render.Render(w, r, ErrNotFound)
-		default:
-			render.Render(w, r, ErrInternalServerError)
-		}
+		renderError(w, r, serviceErrResponse(err))
+		return
 	}
-	render.Respond(w, r, newPaymentResponse(payment))
+	respond(w, r, newPaymentResponse(payment, maskAccounts(r)))
 }
 
 func (rs *PaymentResource) delete(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "paymentID")
-	err := rs.service.Delete(id)
+	logging.AddFields(r.Context(), logrus.Fields{"payment_id": id})
+	err := rs.service.Delete(r.Context(), id)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
 			"location": "api/payment/delete",
 			"details":  "service.Delete",
-			"id":       id,
 			"error":    err,
 		}).Warn("Error deleting by service")
-		switch err.(type) {
-		case *service.InputError:
-			render.Render(w, r, ErrBadRequest)
-		case *service.NotFoundError:
-			render.Render(w, r, ErrNotFound)
-		default:
-			render.Render(w, r, ErrInternalServerError)
-		}
+		renderError(w, r, serviceErrResponse(err))
+		return
 	}
 	render.NoContent(w, r)
 }
 
+func (rs *PaymentResource) approve(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "paymentID")
+	logging.AddFields(r.Context(), logrus.Fields{"payment_id": id})
+	payment, err := rs.service.Approve(r.Context(), id)
+	if err != nil {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/payment/approve",
+			"details":  "service.Approve",
+			"error":    err,
+		}).Warn("Error approving by service")
+		renderError(w, r, serviceErrResponse(err))
+		return
+	}
+	logging.FromContext(r.Context()).WithField("location", "api/payment/approve").Infof("Approved Payment with ID: %s, status: %s", id, payment.Status)
+	render.Status(r, http.StatusCreated)
+	respond(w, r, newPaymentResponse(payment, maskAccounts(r)))
+}
+
+func (rs *PaymentResource) history(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "paymentID")
+	logging.AddFields(r.Context(), logrus.Fields{"payment_id": id})
+	events, err := rs.service.History(r.Context(), id)
+	if err != nil {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"location": "api/payment/history",
+			"details":  "service.History",
+			"error":    err,
+		}).Warn("Error getting history by service")
+		renderError(w, r, serviceErrResponse(err))
+		return
+	}
+	respond(w, r, newEventListResponse(events, maskAccounts(r)))
+}
+
+var errMissingPayment = errors.New("missing payment")
+
 type paymentRequest struct {
 	*domain.Payment
 }
 
+// Bind rejects bodies without a payment, e.g. {} or null, which leave it nil,
+// and registers the personal data of the payment, so that it is scrubbed from
+// the logs of the request, e.g. from errors quoting it.
 func (c *paymentRequest) Bind(r *http.Request) error {
+	if c.Payment == nil {
+		return errMissingPayment
+	}
+	logging.AddPersonalData(r.Context(), c.Payment.PersonalData()...)
 	return nil
 }
 
 type paymentResponse struct {
 	*domain.Payment
-	Type    string `json:"type"`
-	Version int    `json:"version"`
+	Type string `json:"type"`
+}
+
+// maskAccounts decides if account numbers are masked in the response, which
+// is the case on request with ?mask=true and for callers authenticated
+// without the scope granting access to personal data.
+func maskAccounts(r *http.Request) bool {
+	if mask, _ := strconv.ParseBool(r.URL.Query().Get("mask")); mask {
+		return true
+	}
+	principal, ok := auth.FromContext(r.Context())
+	return ok && !principal.HasScope(auth.ScopePaymentsPII)
 }
 
-func newPaymentResponse(payment *domain.Payment) *paymentResponse {
-	return &paymentResponse{Payment: payment, Type: "Payment", Version: 0}
+func newPaymentResponse(payment *domain.Payment, mask bool) *paymentResponse {
+	if mask {
+		payment = domain.MaskAccountNumbers(payment)
+	}
+	return &paymentResponse{Payment: payment, Type: "Payment"}
 }
 
 // PaymentListResponse is the response payload for a list of Payments.
@@ -179,10 +251,27 @@ type paymentListResponse struct {
 	Data []*paymentResponse `json:"data"`
 }
 
-func newPaymentListResponse(payments []*domain.Payment) *paymentListResponse {
+func newPaymentListResponse(payments []*domain.Payment, mask bool) *paymentListResponse {
 	list := []*paymentResponse{}
 	for _, payment := range payments {
-		list = append(list, newPaymentResponse(payment))
+		list = append(list, newPaymentResponse(payment, mask))
 	}
 	return &paymentListResponse{Data: list}
 }
+
+// eventListResponse is the response payload for the history of a Payment.
+type eventListResponse struct {
+	Data []*domain.Event `json:"data"`
+}
+
+func newEventListResponse(events []domain.Event, mask bool) *eventListResponse {
+	list := []*domain.Event{}
+	for ix := range events {
+		event := &events[ix]
+		if mask {
+			event = domain.MaskEventAccountNumbers(event)
+		}
+		list = append(list, event)
+	}
+	return &eventListResponse{Data: list}
+}
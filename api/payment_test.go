@@ -3,18 +3,21 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/copier"
 	"github.com/stretchr/testify/mock"
 
+	"github.com/mysza/paymentsapi/auth"
 	"github.com/mysza/paymentsapi/domain"
 	"github.com/mysza/paymentsapi/service"
 	"github.com/mysza/paymentsapi/service/mocks"
@@ -58,16 +61,22 @@ func createHTTPRequest(method, path string, input *domain.Payment, ctx *httpRequ
 	return req
 }
 
+func createRawHTTPRequest(method, path, body string) *http.Request {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Add("content-type", "application/json")
+	return req
+}
+
 func prepareRepository(newID string, existing, notExisting *domain.Payment) service.PaymentsRepository {
 	repo := new(mocks.PaymentsRepository)
-	repo.On("Add", mock.Anything).Return(newID, nil)
-	repo.On("Exists", existing.ID).Return(true)
-	repo.On("Exists", notExisting.ID).Return(false)
-	repo.On("Update", existing).Return(nil)
-	repo.On("GetAll").Return([]*domain.Payment{existing, existing, existing}, nil)
-	repo.On("Get", existing.ID).Return(existing, nil)
-	repo.On("Get", notExisting.ID).Return(nil, errors.New("not found"))
-	repo.On("Delete", existing.ID).Return(nil)
+	repo.On("Add", mock.Anything, mock.Anything).Return(newID, nil)
+	repo.On("Exists", mock.Anything, existing.ID).Return(true)
+	repo.On("Exists", mock.Anything, notExisting.ID).Return(false)
+	repo.On("Update", mock.Anything, mock.Anything).Return(nil)
+	repo.On("GetAll", mock.Anything).Return([]*domain.Payment{existing, existing, existing}, nil)
+	repo.On("Get", mock.Anything, existing.ID).Return(existing, nil)
+	repo.On("Get", mock.Anything, notExisting.ID).Return(nil, errors.New("not found"))
+	repo.On("Delete", mock.Anything, existing.ID).Return(nil)
 	return repo
 }
 
@@ -89,7 +98,7 @@ func TestAPI(t *testing.T) {
 
 	repo := prepareRepository(newID, validPayment, validPaymentNotExisting)
 
-	paymentResource := NewPaymentResource(repo)
+	paymentResource := NewPaymentResource(service.NewPaymentsService(repo))
 	addHandler := http.HandlerFunc(paymentResource.add)
 	updateHandler := http.HandlerFunc(paymentResource.update)
 	getAllHandler := http.HandlerFunc(paymentResource.getAll)
@@ -122,6 +131,24 @@ func TestAPI(t *testing.T) {
 			handler:      updateHandler,
 			expectedCode: http.StatusBadRequest,
 		},
+		{
+			name:         "PUT: empty body",
+			request:      createRawHTTPRequest("PUT", "/", "{}"),
+			handler:      updateHandler,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "PUT: null body",
+			request:      createRawHTTPRequest("PUT", "/", "null"),
+			handler:      updateHandler,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "POST: null body",
+			request:      createRawHTTPRequest("POST", "/", "null"),
+			handler:      addHandler,
+			expectedCode: http.StatusBadRequest,
+		},
 		{
 			name:         "PUT: non-existing payment",
 			request:      createHTTPRequest("PUT", "/", validPaymentNotExisting, nil),
@@ -174,3 +201,159 @@ func TestAPI(t *testing.T) {
 		})
 	}
 }
+
+func TestViolations(t *testing.T) {
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	payment.ID = ""
+	payment.Attributes.Currency = "EUR"
+	addHandler := http.HandlerFunc(NewPaymentResource(service.NewPaymentsService(nil,
+		service.WithSchemeRules(service.DefaultSchemeRules))).add)
+	recorder := httptest.NewRecorder()
+
+	addHandler.ServeHTTP(recorder, createHTTPRequest("POST", "/", payment, nil))
+
+	var body ErrResponse
+	json.NewDecoder(recorder.Body).Decode(&body)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, body.Violations, service.Violation{
+		Field:   "attributes.currency",
+		Rule:    "currency",
+		Message: "must be one of GBP",
+	})
+}
+
+func TestQuote(t *testing.T) {
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	payment.ID = ""
+	payment.Attributes.ChargesInformation = domain.ChargesInformation{BearerCode: service.BearerDebtor}
+	repo := new(mocks.PaymentsRepository)
+	api, _ := NewAPI(service.NewPaymentsService(repo, service.WithTariffs(service.TariffConfig{
+		Tariffs: service.Tariffs{"FPS": {"GBP": {Sender: service.Fee{Flat: "0.50"}, Receiver: service.Fee{Flat: "0.25"}}}},
+	})))
+	body, _ := json.Marshal(payment)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/payments/quote", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	api.Router().ServeHTTP(recorder, req)
+
+	var quoted paymentResponse
+	json.NewDecoder(recorder.Body).Decode(&quoted)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []domain.Charge{{Amount: "0.75", Currency: "GBP"}}, quoted.Attributes.ChargesInformation.SenderCharges)
+	assert.Equal(t, "0.00", quoted.Attributes.ChargesInformation.ReceiverChargesAmount)
+	repo.AssertNotCalled(t, "Add", mock.Anything, mock.Anything)
+}
+
+func TestMaskedResponses(t *testing.T) {
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	accountNumber := payment.Attributes.Beneficiary.AccountNumber
+	repo := new(mocks.PaymentsRepository)
+	repo.On("Get", mock.Anything, payment.ID).Return(payment, nil)
+	getHandler := http.HandlerFunc(NewPaymentResource(service.NewPaymentsService(repo)).get)
+	withPrincipal := func(req *http.Request, scopes ...string) *http.Request {
+		return req.WithContext(auth.NewContext(req.Context(), &auth.Principal{Subject: "caller", OrganisationID: payment.OrganisationID, Scopes: scopes}))
+	}
+	get := func(path string) *http.Request {
+		return createHTTPRequest("GET", path, nil, &httpRequestContext{"paymentID", payment.ID})
+	}
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		masked bool
+	}{
+		{"Anonymous caller", get("/" + payment.ID), false},
+		{"Masking requested", get("/" + payment.ID + "?mask=true"), true},
+		{"Caller without PII scope", withPrincipal(get("/"+payment.ID), auth.ScopePaymentsRead), true},
+		{"Caller with PII scope", withPrincipal(get("/"+payment.ID), auth.ScopePaymentsRead, auth.ScopePaymentsPII), false},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+
+			getHandler.ServeHTTP(recorder, testCase.req)
+
+			body := recorder.Body.String()
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			if testCase.masked {
+				assert.NotContains(t, body, accountNumber)
+				assert.Contains(t, body, accountNumber[len(accountNumber)-4:])
+			} else {
+				assert.Contains(t, body, accountNumber)
+			}
+		})
+	}
+}
+
+func TestResponseVersion(t *testing.T) {
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	payment.Version = 3
+
+	data, err := json.Marshal(newPaymentResponse(payment, false))
+	var response map[string]interface{}
+	json.Unmarshal(data, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Payment", response["type"])
+	assert.Equal(t, float64(3), response["version"], "Responses must report the stored version")
+}
+
+func TestHistory(t *testing.T) {
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	accountNumber := payment.Attributes.Beneficiary.AccountNumber
+	repo := &eventStore{
+		PaymentsRepository: new(mocks.PaymentsRepository),
+		events: []domain.Event{
+			{Type: domain.EventPaymentCreated, PaymentID: payment.ID, Version: 1, Payment: payment},
+			{Type: domain.EventBeneficiaryChanged, PaymentID: payment.ID, Version: 2, Beneficiary: &payment.Attributes.Beneficiary},
+		},
+	}
+	historyHandler := http.HandlerFunc(NewPaymentResource(service.NewPaymentsService(repo)).history)
+	get := func(id, query string) *http.Request {
+		return createHTTPRequest("GET", "/"+id+"/events"+query, nil, &httpRequestContext{"paymentID", id})
+	}
+
+	t.Run("Events of the payment are returned", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+
+		historyHandler.ServeHTTP(recorder, get(payment.ID, ""))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), domain.EventBeneficiaryChanged)
+		assert.Contains(t, recorder.Body.String(), accountNumber)
+	})
+
+	t.Run("Account numbers of events are masked", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+
+		historyHandler.ServeHTTP(recorder, get(payment.ID, "?mask=true"))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.NotContains(t, recorder.Body.String(), accountNumber)
+	})
+
+	t.Run("Payments without events are not found", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		repo := &eventStore{PaymentsRepository: new(mocks.PaymentsRepository)}
+		handler := http.HandlerFunc(NewPaymentResource(service.NewPaymentsService(repo)).history)
+
+		handler.ServeHTTP(recorder, get(payment.ID, ""))
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
+
+// eventStore is a mocked repository which is an event store.
+type eventStore struct {
+	*mocks.PaymentsRepository
+	events []domain.Event
+}
+
+func (s *eventStore) Append(context.Context, string, []domain.Event) error {
+	return nil
+}
+
+func (s *eventStore) Events(context.Context, string) ([]domain.Event, error) {
+	return s.events, nil
+}
@@ -3,13 +3,24 @@ package api
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/dgraph-io/badger"
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/encryption"
+	"github.com/mysza/paymentsapi/health"
+	"github.com/mysza/paymentsapi/metrics"
 	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/cache"
+	"github.com/mysza/paymentsapi/repository/postgres"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/tracing"
 	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 // Server is the HTTP server of the Payments API.
@@ -17,56 +28,350 @@ type Server struct {
 	*http.Server
 }
 
-func createDatabase(databaseDir string) (*badger.DB, error) {
-	opts := badger.DefaultOptions
-	opts.Dir = databaseDir
-	opts.ValueDir = databaseDir
-	return badger.Open(opts)
+// Config holds the configuration of the HTTP server.
+type Config struct {
+	Host  string     // Host is the address the server binds to; empty binds all interfaces
+	Port  string     // Port the server listens on
+	Store string     // Store is StoreBadger, the default, StoreEventStore, StoreMemory, StoreSQLite or StorePostgres
+	DBDir string     // DBDir is the directory of the database files
+	Auth  AuthConfig // Auth configures the authentication of requests
+	RBAC  RBACConfig // RBAC configures the role based access control
+	TLS   TLSConfig  // TLS configures TLS and mutual TLS
+
+	Tracing TracingConfig // Tracing configures the export of traces
+
+	ReadTimeout       time.Duration // ReadTimeout limits reading the entire request
+	ReadHeaderTimeout time.Duration // ReadHeaderTimeout limits reading the request headers
+	WriteTimeout      time.Duration // WriteTimeout limits writing the response
+	IdleTimeout       time.Duration // IdleTimeout limits waiting for the next request on keep-alive connections
+	MaxHeaderBytes    int           // MaxHeaderBytes limits the size of request headers
+	ShutdownTimeout   time.Duration // ShutdownTimeout is the grace period for in-flight requests on shutdown
+	ShutdownDelay     time.Duration // ShutdownDelay is how long the server keeps serving while reported not ready
+
+	SQLitePath string          // SQLitePath is the file of the SQLite database
+	Postgres   postgres.Config // Postgres configures the connections to the PostgreSQL database
+
+	CacheSize int           // CacheSize is the number of payments cached in memory; zero disables the cache
+	CacheTTL  time.Duration // CacheTTL is how long payments are cached
+
+	MinFreeDisk    uint64        // MinFreeDisk is the free space in the database directory required to be ready
+	GCInterval     time.Duration // GCInterval is how often the value log garbage collection runs; zero disables it
+	GCDiscardRatio float64       // GCDiscardRatio is the fraction of stale data for a value log file to be rewritten
+
+	EncryptionKeyfile string // EncryptionKeyfile holds the master keys encrypting personal data; empty disables encryption
+	Codec             string // Codec encodes the payments written to the badger store: json or binary
+
+	Approvals   service.ApprovalConfig         // Approvals configures the approval workflow
+	SchemeRules map[string]service.SchemeRules // SchemeRules are the rules of payment schemes by name; nil disables them
+	Calendars   service.CalendarConfig         // Calendars configures the business days of processing dates; no calendars disables them
+	FX          *service.FXConfig              // FX configures the checks of exchange rates; nil disables them
+	Tariffs     *service.TariffConfig          // Tariffs configures the calculation of charges; nil disables it
+}
+
+// AuthConfig configures the bearer token authentication.
+// Authentication is disabled if JWKS is empty.
+type AuthConfig struct {
+	JWKS              string        // JWKS is a path or http(s) URL of the JSON Web Key Set
+	JWKSRefresh       time.Duration // JWKSRefresh is how often the key set is reloaded
+	Issuer            string        // Issuer is the required token issuer
+	Audience          string        // Audience is the required token audience
+	OrganisationClaim string        // OrganisationClaim names the claim with the caller organisation
+	RolesClaim        string        // RolesClaim names the claim with the caller roles
+}
+
+// RBACConfig configures the role based access control of payment operations.
+// When disabled, every caller may perform every operation.
+type RBACConfig struct {
+	Enabled bool                // Enabled turns on the role based access control
+	Roles   map[string][]string // Roles maps role names to allowed actions; defaults to service.DefaultRoles
 }
 
-// StartHTTPServer starts HTTP server on a given port, with database
-// being used at dbDir.
-func StartHTTPServer(port, dbDir string) error {
-	db, err := createDatabase(dbDir)
+// TracingConfig configures the tracing of requests.
+type TracingConfig struct {
+	Exporter    string  // Exporter is one of "none", "stdout" or "otlp"
+	Endpoint    string  // Endpoint is the URL of the OTLP/HTTP traces endpoint
+	ServiceName string  // ServiceName identifies the service in exported traces
+	SampleRatio float64 // SampleRatio is the ratio of new traces which are recorded
+}
+
+func createTracerProvider(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	var processor sdktrace.SpanProcessor
+	switch config.Exporter {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		processor = sdktrace.NewSimpleSpanProcessor(tracing.NewWriterExporter(os.Stdout))
+	case "otlp":
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = tracing.DefaultOTLPEndpoint
+		}
+		processor = sdktrace.NewBatchSpanProcessor(tracing.NewOTLPExporter(endpoint))
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", config.Exporter)
+	}
+	return tracing.NewProvider(processor, config.ServiceName, config.SampleRatio), nil
+}
+
+func createPolicy(config RBACConfig) (service.Policy, error) {
+	if !config.Enabled {
+		return service.AllowAll{}, nil
+	}
+	if len(config.Roles) == 0 {
+		return service.NewRolePolicy(service.DefaultRoles)
+	}
+	return service.NewRolePolicy(config.Roles)
+}
+
+func createVerifier(config AuthConfig) (*auth.Verifier, error) {
+	if config.JWKS == "" {
+		return nil, nil
+	}
+	keys, err := auth.NewKeySet(config.JWKS, config.JWKSRefresh)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"location": "api/server/StartHTTPServer",
-			"details":  "database open",
-			"error":    err,
-		}).Error("Error opening database")
-		panic(err)
+		return nil, err
+	}
+	return auth.NewVerifier(keys, auth.VerifierConfig{
+		Issuer:            config.Issuer,
+		Audience:          config.Audience,
+		OrganisationClaim: config.OrganisationClaim,
+		RolesClaim:        config.RolesClaim,
+	}), nil
+}
+
+func createEncrypter(keyfile string) (*encryption.Encrypter, error) {
+	if keyfile == "" {
+		return nil, nil
 	}
-	defer db.Close()
-	repo := repository.New(db)
-	api, err := NewAPI(repo)
+	keyring, err := encryption.LoadKeyring(keyfile)
 	if err != nil {
+		return nil, err
+	}
+	return encryption.NewEncrypter(keyring), nil
+}
+
+// reencrypt re-encrypts payments not encrypted with the active master key,
+// e.g. after rotation, until done or ctx is cancelled.
+func reencrypt(ctx context.Context, repo *repository.PaymentsRepository) {
+	count, err := repo.Reencrypt(ctx)
+	if err != nil && ctx.Err() == nil {
 		logrus.WithFields(logrus.Fields{
-			"location": "api/server/StartHTTPServer",
-			"details":  "api creation",
+			"location": "api/server/reencrypt",
+			"details":  "repository.Reencrypt",
 			"error":    err,
-		}).Error("Error creating API")
-		panic(err)
+		}).Error("Failed to re-encrypt payments")
+		return
 	}
-	srv := http.Server{Addr: fmt.Sprintf("localhost:%v", port), Handler: api.Router()}
-	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	if count > 0 {
+		logrus.WithField("location", "api/server/reencrypt").Infof("Re-encrypted %d payments with the active key", count)
+	}
+}
+
+// rotateKeys re-encrypts payments with the active master key, and again
+// whenever a signal is received on reload, e.g. once the keyfile is rotated
+// while the server holds the database. The keyring is reloaded from the
+// keyfile first, unless that fails.
+func rotateKeys(ctx context.Context, keyfile string, encrypter *encryption.Encrypter, repo *repository.PaymentsRepository, reload <-chan os.Signal) {
+	reencrypt(ctx, repo)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		}
+		keyring, err := encryption.LoadKeyring(keyfile)
+		if err == nil {
+			err = encrypter.Reload(keyring)
+		}
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
-				"location": "api/server/StartHTTPServer",
-				"details":  "listen & serve",
+				"location": "api/server/rotateKeys",
+				"details":  "Reload",
 				"error":    err,
-			}).Error("Error starting HTTP Server")
-			panic(err)
+			}).Error("Failed to reload encryption keys")
+			continue
+		}
+		logrus.WithField("location", "api/server/rotateKeys").Infof("Reloaded encryption keys, active key %s", keyring.Active)
+		reencrypt(ctx, repo)
+	}
+}
+
+// inBackground runs fn in a goroutine, returning the function which cancels
+// the context of fn and waits for it to return.
+func inBackground(fn func(ctx context.Context)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// ServiceOptions returns the options of the payments service checking and
+// completing payments as configured: the approvals, the rules of payment
+// schemes, the calendars, the FX and the tariffs. It returns an error if any
+// of them is invalid.
+func ServiceOptions(config *Config) ([]service.Option, error) {
+	if err := config.Approvals.Validate(); err != nil {
+		return nil, fmt.Errorf("loading approvals: %v", err)
+	}
+	if err := service.ValidateSchemeRules(config.SchemeRules); err != nil {
+		return nil, fmt.Errorf("loading scheme rules: %v", err)
+	}
+	if config.FX != nil {
+		if err := config.FX.Validate(); err != nil {
+			return nil, fmt.Errorf("loading FX: %v", err)
+		}
+	}
+	if config.Tariffs != nil {
+		if err := config.Tariffs.Validate(); err != nil {
+			return nil, fmt.Errorf("loading tariffs: %v", err)
+		}
+	}
+	opts := []service.Option{service.WithApprovals(config.Approvals)}
+	if config.SchemeRules != nil {
+		opts = append(opts, service.WithSchemeRules(config.SchemeRules))
+	}
+	if config.Calendars.Calendars != nil {
+		opts = append(opts, service.WithCalendars(config.Calendars))
+	}
+	if config.FX != nil {
+		opts = append(opts, service.WithFX(*config.FX))
+	}
+	if config.Tariffs != nil {
+		opts = append(opts, service.WithTariffs(*config.Tariffs))
+	}
+	return opts, nil
+}
+
+// StartHTTPServer starts HTTP server on the configured address, with payments
+// kept in the configured store. It blocks until the process receives
+// SIGINT or SIGTERM, and then shuts the server down gracefully.
+func StartHTTPServer(config *Config) error {
+	store, err := openStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	provider, err := createTracerProvider(config.Tracing)
+	if err != nil {
+		return fmt.Errorf("configuring tracing: %v", err)
+	}
+	if provider != nil {
+		tracing.SetProvider(provider)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			provider.Shutdown(ctx)
+		}()
+	}
+	registry := metrics.NewRegistry()
+	if store.collector != nil {
+		registry.Register(store.collector)
+	}
+	shutdown := &health.Shutdown{}
+	readiness := health.NewRegistry(health.DefaultTimeout)
+	for name, check := range store.checks {
+		readiness.Register(name, check)
+	}
+	readiness.Register("shutdown", shutdown.Check)
+	verifier, err := createVerifier(config.Auth)
+	if err != nil {
+		return fmt.Errorf("loading token verification keys: %v", err)
+	}
+	if verifier == nil {
+		logrus.WithField("location", "api/server/StartHTTPServer").Warn("No JWKS configured, authentication is disabled")
+	}
+	policy, err := createPolicy(config.RBAC)
+	if err != nil {
+		return fmt.Errorf("loading access control policy: %v", err)
+	}
+	opts := []Option{WithMetrics(registry), WithHealth(readiness)}
+	if store.backuper != nil {
+		opts = append(opts, WithBackup(store.backuper))
+	}
+	if verifier != nil {
+		opts = append(opts, WithVerifier(verifier))
+	}
+	if config.TLS.ClientCAFile != "" {
+		opts = append(opts, WithClientCertIdentity(config.TLS.ClientScopes, config.TLS.ClientRoles))
+	}
+	serviceOpts, err := ServiceOptions(config)
+	if err != nil {
+		return err
+	}
+	repo := store.repo
+	if config.CacheSize > 0 {
+		repo = cache.New(repo, cache.WithSize(config.CacheSize), cache.WithTTL(config.CacheTTL), cache.WithMetrics(registry))
+	}
+	serviceOpts = append(serviceOpts, service.WithPolicy(policy), service.WithMetrics(registry))
+	api, err := NewAPI(service.NewPaymentsService(repo, serviceOpts...), opts...)
+	if err != nil {
+		return fmt.Errorf("creating API: %v", err)
+	}
+	srv := &http.Server{
+		Addr:              net.JoinHostPort(config.Host, config.Port),
+		Handler:           api.Router(),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	listen := srv.ListenAndServe
+	if config.TLS.CertFile != "" {
+		certs, err := newCertReloader(config.TLS)
+		if err == nil {
+			err = certs.watch()
+		}
+		if err != nil {
+			return fmt.Errorf("loading TLS certificates: %v", err)
+		}
+		defer certs.close()
+		srv.TLSConfig = certs.tlsConfig()
+		listen = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(quit)
+	drain := func() {
+		shutdown.Begin()
+		time.Sleep(config.ShutdownDelay)
+	}
+	return serve(srv, listen, quit, drain, config.ShutdownTimeout)
+}
+
+// serve runs listen until it fails or a signal is received on quit. On signal,
+// drain is called while the server still accepts connections, and then
+// in-flight requests are given the grace period to complete before the
+// remaining connections are closed.
+func serve(srv *http.Server, listen func() error, quit <-chan os.Signal, drain func(), grace time.Duration) error {
+	failed := make(chan error, 1)
+	go func() {
+		if err := listen(); err != http.ErrServerClosed {
+			failed <- err
 		}
 	}()
 	logrus.Printf("Listening on %s\n", srv.Addr)
 
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
-	sig := <-quit
-	logrus.Println("Shutting down server... Reason:", sig)
+	select {
+	case err := <-failed:
+		return fmt.Errorf("starting HTTP server: %v", err)
+	case sig := <-quit:
+		logrus.Println("Shutting down server... Reason:", sig)
+	}
+	drain()
 
-	if err := srv.Shutdown(context.Background()); err != nil {
-		panic(err)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutting down HTTP server: %v", err)
 	}
 	logrus.Println("Server stopped")
 	return nil
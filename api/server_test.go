@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/encryption"
+	"github.com/mysza/paymentsapi/health"
+	"github.com/mysza/paymentsapi/metrics"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/service/mocks"
+)
+
+func startServe(t *testing.T, handler http.Handler, drain func(), grace time.Duration) (string, chan<- os.Signal, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+	quit := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(srv, func() error { return srv.Serve(listener) }, quit, drain, grace)
+	}()
+	return "http://" + listener.Addr().String(), quit, done
+}
+
+func TestServe(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("In-flight requests complete on SIGTERM", func(t *testing.T) {
+		url, quit, done := startServe(t, slow, func() {}, time.Second)
+		responses := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(url)
+			if err != nil {
+				responses <- 0
+				return
+			}
+			resp.Body.Close()
+			responses <- resp.StatusCode
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		quit <- syscall.SIGTERM
+
+		assert.Equal(t, http.StatusOK, <-responses)
+		assert.Nil(t, <-done)
+	})
+
+	t.Run("Shutdown fails when grace period is exceeded", func(t *testing.T) {
+		url, quit, done := startServe(t, slow, func() {}, 10*time.Millisecond)
+		go http.Get(url)
+		time.Sleep(50 * time.Millisecond)
+
+		quit <- syscall.SIGTERM
+
+		assert.Error(t, <-done)
+	})
+
+	t.Run("Readiness fails while draining", func(t *testing.T) {
+		shutdown := &health.Shutdown{}
+		readiness := health.NewRegistry(health.DefaultTimeout)
+		readiness.Register("shutdown", shutdown.Check)
+		draining, drained := make(chan struct{}), make(chan struct{})
+		drain := func() {
+			shutdown.Begin()
+			close(draining)
+			<-drained
+		}
+		url, quit, done := startServe(t, readiness.Handler(), drain, time.Second)
+		resp, err := http.Get(url)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+
+		quit <- syscall.SIGTERM
+		<-draining
+
+		resp, err = http.Get(url)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		close(drained)
+		assert.Nil(t, <-done)
+	})
+
+	t.Run("Listen errors are returned", func(t *testing.T) {
+		srv := &http.Server{Addr: "127.0.0.1:0"}
+		listenErr := &net.OpError{Op: "listen"}
+
+		err := serve(srv, func() error { return listenErr }, make(chan os.Signal), func() {}, time.Second)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	repo := new(mocks.PaymentsRepository)
+	repo.On("Get", mock.Anything, "missing").Return(nil, errors.New("not found"))
+	registry := metrics.NewRegistry()
+	api, _ := NewAPI(service.NewPaymentsService(repo, service.WithMetrics(registry)), WithMetrics(registry))
+
+	api.Router().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/payments/missing", nil))
+	recorder := httptest.NewRecorder()
+	api.Router().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(http.StatusOK, recorder.Code)
+	body := recorder.Body.String()
+	assert.Contains(body, `http_requests_total{method="GET",route="/payments/{paymentID}",status="404"} 1`)
+	assert.Contains(body, `payments_operations_total{operation="get",outcome="not_found"} 1`)
+}
+
+func TestOpenStore(t *testing.T) {
+	t.Run("Stores without encryption at rest refuse keyfiles", func(t *testing.T) {
+		for _, name := range []string{StoreEventStore, StoreMemory, StoreSQLite, StorePostgres} {
+			_, err := openStore(&Config{Store: name, EncryptionKeyfile: "keys.json"})
+
+			if assert.Error(t, err, name) {
+				assert.Contains(t, err.Error(), "encryption at rest is not supported", name)
+			}
+		}
+	})
+}
+
+func TestServiceOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := ServiceOptions(&Config{FX: &service.FXConfig{Tolerance: "0.01"}})
+	_, invalidErr := ServiceOptions(&Config{FX: &service.FXConfig{Tolerance: "-1"}})
+
+	assert.Nil(err)
+	assert.Len(opts, 2, "Approvals and FX must be configured")
+	assert.NotNil(invalidErr)
+}
+
+func TestRotateKeys(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "paymentsapikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "keys.json")
+	keyring, _ := encryption.NewKeyring()
+	keyring.Save(keyfile)
+	db, err := repository.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	encrypter := encryption.NewEncrypter(keyring)
+	repo := repository.New(db, repository.WithEncryption(encrypter))
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "clerk"})
+	repo.Add(ctx, repositorytest.NewPayment(t))
+	rotated, _ := encryption.LoadKeyring(keyfile)
+	rotated.Rotate()
+	rotated.Save(keyfile)
+	reload := make(chan os.Signal)
+
+	stop := inBackground(func(ctx context.Context) { rotateKeys(ctx, keyfile, encrypter, repo, reload) })
+	// the second signal is received only once the first one is handled
+	reload <- syscall.SIGHUP
+	reload <- syscall.SIGHUP
+	stop()
+	pending, err := repo.Reencrypt(context.Background())
+
+	assert.Nil(err)
+	assert.Equal(0, pending, "Payments must be re-encrypted with the reloaded active key")
+	encrypted, _ := encrypter.EncryptPayment(repositorytest.NewPayment(t))
+	assert.Contains(encrypted.Attributes.Debtor.Name, rotated.Active)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/mysza/paymentsapi/health"
+	"github.com/mysza/paymentsapi/metrics"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/eventstore"
+	"github.com/mysza/paymentsapi/repository/memory"
+	"github.com/mysza/paymentsapi/repository/postgres"
+	"github.com/mysza/paymentsapi/repository/sqlite"
+	"github.com/mysza/paymentsapi/service"
+)
+
+// Stores of payments.
+const (
+	StoreBadger     = "badger"     // StoreBadger keeps payments in the Badger database in DBDir
+	StoreEventStore = "eventstore" // StoreEventStore keeps the events of payments in the Badger database in DBDir
+	StoreMemory     = "memory"     // StoreMemory keeps payments in memory, losing them on exit
+	StoreSQLite     = "sqlite"     // StoreSQLite keeps payments in the SQLite database in SQLitePath
+	StorePostgres   = "postgres"   // StorePostgres keeps payments in the PostgreSQL database of Postgres, shared by replicas
+)
+
+// store is the payments repository selected by the configuration, with the
+// extensions of the API it supports.
+type store struct {
+	repo      service.PaymentsRepository
+	backuper  Backuper                // backuper is nil when backups are not supported
+	collector metrics.Collector       // collector gathers statistics of the store, if any
+	checks    map[string]health.Check // checks of the readiness of the store by name
+	close     func()
+}
+
+// openStore opens the store of the configuration,
+// which must be closed once the server is shut down.
+func openStore(config *Config) (*store, error) {
+	if config.Store == StoreBadger || config.Store == "" {
+		return openBadgerStore(config)
+	}
+	if config.EncryptionKeyfile != "" {
+		return nil, fmt.Errorf("encryption at rest is not supported by the %s store", config.Store)
+	}
+	switch config.Store {
+	case StoreEventStore:
+		return openEventStore(config)
+	case StoreMemory:
+		return &store{repo: memory.New(), close: func() {}}, nil
+	case StoreSQLite:
+		db, err := sqlite.Open(config.SQLitePath)
+		if err != nil {
+			return nil, fmt.Errorf("opening SQLite database: %v", err)
+		}
+		repo := sqlite.New(db)
+		return &store{
+			repo:   repo,
+			checks: map[string]health.Check{"sqlite": repo.Check},
+			close:  func() { db.Close() },
+		}, nil
+	case StorePostgres:
+		db, err := postgres.Open(config.Postgres)
+		if err != nil {
+			return nil, fmt.Errorf("opening PostgreSQL database: %v", err)
+		}
+		repo := postgres.New(db)
+		return &store{
+			repo:   repo,
+			checks: map[string]health.Check{"postgres": repo.Check},
+			close:  func() { db.Close() },
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown store %q", config.Store)
+}
+
+// storeCodec returns the configured codec, JSON by default.
+func storeCodec(config *Config) (repository.Codec, error) {
+	if config.Codec == "" {
+		return repository.JSONCodec, nil
+	}
+	return repository.CodecByName(config.Codec)
+}
+
+func openBadgerStore(config *Config) (*store, error) {
+	encrypter, err := createEncrypter(config.EncryptionKeyfile)
+	if err != nil {
+		return nil, fmt.Errorf("loading encryption keys: %v", err)
+	}
+	db, err := openBadger(config)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := storeCodec(config)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	repoOpts := []repository.Option{repository.WithCodec(codec)}
+	if encrypter != nil {
+		repoOpts = append(repoOpts, repository.WithEncryption(encrypter))
+	}
+	repo := repository.New(db, repoOpts...)
+	var stops []func()
+	if encrypter != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		stops = append(stops, func() { signal.Stop(reload) }, inBackground(func(ctx context.Context) {
+			rotateKeys(ctx, config.EncryptionKeyfile, encrypter, repo, reload)
+		}))
+	}
+	stops = append(stops, runBadgerGC(config, db))
+	return &store{
+		repo:      repo,
+		backuper:  repo,
+		collector: repository.NewStatsCollector(db),
+		checks:    badgerChecks(config, db),
+		close: func() {
+			// the database must not be closed before the background jobs stop
+			for _, stop := range stops {
+				stop()
+			}
+			db.Close()
+		},
+	}, nil
+}
+
+func openEventStore(config *Config) (*store, error) {
+	db, err := openBadger(config)
+	if err != nil {
+		return nil, err
+	}
+	repo := eventstore.New(db)
+	stop := runBadgerGC(config, db)
+	return &store{
+		repo:      repo,
+		backuper:  repo,
+		collector: repository.NewStatsCollector(db),
+		checks:    badgerChecks(config, db),
+		close: func() {
+			stop()
+			db.Close()
+		},
+	}, nil
+}
+
+// openBadger opens the Badger database in DBDir, once the configuration of
+// its garbage collection is validated.
+func openBadger(config *Config) (*badger.DB, error) {
+	if config.GCInterval > 0 && (config.GCDiscardRatio <= 0 || config.GCDiscardRatio >= 1) {
+		return nil, fmt.Errorf("GC discard ratio must be between 0 and 1, got %v", config.GCDiscardRatio)
+	}
+	db, err := repository.Open(config.DBDir)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %v", err)
+	}
+	return db, nil
+}
+
+// runBadgerGC starts the periodic garbage collection of the database, if
+// configured, returning the function stopping it.
+func runBadgerGC(config *Config, db *badger.DB) (stop func()) {
+	if config.GCInterval <= 0 {
+		return func() {}
+	}
+	return inBackground(func(ctx context.Context) {
+		repository.RunPeriodicGC(ctx, db, config.GCInterval, config.GCDiscardRatio)
+	})
+}
+
+func badgerChecks(config *Config, db *badger.DB) map[string]health.Check {
+	return map[string]health.Check{
+		"badger": repository.WritableCheck(db),
+		"disk":   health.DiskSpace(config.DBDir, config.MinFreeDisk),
+	}
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mysza/paymentsapi/auth"
+)
+
+// TLSConfig configures TLS and mutual TLS of the HTTP server.
+// TLS is disabled if CertFile is empty.
+type TLSConfig struct {
+	CertFile          string   // CertFile is the PEM encoded server certificate (chain)
+	KeyFile           string   // KeyFile is the PEM encoded server private key
+	ClientCAFile      string   // ClientCAFile is the CA bundle verifying client certificates; mTLS is disabled if empty
+	RequireClientCert bool     // RequireClientCert rejects connections without a valid client certificate
+	ClientScopes      []string // ClientScopes are granted to principals identified by client certificates
+	ClientRoles       []string // ClientRoles are assigned to principals identified by client certificates
+}
+
+// certReloader keeps the server certificate and client CA pool loaded
+// from files, reloading them whenever the files change.
+type certReloader struct {
+	config  TLSConfig
+	watcher *fsnotify.Watcher
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("both TLS certificate and key files are required")
+	}
+	cr := &certReloader{config: config}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.config.CertFile, cr.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS key pair: %v", err)
+	}
+	var pool *x509.CertPool
+	if cr.config.ClientCAFile != "" {
+		bundle, err := ioutil.ReadFile(cr.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CA bundle: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("no certificates found in client CA bundle %v", cr.config.ClientCAFile)
+		}
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.clientCA = pool
+	cr.mu.Unlock()
+	return nil
+}
+
+// watch reloads the certificates on changes in the directories of the
+// watched files, until close is called. Any change reloads them, as files
+// are not necessarily changed themselves: mounted Kubernetes secrets are
+// symbolic links through a ..data link, which is swapped on updates.
+func (cr *certReloader) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{}
+	for _, file := range []string{cr.config.CertFile, cr.config.KeyFile, cr.config.ClientCAFile} {
+		if file != "" {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	cr.watcher = watcher
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if err := cr.load(); err != nil {
+					// keep serving the previous certificates until the files are consistent again
+					logrus.WithFields(logrus.Fields{
+						"location": "api/tls/watch",
+						"details":  "certificate reload",
+						"file":     event.Name,
+						"error":    err,
+					}).Warn("Error reloading TLS certificates")
+					continue
+				}
+				logrus.WithField("location", "api/tls/watch").Infof("Reloaded TLS certificates after change of %s", event.Name)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.WithFields(logrus.Fields{
+					"location": "api/tls/watch",
+					"details":  "watcher",
+					"error":    err,
+				}).Warn("Error watching TLS certificates")
+			}
+		}
+	}()
+	return nil
+}
+
+func (cr *certReloader) close() error {
+	if cr.watcher == nil {
+		return nil
+	}
+	return cr.watcher.Close()
+}
+
+// tlsConfig creates the server TLS configuration, serving the current
+// certificate to every new connection, and verifying client certificates
+// against the current CA pool. Connections verifying client certificates are
+// configured with clones of the base configuration, so that they keep its
+// protocols, e.g. HTTP/2, and share its session ticket keys.
+func (cr *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+			return cr.cert, nil
+		},
+	}
+	if cr.config.ClientCAFile == "" {
+		return base
+	}
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.mu.RLock()
+		defer cr.mu.RUnlock()
+		client := base.Clone()
+		client.ClientCAs = cr.clientCA
+		client.ClientAuth = tls.VerifyClientCertIfGiven
+		if cr.config.RequireClientCert {
+			client.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return client, nil
+	}
+	return config
+}
+
+// clientCertIdentity is a middleware mapping the subject of a verified client
+// certificate to the principal of the request: the common name becomes the
+// subject and the first organisation the organisation ID.
+func clientCertIdentity(scopes, roles []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			subject := r.TLS.VerifiedChains[0][0].Subject
+			principal := &auth.Principal{
+				Subject: subject.CommonName,
+				Scopes:  scopes,
+				Roles:   roles,
+			}
+			if len(subject.Organization) > 0 {
+				principal.OrganisationID = subject.Organization[0]
+			}
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
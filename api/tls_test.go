@@ -0,0 +1,211 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/auth"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func issueCert(t *testing.T, subject pkix.Name, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	keyDER, _ := x509.MarshalECPrivateKey(c.key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paymentsapitls")
+	defer os.RemoveAll(dir)
+	ca := issueCert(t, pkix.Name{CommonName: "Test CA"}, nil, true)
+	server := issueCert(t, pkix.Name{CommonName: "server"}, ca, false)
+	client := issueCert(t, pkix.Name{CommonName: "client-1", Organization: []string{"org-1"}}, ca, false)
+	config := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	server.write(t, config.CertFile, config.KeyFile)
+	ca.write(t, config.ClientCAFile, "")
+
+	certs, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer certs.close()
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := auth.FromContext(r.Context()); ok {
+			fmt.Fprintf(w, "%s/%s", principal.OrganisationID, principal.Subject)
+		}
+	})
+	srv := httptest.NewUnstartedServer(clientCertIdentity([]string{auth.ScopePaymentsRead}, nil)(echo))
+	srv.TLS = certs.tlsConfig()
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	var resp *http.Response
+	get := func(certificates ...tls.Certificate) (string, *x509.Certificate, error) {
+		client := &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true, TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certificates,
+		}}}
+		var err error
+		resp, err = client.Get(srv.URL)
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0], nil
+	}
+	awaitServed := func(t *testing.T, commonName string) {
+		var served *x509.Certificate
+		var err error
+		for attempt := 0; attempt < 50; attempt++ {
+			_, served, err = get()
+			if err == nil && served.Subject.CommonName == commonName {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if assert.NotNil(t, served) {
+			assert.Equal(t, commonName, served.Subject.CommonName)
+		}
+	}
+
+	t.Run("Client certificate subject is mapped to principal", func(t *testing.T) {
+		body, _, err := get(client.tlsCertificate())
+
+		assert.Nil(t, err)
+		assert.Equal(t, "org-1/client-1", body)
+		assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol, "HTTP/2 must be negotiated with client certificates too")
+	})
+
+	t.Run("Clients without certificate are anonymous", func(t *testing.T) {
+		body, _, err := get()
+
+		assert.Nil(t, err)
+		assert.Empty(t, body)
+	})
+
+	t.Run("Certificates are reloaded on change", func(t *testing.T) {
+		renewed := issueCert(t, pkix.Name{CommonName: "server-renewed"}, ca, false)
+		renewed.write(t, config.CertFile, config.KeyFile)
+
+		awaitServed(t, "server-renewed")
+	})
+}
+
+// TestTLSMountedSecret replaces the certificates as Kubernetes updates
+// mounted secrets: the files are links through the ..data link to a
+// directory of the secret version, and the ..data link is swapped.
+func TestTLSMountedSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paymentsapitls")
+	defer os.RemoveAll(dir)
+	ca := issueCert(t, pkix.Name{CommonName: "Test CA"}, nil, true)
+	mount := func(version string, cert *testCert) {
+		versionDir := filepath.Join(dir, version)
+		os.Mkdir(versionDir, 0700)
+		cert.write(t, filepath.Join(versionDir, "tls.crt"), filepath.Join(versionDir, "tls.key"))
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mount("..2018_06_04_first", issueCert(t, pkix.Name{CommonName: "server"}, ca, false))
+	for _, file := range []string{"tls.crt", "tls.key"} {
+		os.Symlink(filepath.Join("..data", file), filepath.Join(dir, file))
+	}
+	certs, err := newCertReloader(TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer certs.close()
+	served := func() string {
+		cert, _ := certs.tlsConfig().GetCertificate(&tls.ClientHelloInfo{})
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName
+	}
+
+	mount("..2018_06_05_second", issueCert(t, pkix.Name{CommonName: "server-renewed"}, ca, false))
+	for attempt := 0; attempt < 50 && served() != "server-renewed"; attempt++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	assert.Equal(t, "server-renewed", served())
+}
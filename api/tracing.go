@@ -0,0 +1,42 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/mysza/paymentsapi/tracing"
+)
+
+// trace is a middleware starting a server span for every request, as a child
+// of the caller's span if the request carries a W3C traceparent header.
+func trace(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, "HTTP "+r.Method, oteltrace.WithSpanKind(oteltrace.SpanKindServer))
+		defer span.End()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		r = r.WithContext(ctx)
+		next.ServeHTTP(ww, r)
+
+		route := routePattern(r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetName("HTTP " + r.Method + " " + route)
+		span.SetAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.Int("http.status_code", status),
+			attribute.String("http.request_id", middleware.GetReqID(r.Context())),
+		)
+		if status >= http.StatusInternalServerError {
+			tracing.RecordError(span, fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+	recorder := tracetest.NewSpanRecorder()
+	tracing.SetProvider(tracing.NewProvider(recorder, "paymentsapi", 1))
+	defer tracing.SetProvider(noop.NewTracerProvider())
+	repo := new(mocks.PaymentsRepository)
+	repo.On("Get", mock.Anything, "missing").Return(nil, errors.New("not found"))
+	api, _ := NewAPI(service.NewPaymentsService(repo))
+
+	request := httptest.NewRequest("GET", "/payments/missing", nil)
+	request.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	api.Router().ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if assert.Len(spans, 2) {
+		assert.Equal("PaymentsService.Get", spans[0].Name())
+		assert.Equal(codes.Error, spans[0].Status().Code)
+		assert.Equal("HTTP GET /payments/{paymentID}", spans[1].Name())
+		assert.Equal(spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[1].SpanContext().TraceID().String())
+		assert.Equal("00f067aa0ba902b7", spans[1].Parent().SpanID().String())
+		assert.Contains(spans[1].Attributes(), attribute.Int("http.status_code", 404))
+	}
+}
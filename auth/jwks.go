@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is how long a loaded JWKS is considered fresh.
+	DefaultRefreshInterval = 15 * time.Minute
+	// minRefreshInterval limits how often unknown key IDs and stale key sets
+	// may trigger a reload, including after failed ones.
+	minRefreshInterval = 30 * time.Second
+)
+
+// ErrKeyNotFound is returned when the key set has no key with the requested ID.
+var ErrKeyNotFound = errors.New("key not found in key set")
+
+// errUnsupportedKey is returned for keys of types and curves tokens cannot be
+// signed with, which are skipped.
+var errUnsupportedKey = errors.New("unsupported key")
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// KeySet is a cached JSON Web Key Set loaded from a file or URL.
+// It is safe for concurrent use.
+type KeySet struct {
+	source          string
+	client          *http.Client
+	refreshInterval time.Duration
+
+	refreshing sync.Mutex // refreshing serialises the reloads triggered by Key
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	loadedAt    time.Time
+	attemptedAt time.Time // attemptedAt is when the last reload started, successful or not
+	refreshErr  error     // refreshErr is the error of the last reload
+	now         func() time.Time
+}
+
+// NewKeySet creates a KeySet reading keys from source, which is either
+// a http(s) URL or a path to a local file. Keys are loaded immediately,
+// and reloaded when older than refreshInterval.
+func NewKeySet(source string, refreshInterval time.Duration) (*KeySet, error) {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultRefreshInterval
+	}
+	ks := &KeySet{
+		source:          source,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		refreshInterval: refreshInterval,
+		now:             time.Now,
+	}
+	if err := ks.Refresh(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Refresh reloads the keys from the source.
+func (ks *KeySet) Refresh() error {
+	attemptedAt := ks.now()
+	keys, err := ks.load()
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.attemptedAt, ks.refreshErr = attemptedAt, err
+	if err != nil {
+		return err
+	}
+	ks.keys = keys
+	ks.loadedAt = attemptedAt
+	return nil
+}
+
+func (ks *KeySet) load() (map[string]crypto.PublicKey, error) {
+	data, err := ks.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("loading JWKS from %v: %v", ks.source, err)
+	}
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWKS from %v: %v", ks.source, err)
+	}
+	return keys, nil
+}
+
+// reload refreshes the keys, unless a reload was attempted within
+// minRefreshInterval, successful or not, in which case its error is
+// returned. Concurrent callers wait for a single reload, so that tokens with
+// unknown key IDs cannot flood the source with requests.
+func (ks *KeySet) reload() error {
+	ks.refreshing.Lock()
+	defer ks.refreshing.Unlock()
+	ks.mu.RLock()
+	attemptedAt, err := ks.attemptedAt, ks.refreshErr
+	ks.mu.RUnlock()
+	if ks.now().Sub(attemptedAt) < minRefreshInterval {
+		return err
+	}
+	return ks.Refresh()
+}
+
+// Key returns the public key with the given key ID. Stale key sets are
+// refreshed first, and an unknown key ID triggers a (rate limited) reload,
+// so that rotated keys are picked up.
+func (ks *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	ks.mu.RLock()
+	key, found := ks.keys[kid]
+	age := ks.now().Sub(ks.loadedAt)
+	ks.mu.RUnlock()
+
+	if found && age < ks.refreshInterval {
+		return key, nil
+	}
+	if err := ks.reload(); err != nil {
+		// serve the cached key if the source is temporarily unavailable
+		if found {
+			return key, nil
+		}
+		return nil, err
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if key, found = ks.keys[kid]; !found {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (ks *KeySet) fetch() ([]byte, error) {
+	if !strings.HasPrefix(ks.source, "http://") && !strings.HasPrefix(ks.source, "https://") {
+		return ioutil.ReadFile(ks.source)
+	}
+	resp, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func parseKeySet(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err == errUnsupportedKey {
+			// e.g. keys added by the issuer for other algorithms
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
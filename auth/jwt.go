@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultOrganisationClaim is the claim holding the caller's organisation ID.
+	DefaultOrganisationClaim = "org_id"
+	// DefaultRolesClaim is the claim holding the caller's roles.
+	DefaultRolesClaim = "roles"
+	// defaultLeeway is the allowed clock skew when checking time based claims.
+	defaultLeeway = 30 * time.Second
+)
+
+// Errors returned when a token fails verification.
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrTokenNotValidYet = errors.New("token not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid token issuer")
+	ErrInvalidAudience  = errors.New("invalid token audience")
+)
+
+// KeyProvider provides public keys used to verify token signatures.
+type KeyProvider interface {
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+// VerifierConfig configures the token Verifier.
+type VerifierConfig struct {
+	Issuer            string // Issuer is the required value of the iss claim
+	Audience          string // Audience must be one of the values of the aud claim
+	OrganisationClaim string // OrganisationClaim names the claim mapped to Principal.OrganisationID
+	RolesClaim        string // RolesClaim names the claim mapped to Principal.Roles
+}
+
+// Verifier validates JWT bearer tokens signed with RS256 or ES256
+// and maps their claims to a Principal.
+type Verifier struct {
+	keys   KeyProvider
+	config VerifierConfig
+	now    func() time.Time
+}
+
+// NewVerifier creates a new Verifier using keys from the given provider.
+func NewVerifier(keys KeyProvider, config VerifierConfig) *Verifier {
+	if config.OrganisationClaim == "" {
+		config.OrganisationClaim = DefaultOrganisationClaim
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = DefaultRolesClaim
+	}
+	return &Verifier{keys: keys, config: config, now: time.Now}
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// audience accepts both the single string and the array form of the aud claim.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Scp       []string `json:"scp"`
+}
+
+// Verify checks the token signature and claims, returning
+// the Principal the token was issued for.
+func (v *Verifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var hdr header
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, ErrMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	key, err := v.keys.Key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(hdr.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrMalformedToken
+	}
+	var raw map[string]interface{}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := v.validate(&c); err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{Subject: c.Subject, Scopes: c.Scp}
+	if c.Scope != "" {
+		principal.Scopes = append(principal.Scopes, strings.Fields(c.Scope)...)
+	}
+	if org, ok := raw[v.config.OrganisationClaim].(string); ok {
+		principal.OrganisationID = org
+	}
+	principal.Roles = stringList(raw[v.config.RolesClaim])
+	return principal, nil
+}
+
+// stringList maps claims given either as an array of strings
+// or as a single space-separated string.
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (v *Verifier) validate(c *claims) error {
+	now := v.now()
+	if c.ExpiresAt == nil || now.After(time.Unix(*c.ExpiresAt, 0).Add(defaultLeeway)) {
+		return ErrTokenExpired
+	}
+	if c.NotBefore != nil && now.Add(defaultLeeway).Before(time.Unix(*c.NotBefore, 0)) {
+		return ErrTokenNotValidYet
+	}
+	if v.config.Issuer != "" && c.Issuer != v.config.Issuer {
+		return ErrInvalidIssuer
+	}
+	if v.config.Audience != "" {
+		for _, aud := range c.Audience {
+			if aud == v.config.Audience {
+				return nil
+			}
+		}
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return ErrUnsupportedAlg
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decoding token segment: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s *testSigner) jwk() map[string]string {
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA", "kid": s.kid, "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC", "kid": s.kid, "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			"y": base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+	return nil
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, sv, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), sv.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func jwksServer(signers ...*testSigner) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]string{}
+		for _, s := range signers {
+			keys = append(keys, s.jwk())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "https://issuer.example.com",
+		"aud":    []string{"paymentsapi"},
+		"sub":    "user-1",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"org_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+		"scope":  "payments:read payments:write",
+		"roles":  []string{"operator", "approver"},
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaSigner := &testSigner{kid: "rsa-1", alg: "RS256", key: rsaKey}
+	ecSigner := &testSigner{kid: "ec-1", alg: "ES256", key: ecKey}
+	server := jwksServer(rsaSigner, ecSigner)
+	defer server.Close()
+
+	keys, err := NewKeySet(server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier(keys, VerifierConfig{Issuer: "https://issuer.example.com", Audience: "paymentsapi"})
+
+	t.Run("Valid tokens are mapped to principal", func(t *testing.T) {
+		for _, signer := range []*testSigner{rsaSigner, ecSigner} {
+			assert := assert.New(t)
+
+			principal, err := verifier.Verify(signer.sign(t, validClaims()))
+
+			assert.Nilf(err, "%v token rejected: %v", signer.alg, err)
+			if assert.NotNil(principal) {
+				assert.Equal("user-1", principal.Subject)
+				assert.Equal("743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", principal.OrganisationID)
+				assert.True(principal.HasScope(ScopePaymentsRead))
+				assert.True(principal.HasScope(ScopePaymentsWrite))
+				assert.Equal([]string{"operator", "approver"}, principal.Roles)
+			}
+		}
+	})
+
+	cases := []struct {
+		name     string
+		modify   func(map[string]interface{})
+		expected error
+	}{
+		{"Expired token", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, ErrTokenExpired},
+		{"Missing expiry", func(c map[string]interface{}) { delete(c, "exp") }, ErrTokenExpired},
+		{"Not valid yet", func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, ErrTokenNotValidYet},
+		{"Wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, ErrInvalidIssuer},
+		{"Wrong audience", func(c map[string]interface{}) { c["aud"] = "other" }, ErrInvalidAudience},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			claims := validClaims()
+			testCase.modify(claims)
+
+			_, err := verifier.Verify(rsaSigner.sign(t, claims))
+
+			assert.Equal(t, testCase.expected, err)
+		})
+	}
+
+	t.Run("Tampered token is rejected", func(t *testing.T) {
+		token := rsaSigner.sign(t, validClaims())
+		parts := strings.Split(token, ".")
+		claims := validClaims()
+		claims["scope"] = "payments:admin"
+		body, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(body)
+
+		_, err := verifier.Verify(strings.Join(parts, "."))
+
+		assert.Equal(t, ErrInvalidSignature, err)
+	})
+
+	t.Run("Unknown signing key is rejected", func(t *testing.T) {
+		otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		other := &testSigner{kid: "unknown", alg: "RS256", key: otherKey}
+
+		_, err := verifier.Verify(other.sign(t, validClaims()))
+
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("Unsupported algorithm is rejected", func(t *testing.T) {
+		token := rsaSigner.sign(t, validClaims())
+		parts := strings.Split(token, ".")
+		hdr, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa-1"})
+		parts[0] = base64.RawURLEncoding.EncodeToString(hdr)
+
+		_, err := verifier.Verify(strings.Join(parts, "."))
+
+		assert.Equal(t, ErrUnsupportedAlg, err)
+	})
+
+	t.Run("Malformed token is rejected", func(t *testing.T) {
+		_, err := verifier.Verify("not-a-token")
+
+		assert.Equal(t, ErrMalformedToken, err)
+	})
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	assert := assert.New(t)
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signers := []*testSigner{{kid: "first", alg: "ES256", key: first}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]string{}
+		for _, s := range signers {
+			keys = append(keys, s.jwk())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+	keys, err := NewKeySet(server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers = append(signers, &testSigner{kid: "second", alg: "ES256", key: second})
+	_, err = keys.Key("second")
+	assert.Equal(ErrKeyNotFound, err, "Unknown keys should not trigger immediate reload")
+
+	assert.Nil(keys.Refresh())
+	key, err := keys.Key("second")
+	assert.Nil(err)
+	assert.NotNil(key)
+}
+
+func TestKeySetReloads(t *testing.T) {
+	assert := assert.New(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := &testSigner{kid: "ec-1", alg: "ES256", key: key}
+	var requests int32
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			signer.jwk(),
+			{"kty": "EC", "kid": "ec-384", "crv": "P-384", "x": "AA", "y": "AA"},
+			{"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": "AA"},
+		}})
+	}))
+	defer server.Close()
+	keys, err := NewKeySet(server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	t.Run("Unsupported keys are skipped", func(t *testing.T) {
+		key, err := keys.Key("ec-1")
+
+		assert.Nil(err)
+		assert.NotNil(key)
+	})
+
+	t.Run("Concurrent reloads are done once", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		atomic.StoreInt32(&requests, 0)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				keys.Key("unknown")
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(int32(1), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Failed reloads are not retried immediately", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		atomic.StoreInt32(&requests, 0)
+		failing = true
+
+		stale, staleErr := keys.Key("ec-1")
+		_, unknownErr := keys.Key("unknown")
+		now = now.Add(minRefreshInterval)
+		_, retriedErr := keys.Key("unknown")
+
+		assert.Nil(staleErr, "Cached keys are served while the source is unavailable")
+		assert.NotNil(stale)
+		assert.Error(unknownErr)
+		assert.Error(retriedErr)
+		assert.Equal(int32(2), atomic.LoadInt32(&requests))
+	})
+}
@@ -0,0 +1,50 @@
+package auth
+
+import "context"
+
+// Scopes recognised by the Payments API.
+const (
+	ScopePaymentsRead  = "payments:read"
+	ScopePaymentsWrite = "payments:write"
+	ScopePaymentsPII   = "payments:pii"   // ScopePaymentsPII grants reading unmasked account numbers
+	ScopeAdmin         = "payments:admin" // ScopeAdmin grants the administrative operations, e.g. backups
+)
+
+type ctxKey int
+
+const (
+	ctxPrincipal ctxKey = iota
+)
+
+// Principal is the identity of the caller, as established by one
+// of the authentication mechanisms.
+type Principal struct {
+	Subject        string   // Subject uniquely identifies the caller
+	OrganisationID string   // OrganisationID is the organisation the caller acts for
+	Scopes         []string // Scopes the caller was granted
+	Roles          []string // Roles the caller was assigned
+}
+
+// HasScope checks if the principal was granted the given scope.
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext returns a copy of ctx carrying the principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxPrincipal, p)
+}
+
+// FromContext retrieves the principal stored in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(ctxPrincipal).(*Principal)
+	return p, ok && p != nil
+}
@@ -0,0 +1,160 @@
+// Package calendar implements calendars of business days, on which payment
+// schemes process payments: the weekdays other than holidays.
+package calendar
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DateLayout is the layout of dates in ISO 8601, e.g. 2018-06-04.
+const DateLayout = "2006-01-02"
+
+// Names of the embedded calendars.
+const (
+	UK      = "UK"      // UK holds the bank holidays in England and Wales
+	TARGET2 = "TARGET2" // TARGET2 holds the closing days of the euro settlement system
+)
+
+//go:embed holidays/*.txt
+var holidayFiles embed.FS
+
+var embedded = map[string]string{
+	UK:      "holidays/uk.txt",
+	TARGET2: "holidays/target2.txt",
+}
+
+// Calendar is a calendar of business days. Dates are days in UTC; their
+// time of day is ignored.
+type Calendar struct {
+	Name     string
+	holidays map[string]string // names of the holidays by date
+	until    time.Time         // until is the last date the holidays are known for; zero for every date
+}
+
+// Parse reads the holidays of the calendar, one per line with the date
+// followed by the name of the holiday, e.g. 2018-12-25 Christmas Day. Empty
+// lines and lines starting with # are skipped. The holidays are known until
+// the date of the line starting with until, e.g. until 2027-12-31, or else
+// until the end of the year of the last holiday.
+func Parse(name string, r io.Reader) (*Calendar, error) {
+	c := &Calendar{Name: name, holidays: map[string]string{}}
+	var last, until time.Time
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		if fields[0] == "until" {
+			var err error
+			if until, err = time.Parse(DateLayout, strings.TrimSpace(strings.Join(fields[1:], ""))); err != nil {
+				return nil, fmt.Errorf("calendar %s, line %d: %v", name, line, err)
+			}
+			continue
+		}
+		date, err := time.Parse(DateLayout, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("calendar %s, line %d: %v", name, line, err)
+		}
+		c.holidays[date.Format(DateLayout)] = strings.TrimSpace(strings.Join(fields[1:], ""))
+		if date.After(last) {
+			last = date
+		}
+	}
+	switch {
+	case !until.IsZero():
+		c.until = until
+	case !last.IsZero():
+		c.until = time.Date(last.Year(), time.December, 31, 0, 0, 0, 0, time.UTC)
+	}
+	return c, scanner.Err()
+}
+
+// Load reads the holidays of the calendar from the file, as in Parse.
+func Load(name, path string) (*Calendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(name, f)
+}
+
+// Embedded returns the calendars embedded in the binary, by name.
+func Embedded() (map[string]*Calendar, error) {
+	calendars := make(map[string]*Calendar, len(embedded))
+	for name, path := range embedded {
+		f, err := holidayFiles.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		calendar, err := Parse(name, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		calendars[name] = calendar
+	}
+	return calendars, nil
+}
+
+// Until returns the last date the holidays of the calendar are known for, or
+// the zero time if they are known for every date.
+func (c *Calendar) Until() time.Time {
+	return c.until
+}
+
+// Covers checks the holidays of the calendar are known for the date, that is,
+// whether the calendar tells if it is a business day.
+func (c *Calendar) Covers(date time.Time) bool {
+	return c.until.IsZero() || !Day(date).After(c.until)
+}
+
+// Holiday returns the name of the holiday on the date, if it is one.
+func (c *Calendar) Holiday(date time.Time) (string, bool) {
+	name, found := c.holidays[date.UTC().Format(DateLayout)]
+	return name, found
+}
+
+// IsBusinessDay checks if the date is a weekday other than a holiday.
+func (c *Calendar) IsBusinessDay(date time.Time) bool {
+	date = date.UTC()
+	if weekday := date.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+		return false
+	}
+	_, holiday := c.Holiday(date)
+	return !holiday
+}
+
+// Next returns the date if it is a business day, or the next business day.
+func (c *Calendar) Next(date time.Time) time.Time {
+	date = Day(date)
+	for !c.IsBusinessDay(date) {
+		date = date.AddDate(0, 0, 1)
+	}
+	return date
+}
+
+// BusinessDays returns the business days from one date to another, inclusive.
+func (c *Calendar) BusinessDays(from, to time.Time) []time.Time {
+	var days []time.Time
+	for date := Day(from); !date.After(to.UTC()); date = date.AddDate(0, 0, 1) {
+		if c.IsBusinessDay(date) {
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+// Day returns the start of the day of the date, in UTC.
+func Day(date time.Time) time.Time {
+	year, month, day := date.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,88 @@
+package calendar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func date(value string) time.Time {
+	date, err := time.Parse(DateLayout, value)
+	if err != nil {
+		panic(err)
+	}
+	return date
+}
+
+func TestCalendar(t *testing.T) {
+	assert := assert.New(t)
+	calendars, err := Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uk, target2 := calendars[UK], calendars[TARGET2]
+
+	t.Run("Weekends and holidays are not business days", func(t *testing.T) {
+		christmas, isHoliday := uk.Holiday(date("2018-12-25"))
+
+		assert.True(isHoliday)
+		assert.Equal("Christmas Day", christmas)
+		assert.False(uk.IsBusinessDay(date("2018-12-25")))
+		assert.False(uk.IsBusinessDay(date("2018-06-02")), "Saturday")
+		assert.True(uk.IsBusinessDay(date("2018-06-04")))
+		assert.False(uk.IsBusinessDay(date("2018-08-27")), "Summer bank holiday")
+		assert.True(target2.IsBusinessDay(date("2018-08-27")), "Not a TARGET2 closing day")
+		assert.False(target2.IsBusinessDay(date("2018-05-01")), "Labour Day")
+	})
+
+	t.Run("Next business day", func(t *testing.T) {
+		assert.Equal(date("2018-06-04"), uk.Next(date("2018-06-04")))
+		assert.Equal(date("2018-12-27"), uk.Next(date("2018-12-25")), "Christmas and Boxing Day are skipped")
+		assert.Equal(date("2018-06-04"), uk.Next(time.Date(2018, 6, 2, 23, 0, 0, 0, time.UTC)))
+	})
+
+	t.Run("Business days between dates", func(t *testing.T) {
+		days := uk.BusinessDays(date("2018-12-21"), date("2018-12-31"))
+
+		var formatted []string
+		for _, day := range days {
+			formatted = append(formatted, day.Format(DateLayout))
+		}
+		assert.Equal([]string{"2018-12-21", "2018-12-24", "2018-12-27", "2018-12-28", "2018-12-31"}, formatted)
+		assert.Empty(uk.BusinessDays(date("2018-06-04"), date("2018-06-03")))
+	})
+
+	t.Run("Calendars are loaded from files", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "paymentsapicalendar")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "company.txt")
+		ioutil.WriteFile(path, []byte("# company holidays\n\n2018-06-04 Founders Day\n"), 0600)
+
+		company, err := Load("COMPANY", path)
+		_, parseErr := Parse("BROKEN", strings.NewReader("4 June 2018 Founders Day"))
+
+		assert.Nil(err)
+		assert.Equal("COMPANY", company.Name)
+		assert.False(company.IsBusinessDay(date("2018-06-04")))
+		assert.Contains(parseErr.Error(), "line 1")
+	})
+
+	t.Run("Calendars cover the dates their holidays are known for", func(t *testing.T) {
+		listed, _ := Parse("LISTED", strings.NewReader("2018-06-04 Founders Day\n"))
+		explicit, _ := Parse("EXPLICIT", strings.NewReader("until 2019-06-30\n2018-06-04 Founders Day\n"))
+		empty, _ := Parse("EMPTY", strings.NewReader(""))
+
+		assert.Equal(date("2027-12-31"), uk.Until())
+		assert.Equal(date("2027-12-31"), target2.Until())
+		assert.True(uk.Covers(time.Date(2027, 12, 31, 23, 0, 0, 0, time.UTC)))
+		assert.False(uk.Covers(date("2028-01-01")))
+		assert.Equal(date("2018-12-31"), listed.Until(), "Holidays are known until the end of the year of the last one")
+		assert.Equal(date("2019-06-30"), explicit.Until())
+		assert.True(empty.Covers(date("2100-01-01")))
+	})
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/mysza/paymentsapi/repository"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "write a backup of the database to a file",
+	Long: `Writes a backup of the database to the file given with --out. With --since, only
+the changes committed at or after that version are written, making an incremental
+backup; the version to pass to the next incremental backup is printed when done.
+
+The database is locked while the server runs; back up a running server with
+--server, its base URL, instead, passing a bearer token granted the admin scope
+with --token.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, _ := cmd.Flags().GetString("out")
+		since, _ := cmd.Flags().GetUint64("since")
+		server, _ := cmd.Flags().GetString("server")
+		token, _ := cmd.Flags().GetString("token")
+		if out == "" {
+			return errors.New("no output file given")
+		}
+		backup := func(w io.Writer) (uint64, error) {
+			return backupFromServer(server, token, since, w)
+		}
+		if server == "" {
+			db, err := repository.Open(viper.GetString("dbdir"))
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			backup = func(w io.Writer) (uint64, error) {
+				return repository.New(db).Backup(w, since)
+			}
+		}
+
+		// write to a temporary file first, so that a failed backup
+		// never leaves a truncated file behind
+		tmp, err := ioutil.TempFile(filepath.Dir(out), filepath.Base(out)+".tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		next, err := backup(tmp)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), out); err != nil {
+			return err
+		}
+		fmt.Printf("Backup written to %s; next incremental backup since %d\n", out, next)
+		return nil
+	},
+}
+
+// backupFromServer streams the backup of the running server to w, returning
+// the since version of the next incremental backup. The server sends that
+// version in a trailer once the backup is complete, so backups without it
+// failed midway.
+func backupFromServer(server, token string, since uint64, w io.Writer) (uint64, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/admin/backup?since=%d", strings.TrimSuffix(server, "/"), since), nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("backup refused by the server: %s", resp.Status)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return 0, fmt.Errorf("backup interrupted: %v", err)
+	}
+	trailer := resp.Trailer.Get("X-Backup-Next-Since")
+	if trailer == "" {
+		return 0, errors.New("backup incomplete: the server did not confirm it, see its log")
+	}
+	next, err := strconv.ParseUint(trailer, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("backup confirmed with invalid next since version %q", trailer)
+	}
+	return next, nil
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "load a backup into the database",
+	Long: `Loads the backup file given with --in into the database. Restore incremental
+backups in the order they were taken, after the full backup they are based on.
+The server must not be running while restoring.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		in, _ := cmd.Flags().GetString("in")
+		if in == "" {
+			return errors.New("no input file given")
+		}
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		db, err := repository.Open(viper.GetString("dbdir"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if err := repository.New(db).Restore(f); err != nil {
+			return fmt.Errorf("restoring %s: %v", in, err)
+		}
+		fmt.Printf("Restored %s\n", in)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd, restoreCmd)
+	backupCmd.Flags().String("out", "", "file to write the backup to")
+	backupCmd.Flags().Uint64("since", 0, "version to back up from; 0 makes a full backup")
+	backupCmd.Flags().String("server", "", "base URL of the running server to back up, e.g. http://localhost:8080")
+	backupCmd.Flags().String("token", "", "bearer token granted the admin scope, for --server")
+	restoreCmd.Flags().String("in", "", "backup file to load")
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/mysza/paymentsapi/api"
+	"github.com/mysza/paymentsapi/encryption"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/service"
+)
+
+// dbCmd groups the commands maintaining the database
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "inspect and maintain the database",
+	Long: `Inspects and maintains the database in the configured directory.
+The database is locked while the server runs, so these commands need it stopped.`,
+}
+
+var dbStatsCmd = &cobra.Command{
+	Use:          "stats",
+	Short:        "print the number of keys, sizes and tables of the database",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := repository.Open(viper.GetString("dbdir"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		stats := repository.GetStats(db)
+		fmt.Printf("Keys:           %d\n", stats.Keys)
+		fmt.Printf("LSM tree size:  %d bytes\n", stats.LSMSize)
+		fmt.Printf("Value log size: %d bytes\n", stats.VLogSize)
+		for level, tables := range stats.TablesPerLevel {
+			fmt.Printf("Level %d tables: %d\n", level, tables)
+		}
+		return nil
+	},
+}
+
+var dbGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "run the value log garbage collection",
+	Long: `Rewrites the value log files in which at least the discard ratio of the space
+is taken by deleted or overwritten values, reclaiming the disk space.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		discardRatio, _ := cmd.Flags().GetFloat64("discard-ratio")
+		if discardRatio <= 0 || discardRatio >= 1 {
+			return fmt.Errorf("discard ratio must be between 0 and 1, got %v", discardRatio)
+		}
+		db, err := repository.Open(viper.GetString("dbdir"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		rewritten, err := repository.RunGC(db, discardRatio)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rewrote %d value log files\n", rewritten)
+		return nil
+	},
+}
+
+var dbVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "report stored payments which are corrupt or invalid",
+	Long: `Decodes every stored payment and validates it with the rules applied when
+payments are added or updated, configured as for the serve command: the approvals,
+the rules of payment schemes, the calendars, the FX and the tariffs. Payments
+encrypted at rest are decrypted with the keys of the configured encryption.keyfile.
+Fails when any payment is invalid.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := serverConfig()
+		if err != nil {
+			return err
+		}
+		serviceOpts, err := api.ServiceOptions(config)
+		if err != nil {
+			return err
+		}
+		codec, err := repository.CodecByName(config.Codec)
+		if err != nil {
+			return err
+		}
+		opts := []repository.Option{repository.WithCodec(codec)}
+		if keyfile := config.EncryptionKeyfile; keyfile != "" {
+			keyring, err := encryption.LoadKeyring(keyfile)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, repository.WithEncryption(encryption.NewEncrypter(keyring)))
+		}
+		db, err := repository.Open(config.DBDir)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		repo := repository.New(db, opts...)
+		invalid, err := repo.Verify(context.Background(), service.NewPaymentsService(repo, serviceOpts...).Validate)
+		if err != nil {
+			return err
+		}
+		for _, record := range invalid {
+			fmt.Printf("%s: %v\n", record.ID, record.Err)
+		}
+		if len(invalid) > 0 {
+			return fmt.Errorf("found %d invalid payments", len(invalid))
+		}
+		fmt.Println("All payments are valid")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbStatsCmd, dbGCCmd, dbVerifyCmd)
+	dbGCCmd.Flags().Float64("discard-ratio", repository.DefaultDiscardRatio, "fraction of stale data for a value log file to be rewritten")
+}
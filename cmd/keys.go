@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/mysza/paymentsapi/encryption"
+	"github.com/mysza/paymentsapi/repository"
+)
+
+// keysCmd groups the commands managing the encryption keys
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "manage master keys encrypting personal data",
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:          "generate",
+	Short:        "create a keyfile with a new master key",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyfile := viper.GetString("encryption.keyfile")
+		if keyfile == "" {
+			return errors.New("no keyfile configured")
+		}
+		if _, err := os.Stat(keyfile); err == nil {
+			return fmt.Errorf("keyfile %s already exists; use rotate to add a key", keyfile)
+		}
+		keyring, err := encryption.NewKeyring()
+		if err != nil {
+			return err
+		}
+		if err := keyring.Save(keyfile); err != nil {
+			return err
+		}
+		fmt.Printf("Created keyfile %s with key %s\n", keyfile, keyring.Active)
+		return nil
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "activate a new master key and re-encrypt stored payments",
+	Long: `Generates a new master key, makes it the active one and re-encrypts the stored
+payments with new data keys wrapped by it. Previous keys are kept in the keyfile.
+
+The database is locked while the server runs; in that case only the keyfile is
+updated. Send SIGHUP to the server to reload the keyfile and re-encrypt the
+payments in the background.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyfile := viper.GetString("encryption.keyfile")
+		if keyfile == "" {
+			return errors.New("no keyfile configured")
+		}
+		codec, err := repository.CodecByName(viper.GetString("codec"))
+		if err != nil {
+			return err
+		}
+		keyring, err := encryption.LoadKeyring(keyfile)
+		if err != nil {
+			return err
+		}
+		if err := keyring.Rotate(); err != nil {
+			return err
+		}
+		if err := keyring.Save(keyfile); err != nil {
+			return err
+		}
+		fmt.Printf("Activated key %s\n", keyring.Active)
+
+		db, err := repository.Open(viper.GetString("dbdir"))
+		if err != nil {
+			fmt.Printf("Payments not re-encrypted, database unavailable: %v\n", err)
+			fmt.Println("If the server holds the database, send it SIGHUP to reload the keyfile and re-encrypt them")
+			return nil
+		}
+		defer db.Close()
+		repo := repository.New(db, repository.WithCodec(codec), repository.WithEncryption(encryption.NewEncrypter(keyring)))
+		count, err := repo.Reencrypt(context.Background())
+		if err != nil {
+			return fmt.Errorf("re-encrypting payments: %v", err)
+		}
+		fmt.Printf("Re-encrypted %d payments\n", count)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd, keysRotateCmd)
+	keysCmd.PersistentFlags().String("keyfile", "", "file holding the master keys")
+	viper.BindPFlag("encryption.keyfile", keysCmd.PersistentFlags().Lookup("keyfile"))
+}
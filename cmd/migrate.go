@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/mysza/paymentsapi/repository"
+)
+
+// migrateCmd groups the commands managing the schema version of stored payments
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "manage the schema version of stored payments",
+	Long: `Payments are stored with the version of their schema. Payments of older versions
+are upgraded when read, and stored in the current version on their next write.
+The migrate commands report and complete the upgrade of all stored payments, and
+of payments encoded by another codec than the configured one.`,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:          "up",
+	Short:        "upgrade all stored payments to the current schema version and the configured codec",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		codec, err := repository.CodecByName(viper.GetString("codec"))
+		if err != nil {
+			return err
+		}
+		db, err := repository.Open(viper.GetString("dbdir"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		repo := repository.New(db, repository.WithCodec(codec))
+		count, err := repo.Migrate(context.Background())
+		if err != nil {
+			return fmt.Errorf("migrating payments: %v", err)
+		}
+		fmt.Printf("Migrated %d payments to schema version %d, encoded as %s\n", count, repo.SchemaVersion(), codec.Name())
+		return nil
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:          "status",
+	Short:        "print the migrations and the number of payments per schema version",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := repository.Open(viper.GetString("dbdir"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		repo := repository.New(db)
+		versions, err := repo.SchemaVersions(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Current schema version: %d\n", repo.SchemaVersion())
+		fmt.Println("Migrations:")
+		for _, migration := range repo.Migrations() {
+			pending := 0
+			for version, count := range versions {
+				if version < migration.Version {
+					pending += count
+				}
+			}
+			fmt.Printf("  %d: %s (%d payments pending)\n", migration.Version, migration.Description, pending)
+		}
+		fmt.Println("Payments per schema version:")
+		var stored []int
+		for version := range versions {
+			stored = append(stored, version)
+		}
+		sort.Ints(stored)
+		for _, version := range stored {
+			fmt.Printf("  %d: %d\n", version, versions[version])
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migrateUpCmd, migrateStatusCmd)
+}
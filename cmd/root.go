@@ -3,8 +3,10 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/mysza/paymentsapi/logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -16,6 +18,9 @@ var rootCmd = &cobra.Command{
 	Use:   "payments",
 	Short: "Sample API for a RESTful payments service",
 	Long:  `Payments service provides HTTP API for the simple CRUD methods on Payments resource.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return logging.Configure(viper.GetString("log.format"), viper.GetString("log.level"))
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -30,6 +35,12 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.paymentsapi.yaml)")
+	rootCmd.PersistentFlags().String("log-format", logging.FormatText, "format of logs: text or json")
+	rootCmd.PersistentFlags().String("log-level", "info", "minimum level of logs: debug, info, warning or error")
+	viper.BindPFlag("log.format", rootCmd.PersistentFlags().Lookup("log-format"))
+	viper.BindPFlag("log.level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.SetDefault("log.format", logging.FormatText)
+	viper.SetDefault("log.level", "info")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -50,7 +61,11 @@ func initConfig() {
 		viper.SetConfigName(".paymentsapi")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// read in environment variables that match, e.g. PAYMENTSAPI_PORT for port
+	// and PAYMENTSAPI_TLS_CERT for tls.cert
+	viper.SetEnvPrefix("paymentsapi")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
@@ -1,23 +1,300 @@
 package cmd
 
 import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/mysza/paymentsapi/api"
+	"github.com/mysza/paymentsapi/calendar"
+	"github.com/mysza/paymentsapi/fx"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/cache"
+	"github.com/mysza/paymentsapi/repository/postgres"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
-	Use:   "serve",
-	Short: "start http server with configured api",
-	Long:  `Starts a http server and serves the configured api`,
-	Run: func(cmd *cobra.Command, args []string) {
-		api.StartHTTPServer(viper.GetString("port"), viper.GetString("dbdir"))
+	Use:          "serve",
+	Short:        "start http server with configured api",
+	Long:         `Starts a http server and serves the configured api`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := serverConfig()
+		if err != nil {
+			return err
+		}
+		return api.StartHTTPServer(config)
 	},
 }
 
+// serverConfig reads the configuration of the server, also used by the
+// commands which check payments as the server does.
+func serverConfig() (*api.Config, error) {
+	rules, err := schemeRules()
+	if err != nil {
+		return nil, err
+	}
+	calendars, err := calendarConfig()
+	if err != nil {
+		return nil, err
+	}
+	exchange, err := fxConfig()
+	if err != nil {
+		return nil, err
+	}
+	tariffs, err := tariffConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &api.Config{
+		Host:              viper.GetString("host"),
+		Port:              viper.GetString("port"),
+		Store:             viper.GetString("store"),
+		DBDir:             viper.GetString("dbdir"),
+		SQLitePath:        viper.GetString("sqlite.path"),
+		CacheSize:         viper.GetInt("cache.size"),
+		CacheTTL:          viper.GetDuration("cache.ttl"),
+		ReadTimeout:       viper.GetDuration("read_timeout"),
+		ReadHeaderTimeout: viper.GetDuration("read_header_timeout"),
+		WriteTimeout:      viper.GetDuration("write_timeout"),
+		IdleTimeout:       viper.GetDuration("idle_timeout"),
+		MaxHeaderBytes:    viper.GetInt("max_header_bytes"),
+		ShutdownTimeout:   viper.GetDuration("shutdown_timeout"),
+		ShutdownDelay:     viper.GetDuration("shutdown_delay"),
+		MinFreeDisk:       uint64(viper.GetSizeInBytes("health.min_free_disk")),
+		GCInterval:        viper.GetDuration("gc.interval"),
+		GCDiscardRatio:    viper.GetFloat64("gc.discard_ratio"),
+		EncryptionKeyfile: viper.GetString("encryption.keyfile"),
+		Codec:             viper.GetString("codec"),
+		Auth: api.AuthConfig{
+			JWKS:              viper.GetString("auth.jwks"),
+			JWKSRefresh:       viper.GetDuration("auth.jwks_refresh"),
+			Issuer:            viper.GetString("auth.issuer"),
+			Audience:          viper.GetString("auth.audience"),
+			OrganisationClaim: viper.GetString("auth.organisation_claim"),
+			RolesClaim:        viper.GetString("auth.roles_claim"),
+		},
+		RBAC: api.RBACConfig{
+			Enabled: viper.GetBool("rbac.enabled"),
+			Roles:   viper.GetStringMapStringSlice("rbac.roles"),
+		},
+		TLS: api.TLSConfig{
+			CertFile:          viper.GetString("tls.cert"),
+			KeyFile:           viper.GetString("tls.key"),
+			ClientCAFile:      viper.GetString("tls.client_ca"),
+			RequireClientCert: viper.GetBool("tls.require_client_cert"),
+			ClientScopes:      viper.GetStringSlice("tls.client_scopes"),
+			ClientRoles:       viper.GetStringSlice("tls.client_roles"),
+		},
+		Tracing: api.TracingConfig{
+			Exporter:    viper.GetString("tracing.exporter"),
+			Endpoint:    viper.GetString("tracing.endpoint"),
+			ServiceName: viper.GetString("tracing.service_name"),
+			SampleRatio: viper.GetFloat64("tracing.sample_ratio"),
+		},
+		Postgres: postgres.Config{
+			DSN:             viper.GetString("postgres.dsn"),
+			MaxOpenConns:    viper.GetInt("postgres.max_open_conns"),
+			MaxIdleConns:    viper.GetInt("postgres.max_idle_conns"),
+			ConnMaxLifetime: viper.GetDuration("postgres.conn_max_lifetime"),
+			ConnMaxIdleTime: viper.GetDuration("postgres.conn_max_idle_time"),
+		},
+		Approvals: service.ApprovalConfig{
+			Thresholds:        viper.GetStringMapString("approvals.thresholds"),
+			RequiredApprovals: viper.GetInt("approvals.required"),
+			Organisations:     organisationApprovals(),
+		},
+		SchemeRules: rules,
+		Calendars:   calendars,
+		FX:          exchange,
+		Tariffs:     tariffs,
+	}, nil
+}
+
 func init() {
 	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().String("host", "localhost", "address to bind to; empty binds all interfaces")
+	serveCmd.Flags().String("port", "3000", "port to listen on")
+	serveCmd.Flags().String("store", api.StoreBadger, "store of payments: badger, eventstore, memory, sqlite or postgres")
+	serveCmd.Flags().Duration("read-timeout", 15*time.Second, "maximum duration of reading the entire request")
+	serveCmd.Flags().Duration("read-header-timeout", 5*time.Second, "maximum duration of reading request headers")
+	serveCmd.Flags().Duration("write-timeout", 20*time.Second, "maximum duration of writing the response")
+	serveCmd.Flags().Duration("idle-timeout", 60*time.Second, "maximum time to wait for the next request on keep-alive connections")
+	serveCmd.Flags().Int("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers")
+	serveCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "grace period for in-flight requests on shutdown")
+	serveCmd.Flags().Duration("shutdown-delay", 0, "time to keep serving after reporting not ready on shutdown")
+	viper.BindPFlag("host", serveCmd.Flags().Lookup("host"))
+	viper.BindPFlag("port", serveCmd.Flags().Lookup("port"))
+	viper.BindPFlag("store", serveCmd.Flags().Lookup("store"))
+	viper.BindPFlag("read_timeout", serveCmd.Flags().Lookup("read-timeout"))
+	viper.BindPFlag("read_header_timeout", serveCmd.Flags().Lookup("read-header-timeout"))
+	viper.BindPFlag("write_timeout", serveCmd.Flags().Lookup("write-timeout"))
+	viper.BindPFlag("idle_timeout", serveCmd.Flags().Lookup("idle-timeout"))
+	viper.BindPFlag("max_header_bytes", serveCmd.Flags().Lookup("max-header-bytes"))
+	viper.BindPFlag("shutdown_timeout", serveCmd.Flags().Lookup("shutdown-timeout"))
+	viper.BindPFlag("shutdown_delay", serveCmd.Flags().Lookup("shutdown-delay"))
+	serveCmd.Flags().String("tls-cert", "", "PEM encoded TLS certificate; enables HTTPS")
+	serveCmd.Flags().String("tls-key", "", "PEM encoded TLS private key")
+	serveCmd.Flags().String("tls-client-ca", "", "PEM encoded CA bundle verifying client certificates; enables mutual TLS")
+	viper.BindPFlag("tls.cert", serveCmd.Flags().Lookup("tls-cert"))
+	viper.BindPFlag("tls.key", serveCmd.Flags().Lookup("tls-key"))
+	viper.BindPFlag("tls.client_ca", serveCmd.Flags().Lookup("tls-client-ca"))
+	serveCmd.Flags().String("tracing-exporter", "none", "exporter of traces: none, stdout or otlp")
+	serveCmd.Flags().String("tracing-endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP endpoint traces are exported to")
+	viper.BindPFlag("tracing.exporter", serveCmd.Flags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing.endpoint", serveCmd.Flags().Lookup("tracing-endpoint"))
+	serveCmd.Flags().Duration("gc-interval", 10*time.Minute, "how often the value log garbage collection runs; 0 disables it")
+	serveCmd.Flags().Float64("gc-discard-ratio", repository.DefaultDiscardRatio, "fraction of stale data for a value log file to be rewritten")
+	viper.BindPFlag("gc.interval", serveCmd.Flags().Lookup("gc-interval"))
+	viper.BindPFlag("gc.discard_ratio", serveCmd.Flags().Lookup("gc-discard-ratio"))
+	viper.SetDefault("host", "localhost")
 	viper.SetDefault("port", "3000")
+	viper.SetDefault("store", api.StoreBadger)
 	viper.SetDefault("dbdir", "./db")
+	viper.SetDefault("sqlite.path", "./payments.sqlite")
+	viper.SetDefault("postgres.max_open_conns", 10)
+	viper.SetDefault("postgres.max_idle_conns", 5)
+	viper.SetDefault("postgres.conn_max_lifetime", "30m")
+	viper.SetDefault("postgres.conn_max_idle_time", "5m")
+	viper.SetDefault("codec", repository.JSONCodec.Name())
+	viper.SetDefault("cache.size", 0)
+	viper.SetDefault("cache.ttl", cache.DefaultTTL)
+	viper.SetDefault("health.min_free_disk", "100MB")
+	viper.SetDefault("gc.interval", "10m")
+	viper.SetDefault("gc.discard_ratio", repository.DefaultDiscardRatio)
+	viper.SetDefault("auth.jwks_refresh", "15m")
+	viper.SetDefault("auth.organisation_claim", "org_id")
+	viper.SetDefault("auth.roles_claim", "roles")
+	viper.SetDefault("rbac.enabled", false)
+	viper.SetDefault("approvals.required", 1)
+	viper.SetDefault("schemes.enabled", false)
+	viper.SetDefault("calendars.enabled", false)
+	viper.SetDefault("calendars.roll", false)
+	viper.SetDefault("fx.enabled", false)
+	viper.SetDefault("fx.tolerance", "0.01")
+	viper.SetDefault("fx.decimals", 2)
+	viper.SetDefault("fx.rounding", string(service.RoundHalfUp))
+	viper.SetDefault("charges.enabled", false)
+	viper.SetDefault("tracing.service_name", "paymentsapi")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+	viper.SetDefault("tls.client_scopes", []string{"payments:read"})
+}
+
+// organisationApprovals reads the per organisation number of required approvals.
+func organisationApprovals() map[string]int {
+	organisations := map[string]int{}
+	for org, required := range viper.GetStringMap("approvals.organisations") {
+		organisations[org] = cast.ToInt(required)
+	}
+	return organisations
+}
+
+// schemeRules returns the default rules of payment schemes, replaced by the
+// configured rules of the schemes named, or nil if they are disabled.
+func schemeRules() (map[string]service.SchemeRules, error) {
+	if !viper.GetBool("schemes.enabled") {
+		return nil, nil
+	}
+	var configured map[string]service.SchemeRules
+	if err := viper.UnmarshalKey("schemes.rules", &configured); err != nil {
+		return nil, fmt.Errorf("reading scheme rules: %v", err)
+	}
+	rules := map[string]service.SchemeRules{}
+	for scheme, schemeRules := range service.DefaultSchemeRules {
+		rules[scheme] = schemeRules
+	}
+	for scheme, schemeRules := range configured {
+		rules[strings.ToUpper(scheme)] = schemeRules
+	}
+	return rules, nil
+}
+
+// calendarConfig returns the embedded calendars, together with the ones loaded
+// from the configured files, and the calendars of schemes and currencies, the
+// defaults replaced by the configured ones. It returns no calendars if they
+// are disabled.
+func calendarConfig() (service.CalendarConfig, error) {
+	if !viper.GetBool("calendars.enabled") {
+		return service.CalendarConfig{}, nil
+	}
+	calendars, err := calendar.Embedded()
+	if err != nil {
+		return service.CalendarConfig{}, err
+	}
+	for name, path := range viper.GetStringMapString("calendars.files") {
+		name = strings.ToUpper(name)
+		if calendars[name], err = calendar.Load(name, path); err != nil {
+			return service.CalendarConfig{}, fmt.Errorf("loading calendar %s: %v", name, err)
+		}
+	}
+	config := service.CalendarConfig{
+		Calendars:  calendars,
+		Schemes:    map[string]string{},
+		Currencies: map[string]string{},
+		Roll:       viper.GetBool("calendars.roll"),
+	}
+	for _, mapping := range []struct {
+		names      map[string]string
+		defaults   map[string]string
+		configured string
+	}{
+		{config.Schemes, service.DefaultCalendarSchemes, "calendars.schemes"},
+		{config.Currencies, service.DefaultCalendarCurrencies, "calendars.currencies"},
+	} {
+		for key, name := range mapping.defaults {
+			mapping.names[key] = name
+		}
+		for key, name := range viper.GetStringMapString(mapping.configured) {
+			name = strings.ToUpper(name)
+			if _, found := calendars[name]; name != "" && !found {
+				return service.CalendarConfig{}, fmt.Errorf("%s.%s: unknown calendar %q", mapping.configured, key, name)
+			}
+			mapping.names[strings.ToUpper(key)] = name
+		}
+	}
+	return config, nil
+}
+
+// fxConfig returns the configuration of the checks of exchange rates, quoted
+// from the rates file if configured, or nil if they are disabled.
+func fxConfig() (*service.FXConfig, error) {
+	if !viper.GetBool("fx.enabled") {
+		return nil, nil
+	}
+	rounding, err := service.ParseRounding(viper.GetString("fx.rounding"))
+	if err != nil {
+		return nil, fmt.Errorf("fx.rounding: %v", err)
+	}
+	config := &service.FXConfig{
+		Tolerance: viper.GetString("fx.tolerance"),
+		Decimals:  viper.GetInt("fx.decimals"),
+		Rounding:  rounding,
+	}
+	if path := viper.GetString("fx.rates_file"); path != "" {
+		rates, err := fx.LoadStaticRates(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading exchange rates: %v", err)
+		}
+		config.Provider = rates
+	}
+	return config, nil
+}
+
+// tariffConfig returns the tariffs the charges of payments are calculated
+// with, or nil if their calculation is disabled.
+func tariffConfig() (*service.TariffConfig, error) {
+	if !viper.GetBool("charges.enabled") {
+		return nil, nil
+	}
+	config := &service.TariffConfig{}
+	if err := viper.UnmarshalKey("charges", config); err != nil {
+		return nil, fmt.Errorf("reading tariffs: %v", err)
+	}
+	return config, nil
 }
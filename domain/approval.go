@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// Payment statuses managed by the service.
+const (
+	StatusAccepted        = "accepted"         // StatusAccepted marks payments allowed to proceed
+	StatusPendingApproval = "pending_approval" // StatusPendingApproval marks payments awaiting approvals
+)
+
+// Approval records the approval of a payment by a principal.
+type Approval struct {
+	ApprovedBy string    `json:"approved_by"`
+	ApprovedAt time.Time `json:"approved_at"`
+}
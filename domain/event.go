@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"reflect"
+	"time"
+)
+
+// Types of the events recording the history of payments.
+const (
+	EventPaymentCreated     = "PaymentCreated"     // EventPaymentCreated carries the created payment
+	EventBeneficiaryChanged = "BeneficiaryChanged" // EventBeneficiaryChanged carries the new beneficiary
+	EventAmountAmended      = "AmountAmended"      // EventAmountAmended carries the new amount and currency
+	EventPaymentAmended     = "PaymentAmended"     // EventPaymentAmended carries the payment after any other change
+	EventPaymentApproved    = "PaymentApproved"    // EventPaymentApproved carries the approval and the resulting status
+	EventPaymentDeleted     = "PaymentDeleted"     // EventPaymentDeleted carries no data
+)
+
+// Event is a change of a payment. The state of a payment is the result of
+// applying the events of its stream in order.
+type Event struct {
+	Type       string    `json:"type"`
+	PaymentID  string    `json:"payment_id"`
+	Version    int       `json:"version"`         // Version is the position in the stream of the payment, starting with 1
+	OccurredAt time.Time `json:"occurred_at"`     // OccurredAt is set when the event is stored
+	Actor      string    `json:"actor,omitempty"` // Actor is the subject of the principal causing the event, if any
+
+	Payment     *Payment                 `json:"payment,omitempty"`
+	Beneficiary *BeneficiaryPaymentParty `json:"beneficiary_party,omitempty"`
+	Amount      string                   `json:"amount,omitempty"`
+	Currency    string                   `json:"currency,omitempty"`
+	Approval    *Approval                `json:"approval,omitempty"`
+	Status      string                   `json:"status,omitempty"`
+}
+
+// Amendments returns the events of updating the payment before into the one
+// after. Changes of the beneficiary and the amount are recorded by their own
+// events, followed by an EventPaymentAmended event if anything else changed.
+// The versions of the payments, managed by the repositories, are not compared.
+func Amendments(before, after *Payment) []Event {
+	var events []Event
+	if !reflect.DeepEqual(before.Attributes.Beneficiary, after.Attributes.Beneficiary) {
+		beneficiary := after.Attributes.Beneficiary
+		events = append(events, Event{Type: EventBeneficiaryChanged, PaymentID: after.ID, Beneficiary: &beneficiary})
+	}
+	if before.Attributes.Amount != after.Attributes.Amount || before.Attributes.Currency != after.Attributes.Currency {
+		events = append(events, Event{
+			Type:      EventAmountAmended,
+			PaymentID: after.ID,
+			Amount:    after.Attributes.Amount,
+			Currency:  after.Attributes.Currency,
+		})
+	}
+	changed := *Replay(before, events)
+	changed.Version = after.Version
+	if !reflect.DeepEqual(&changed, after) {
+		events = append(events, Event{Type: EventPaymentAmended, PaymentID: after.ID, Payment: after})
+	}
+	return events
+}
+
+// Replay returns the payment resulting from applying the events to it, or nil
+// if it was deleted. The payment is not modified, but the result may share
+// memory with it and with the events.
+func Replay(payment *Payment, events []Event) *Payment {
+	for _, event := range events {
+		payment = event.apply(payment)
+	}
+	return payment
+}
+
+// apply returns the payment after the event. Only PaymentCreated events
+// create payments; other events do not bring deleted payments back.
+func (e *Event) apply(payment *Payment) *Payment {
+	switch e.Type {
+	case EventPaymentCreated:
+		applied := *e.Payment
+		return &applied
+	case EventPaymentDeleted:
+		return nil
+	}
+	if payment == nil {
+		return nil
+	}
+	applied := *payment
+	switch e.Type {
+	case EventPaymentAmended:
+		applied = *e.Payment
+	case EventBeneficiaryChanged:
+		applied.Attributes.Beneficiary = *e.Beneficiary
+	case EventAmountAmended:
+		applied.Attributes.Amount = e.Amount
+		applied.Attributes.Currency = e.Currency
+	case EventPaymentApproved:
+		applied.Approvals = append(append([]Approval(nil), payment.Approvals...), *e.Approval)
+		applied.Status = e.Status
+	}
+	return &applied
+}
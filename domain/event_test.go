@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Replaying the amendments results in the updated payment", func(t *testing.T) {
+		before := testPayment()
+		after := testPayment()
+		after.Attributes.Beneficiary.Name = "Miss Moneypenny"
+		after.Attributes.Amount = "200.00"
+		after.Attributes.Reference = "changed"
+
+		events := Amendments(before, after)
+
+		var types []string
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+		assert.Equal([]string{EventBeneficiaryChanged, EventAmountAmended, EventPaymentAmended}, types)
+		assert.Equal(after, Replay(before, events))
+		assert.Equal("100.00", before.Attributes.Amount, "Original payment was modified")
+	})
+
+	t.Run("Specific changes are not recorded as amendments", func(t *testing.T) {
+		before := testPayment()
+		after := testPayment()
+		after.Attributes.Currency = "EUR"
+
+		events := Amendments(before, after)
+
+		assert.Len(events, 1)
+		assert.Equal(EventAmountAmended, events[0].Type)
+		assert.Equal(after, Replay(before, events))
+	})
+
+	t.Run("Versions are not amendments", func(t *testing.T) {
+		before := testPayment()
+		after := testPayment()
+		after.Version = 2
+
+		assert.Empty(Amendments(before, after))
+		assert.Equal(int64(0), before.Version, "Original payment was modified")
+	})
+
+	t.Run("Approvals add to those collected", func(t *testing.T) {
+		payment := testPayment()
+		payment.Approvals = []Approval{{ApprovedBy: "first"}}
+		approval := Approval{ApprovedBy: "second"}
+
+		approved := Replay(payment, []Event{{Type: EventPaymentApproved, Approval: &approval, Status: StatusAccepted}})
+
+		assert.Equal([]Approval{{ApprovedBy: "first"}, approval}, approved.Approvals)
+		assert.Equal(StatusAccepted, approved.Status)
+		assert.Len(payment.Approvals, 1, "Original payment was modified")
+	})
+
+	t.Run("Creating and deleting payments", func(t *testing.T) {
+		payment := testPayment()
+
+		created := []Event{{Type: EventPaymentCreated, Payment: payment}}
+		deleted := []Event{{Type: EventPaymentDeleted}}
+
+		assert.Equal(payment, Replay(nil, created))
+		assert.Nil(Replay(payment, deleted))
+		assert.Nil(Replay(nil, []Event{{Type: EventPaymentAmended, Payment: payment}}), "Amendments must not bring deleted payments back")
+		assert.Nil(Replay(nil, []Event{{Type: EventPaymentApproved, Approval: &Approval{}}}), "Approvals must not bring deleted payments back")
+	})
+
+	t.Run("Masking account numbers of events", func(t *testing.T) {
+		payment := testPayment()
+		event := &Event{Type: EventBeneficiaryChanged, Beneficiary: &payment.Attributes.Beneficiary, Payment: payment}
+
+		masked := MaskEventAccountNumbers(event)
+
+		assert.Equal("************5678", masked.Beneficiary.AccountNumber)
+		assert.Equal("************5678", masked.Payment.Attributes.Debtor.AccountNumber)
+		assert.Equal("GB29XBKC12345678", payment.Attributes.Beneficiary.AccountNumber, "Original event was modified")
+	})
+}
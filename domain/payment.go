@@ -2,14 +2,24 @@ package domain
 
 import (
 	"encoding/json"
+	"errors"
 )
 
+// ErrVersionConflict is returned by repositories updating a payment whose
+// Version is not the stored one, as it was changed since it was read.
+var ErrVersionConflict = errors.New("payment changed concurrently")
+
 // Payment is the base data structure provided by the service.
 // It describes a single payment registered in the system.
 type Payment struct {
 	ID             string            `json:"id" validate:"-"`
 	OrganisationID string            `json:"organisation_id" validate:"required"`
 	Attributes     PaymentAttributes `json:"attributes" validate:"required"`
+	Status         string            `json:"status,omitempty" validate:"-"`     // Status is managed by the service
+	CreatedBy      string            `json:"created_by,omitempty" validate:"-"` // CreatedBy is the subject of the creator
+	Approvals      []Approval        `json:"approvals,omitempty" validate:"-"`  // Approvals collected so far
+	UpdatedBy      string            `json:"updated_by,omitempty" validate:"-"` // UpdatedBy is the subject of the last modifier
+	Version        int64             `json:"version" validate:"-"`              // Version of the stored payment, incremented by the repositories on updates
 }
 
 // PaymentToByteSlice encodes the Payment to byte slice.
@@ -27,3 +37,17 @@ func PaymentFromByteSlice(data []byte) (*Payment, error) {
 	err := json.Unmarshal(data, &p)
 	return &p, err
 }
+
+// Clone returns a deep copy of the payment.
+func (p *Payment) Clone() *Payment {
+	c := *p
+	if charges := p.Attributes.ChargesInformation.SenderCharges; charges != nil {
+		c.Attributes.ChargesInformation.SenderCharges = make([]Charge, len(charges))
+		copy(c.Attributes.ChargesInformation.SenderCharges, charges)
+	}
+	if p.Approvals != nil {
+		c.Approvals = make([]Approval, len(p.Approvals))
+		copy(c.Approvals, p.Approvals)
+	}
+	return &c
+}
@@ -14,7 +14,7 @@ type PaymentAttributes struct {
 	PaymentPurpose       string                  `json:"payment_purpose" validate:"required"`
 	PaymentScheme        string                  `json:"payment_scheme" validate:"required"`
 	PaymentType          string                  `json:"payment_type" validate:"required"`
-	ProcessingDate       string                  `json:"processing_date" validate:"required"`
+	ProcessingDate       string                  `json:"processing_date" validate:"required,date"`
 	SchemePaymentType    string                  `json:"scheme_payment_type" validate:"required"`
 	SchemePaymentSubType string                  `json:"scheme_payment_sub_type" validate:"required"`
 	Reference            string                  `json:"reference" validate:"required"`
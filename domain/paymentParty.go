@@ -2,7 +2,7 @@ package domain
 
 // Account holds the base information about an account
 type Account struct {
-	AccountNumber string `json:"account_number" validate:"required"`
+	AccountNumber string `json:"account_number" validate:"required" pii:"last4"`
 	BankID        string `json:"bank_id" validate:"required"`
 	BankIDCode    string `json:"bank_id_code" validate:"required"`
 }
@@ -10,10 +10,10 @@ type Account struct {
 // PaymentParty is a party taking part in the payment transaction
 type PaymentParty struct {
 	Account
-	AccountName       string `json:"account_name" validate:"required"`
+	AccountName       string `json:"account_name" validate:"required" pii:"redact"`
 	AccountNumberCode string `json:"account_number_code" validate:"required,oneof=IBAN BBAN"`
-	Address           string `json:"address" validate:"required"`
-	Name              string `json:"name" validate:"required"`
+	Address           string `json:"address" validate:"required" pii:"redact"`
+	Name              string `json:"name" validate:"required" pii:"redact"`
 }
 
 // BeneficiaryPaymentParty is a PaymentParty with additional AccountType field
@@ -0,0 +1,154 @@
+package domain
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Personal data is marked with the pii struct tag of string fields:
+//
+//	pii:"redact" - the value is replaced entirely when redacted
+//	pii:"last4"  - all but the last 4 characters are masked, e.g. account numbers
+const (
+	piiTag    = "pii"
+	piiRedact = "redact"
+	piiLast4  = "last4"
+
+	// RedactedValue replaces values of fields tagged pii:"redact".
+	RedactedValue = "[REDACTED]"
+)
+
+// Redacted returns a copy of the payment with all personal data masked,
+// suitable for logs.
+func (p *Payment) Redacted() interface{} {
+	return RedactPayment(p)
+}
+
+// PersonalData returns the values of all personal data of the payment, so
+// that they are scrubbed from logs quoting them, e.g. in errors.
+func (p *Payment) PersonalData() []string {
+	var values []string
+	TransformPII(p, func(_, value string) (string, error) {
+		if value != "" {
+			values = append(values, value)
+		}
+		return value, nil
+	})
+	return values
+}
+
+// RedactPayment returns a copy of the payment with all personal data masked.
+func RedactPayment(p *Payment) *Payment {
+	redacted, _ := TransformPII(p, func(kind, value string) (string, error) {
+		return mask(value, kind), nil
+	})
+	return redacted
+}
+
+// MaskAccountNumbers returns a copy of the payment with account numbers
+// masked except for their last 4 digits.
+func MaskAccountNumbers(p *Payment) *Payment {
+	masked, _ := TransformPII(p, maskLast4)
+	return masked
+}
+
+// MaskEventAccountNumbers returns a copy of the event with account numbers of
+// the payment or the beneficiary it carries masked except for their last 4 digits.
+func MaskEventAccountNumbers(e *Event) *Event {
+	c := *e
+	c.Payment = MaskAccountNumbers(e.Payment)
+	if e.Beneficiary != nil {
+		beneficiary := *e.Beneficiary
+		transformValue(reflect.ValueOf(&beneficiary).Elem(), maskLast4)
+		c.Beneficiary = &beneficiary
+	}
+	return &c
+}
+
+func maskLast4(kind, value string) (string, error) {
+	if kind != piiLast4 {
+		return value, nil
+	}
+	return mask(value, kind), nil
+}
+
+// TransformPII returns a copy of the payment with every field tagged as
+// personal data replaced by the result of fn, given the kind of the tag and
+// the value of the field. The original payment is left intact.
+func TransformPII(p *Payment, fn func(kind, value string) (string, error)) (*Payment, error) {
+	if p == nil {
+		return nil, nil
+	}
+	c := *p
+	if err := transformValue(reflect.ValueOf(&c).Elem(), fn); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// transformValue transforms the tagged fields of v, which must be addressable
+// and must not share memory with the original, except for slices copied here.
+func transformValue(v reflect.Value, fn func(kind, value string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			if kind := t.Field(i).Tag.Get(piiTag); kind != "" && field.Kind() == reflect.String {
+				value, err := fn(kind, field.String())
+				if err != nil {
+					return err
+				}
+				field.SetString(value)
+				continue
+			}
+			if err := transformValue(field, fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.IsNil() || !hasPII(v.Type().Elem()) {
+			return nil
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(copied, v)
+		v.Set(copied)
+		for i := 0; i < v.Len(); i++ {
+			if err := transformValue(v.Index(i), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasPII reports whether values of type t may contain tagged fields.
+func hasPII(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get(piiTag) != "" || hasPII(t.Field(i).Type) {
+				return true
+			}
+		}
+	case reflect.Slice:
+		return hasPII(t.Elem())
+	}
+	return false
+}
+
+func mask(value, kind string) string {
+	if value == "" {
+		return ""
+	}
+	if kind == piiRedact {
+		return RedactedValue
+	}
+	if len(value) <= 4 {
+		return strings.Repeat("*", len(value))
+	}
+	return strings.Repeat("*", len(value)-4) + value[len(value)-4:]
+}
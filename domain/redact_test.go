@@ -0,0 +1,75 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPayment() *Payment {
+	party := PaymentParty{
+		Account:     Account{AccountNumber: "GB29XBKC12345678", BankID: "403000", BankIDCode: "GBDSC"},
+		AccountName: "James Bond",
+		Address:     "1 The Street",
+		Name:        "James Bond",
+	}
+	return &Payment{
+		ID: "id",
+		Attributes: PaymentAttributes{
+			Amount:      "100.00",
+			Beneficiary: BeneficiaryPaymentParty{PaymentParty: party},
+			Debtor:      party,
+			Sponsor:     Account{AccountNumber: "56781234", BankID: "123123"},
+			ChargesInformation: ChargesInformation{
+				SenderCharges: []Charge{{Amount: "5.00", Currency: "GBP"}},
+			},
+		},
+	}
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("All personal data is redacted", func(t *testing.T) {
+		payment := testPayment()
+
+		redacted := RedactPayment(payment)
+
+		debtor := redacted.Attributes.Debtor
+		assert.Equal("************5678", debtor.AccountNumber)
+		assert.Equal(RedactedValue, debtor.Name)
+		assert.Equal(RedactedValue, debtor.AccountName)
+		assert.Equal(RedactedValue, debtor.Address)
+		assert.Equal(RedactedValue, redacted.Attributes.Beneficiary.Name)
+		assert.Equal("****1234", redacted.Attributes.Sponsor.AccountNumber)
+		assert.Equal("403000", debtor.BankID)
+		assert.Equal("100.00", redacted.Attributes.Amount)
+		assert.Equal("James Bond", payment.Attributes.Debtor.Name, "Original payment was modified")
+	})
+
+	t.Run("Masking account numbers keeps other data", func(t *testing.T) {
+		masked := MaskAccountNumbers(testPayment())
+
+		assert.Equal("************5678", masked.Attributes.Beneficiary.AccountNumber)
+		assert.Equal("James Bond", masked.Attributes.Beneficiary.Name)
+	})
+
+	t.Run("Short and empty values are masked entirely", func(t *testing.T) {
+		assert.Equal("***", mask("123", piiLast4))
+		assert.Equal("", mask("", piiRedact))
+	})
+
+	t.Run("Personal data is listed", func(t *testing.T) {
+		values := testPayment().PersonalData()
+
+		assert.Contains(values, "James Bond")
+		assert.Contains(values, "GB29XBKC12345678")
+		assert.Contains(values, "56781234")
+		assert.NotContains(values, "403000")
+		assert.NotContains(values, "")
+	})
+
+	t.Run("Nil payment is redacted to nil", func(t *testing.T) {
+		assert.Nil(RedactPayment(nil))
+	})
+}
@@ -0,0 +1,173 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// prefix starts encrypted values, which have the form
+// enc:v1:<master key ID>:<wrapped data key>:<ciphertext>, with the wrapped
+// data key and the ciphertext base64 encoded and prefixed with their nonces.
+const prefix = "enc:v1:"
+
+// ErrMalformed is returned for encrypted values which cannot be parsed.
+var ErrMalformed = errors.New("malformed encrypted value")
+
+// Encrypter encrypts the personal data of payments, as tagged in the domain,
+// with a data key per payment. It is safe for concurrent use.
+type Encrypter struct {
+	mu      sync.RWMutex
+	keyring *Keyring
+}
+
+// NewEncrypter creates an Encrypter using keys of the keyring.
+func NewEncrypter(keyring *Keyring) *Encrypter {
+	return &Encrypter{keyring: keyring}
+}
+
+// Reload replaces the keyring, e.g. once rotated in the keyfile. It fails,
+// keeping the current keyring, if any of its keys is missing in the new one,
+// as data encrypted with that key would become unreadable.
+func (e *Encrypter) Reload(keyring *Keyring) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id := range e.keyring.Keys {
+		if _, found := keyring.Keys[id]; !found {
+			return fmt.Errorf("key %s missing in the new keyring", id)
+		}
+	}
+	e.keyring = keyring
+	return nil
+}
+
+func (e *Encrypter) current() *Keyring {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.keyring
+}
+
+// EncryptPayment returns a copy of the payment with personal data encrypted
+// using a new data key wrapped with the active master key.
+func (e *Encrypter) EncryptPayment(p *domain.Payment) (*domain.Payment, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	keyring := e.current()
+	masterKey, err := keyring.key(keyring.Active)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(masterKey, dataKey, []byte(keyring.Active))
+	if err != nil {
+		return nil, err
+	}
+	header := prefix + keyring.Active + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":"
+	return domain.TransformPII(p, func(_, value string) (string, error) {
+		if value == "" {
+			return "", nil
+		}
+		sealed, err := seal(dataKey, []byte(value), nil)
+		if err != nil {
+			return "", err
+		}
+		return header + base64.RawStdEncoding.EncodeToString(sealed), nil
+	})
+}
+
+// DecryptPayment returns a copy of the payment with personal data decrypted.
+// Values which are not encrypted are returned as they are, so that records
+// stored before encryption was enabled remain readable.
+func (e *Encrypter) DecryptPayment(p *domain.Payment) (*domain.Payment, error) {
+	keyring := e.current()
+	dataKeys := map[string][]byte{} // unwrapped data keys by wrapped key
+	return domain.TransformPII(p, func(_, value string) (string, error) {
+		if !strings.HasPrefix(value, prefix) {
+			return value, nil
+		}
+		parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+		if len(parts) != 3 {
+			return "", ErrMalformed
+		}
+		keyID, wrapped, ciphertext := parts[0], parts[1], parts[2]
+		dataKey, found := dataKeys[wrapped]
+		if !found {
+			masterKey, err := keyring.key(keyID)
+			if err != nil {
+				return "", err
+			}
+			decoded, err := base64.RawStdEncoding.DecodeString(wrapped)
+			if err != nil {
+				return "", ErrMalformed
+			}
+			if dataKey, err = open(masterKey, decoded, []byte(keyID)); err != nil {
+				return "", fmt.Errorf("unwrapping data key with master key %s: %v", keyID, err)
+			}
+			dataKeys[wrapped] = dataKey
+		}
+		decoded, err := base64.RawStdEncoding.DecodeString(ciphertext)
+		if err != nil {
+			return "", ErrMalformed
+		}
+		plaintext, err := open(dataKey, decoded, nil)
+		if err != nil {
+			return "", fmt.Errorf("decrypting value: %v", err)
+		}
+		return string(plaintext), nil
+	})
+}
+
+// NeedsRotation reports whether any personal data of the stored payment
+// is in clear text or encrypted with a master key other than the active one.
+func (e *Encrypter) NeedsRotation(p *domain.Payment) bool {
+	current := prefix + e.current().Active + ":"
+	needed := false
+	domain.TransformPII(p, func(_, value string) (string, error) {
+		if value != "" && !strings.HasPrefix(value, current) {
+			needed = true
+		}
+		return value, nil
+	})
+	return needed
+}
+
+// seal encrypts with AES-GCM, prefixing the ciphertext with the random nonce.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the output of seal.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
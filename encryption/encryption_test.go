@@ -0,0 +1,134 @@
+package encryption
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+func testPayment() *domain.Payment {
+	return &domain.Payment{
+		ID: "id",
+		Attributes: domain.PaymentAttributes{
+			Amount: "100.00",
+			Debtor: domain.PaymentParty{
+				Account: domain.Account{AccountNumber: "GB29XABC10161234567801", BankID: "203301"},
+				Name:    "Jane Doe",
+				Address: "10 Debtor Crescent",
+			},
+		},
+	}
+}
+
+func TestEncrypter(t *testing.T) {
+	assert := assert.New(t)
+	keyring, _ := NewKeyring()
+	encrypter := NewEncrypter(keyring)
+	payment := testPayment()
+
+	t.Run("Personal data is encrypted and decrypted", func(t *testing.T) {
+		encrypted, err := encrypter.EncryptPayment(payment)
+		decrypted, decryptErr := encrypter.DecryptPayment(encrypted)
+
+		assert.Nil(err)
+		assert.Nil(decryptErr)
+		debtor := encrypted.Attributes.Debtor
+		assert.True(strings.HasPrefix(debtor.Name, prefix+keyring.Active+":"))
+		assert.NotContains(debtor.AccountNumber, "GB29XABC10161234567801")
+		assert.Equal("", debtor.AccountName, "Empty values are not encrypted")
+		assert.Equal("203301", debtor.BankID)
+		assert.Equal("Jane Doe", payment.Attributes.Debtor.Name, "Original payment was modified")
+		assert.Equal(payment, decrypted)
+	})
+
+	t.Run("Clear text values are read as they are", func(t *testing.T) {
+		decrypted, err := encrypter.DecryptPayment(payment)
+
+		assert.Nil(err)
+		assert.Equal(payment, decrypted)
+	})
+
+	t.Run("Rotated keyring decrypts data encrypted with previous keys", func(t *testing.T) {
+		encrypted, _ := encrypter.EncryptPayment(payment)
+		previous := keyring.Active
+		keyring.Rotate()
+
+		decrypted, err := encrypter.DecryptPayment(encrypted)
+
+		assert.Nil(err)
+		assert.Equal(payment, decrypted)
+		assert.NotEqual(previous, keyring.Active)
+		assert.True(encrypter.NeedsRotation(encrypted))
+		assert.True(encrypter.NeedsRotation(payment))
+		reencrypted, _ := encrypter.EncryptPayment(decrypted)
+		assert.False(encrypter.NeedsRotation(reencrypted))
+	})
+
+	t.Run("Reloaded keyrings must keep the previous keys", func(t *testing.T) {
+		encrypted, _ := encrypter.EncryptPayment(payment)
+		rotated := &Keyring{Active: keyring.Active, Keys: map[string][]byte{}}
+		for id, key := range keyring.Keys {
+			rotated.Keys[id] = key
+		}
+		rotated.Rotate()
+		other, _ := NewKeyring()
+
+		otherErr := encrypter.Reload(other)
+		err := encrypter.Reload(rotated)
+		decrypted, decryptErr := encrypter.DecryptPayment(encrypted)
+
+		assert.Error(otherErr)
+		assert.Nil(err)
+		assert.Nil(decryptErr)
+		assert.Equal(payment, decrypted)
+		assert.True(encrypter.NeedsRotation(encrypted), "Payments must be re-encrypted with the reloaded active key")
+		keyring = rotated
+	})
+
+	t.Run("Unknown keys and tampered values are rejected", func(t *testing.T) {
+		encrypted, _ := encrypter.EncryptPayment(payment)
+		other, _ := NewKeyring()
+		tampered := *encrypted
+		name := encrypted.Attributes.Debtor.Name
+		flipped := "A"
+		if strings.HasSuffix(name, flipped) {
+			flipped = "B"
+		}
+		tampered.Attributes.Debtor.Name = name[:len(name)-1] + flipped
+
+		_, unknownErr := NewEncrypter(other).DecryptPayment(encrypted)
+		_, tamperedErr := encrypter.DecryptPayment(&tampered)
+
+		assert.Error(unknownErr)
+		assert.Error(tamperedErr)
+	})
+}
+
+func TestKeyring(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "paymentsapikeys")
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "keys.json")
+	keyring, _ := NewKeyring()
+	keyring.Rotate()
+
+	err := keyring.Save(keyfile)
+	loaded, loadErr := LoadKeyring(keyfile)
+	info, _ := os.Stat(keyfile)
+
+	assert.Nil(err)
+	assert.Nil(loadErr)
+	assert.Equal(keyring, loaded)
+	assert.Len(loaded.Keys, 2)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	ioutil.WriteFile(keyfile, []byte(`{"active":"missing","keys":{}}`), 0600)
+	_, err = LoadKeyring(keyfile)
+	assert.Error(err)
+}
@@ -0,0 +1,103 @@
+// Package encryption implements envelope encryption of personal data in
+// stored payments: every record gets a random AES-GCM data key, which is
+// wrapped with the active master key of the keyring.
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// KeySize is the size of master and data keys, selecting AES-256.
+const KeySize = 32
+
+// ErrUnknownKey is returned when data was encrypted with a master key
+// which is not in the keyring.
+var ErrUnknownKey = errors.New("unknown master key")
+
+// Keyring holds the master keys by ID. New data keys are wrapped with the
+// active key, while the others are kept to unwrap existing data keys.
+type Keyring struct {
+	Active string            `json:"active"`
+	Keys   map[string][]byte `json:"keys"` // Keys are base64 encoded in the keyfile
+}
+
+// NewKeyring creates a keyring with a single, newly generated, active key.
+func NewKeyring() (*Keyring, error) {
+	k := &Keyring{Keys: map[string][]byte{}}
+	return k, k.Rotate()
+}
+
+// LoadKeyring reads the keyring from the keyfile.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k Keyring
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("parsing keyfile %s: %v", path, err)
+	}
+	if _, found := k.Keys[k.Active]; !found {
+		return nil, fmt.Errorf("active key %q missing in keyfile %s", k.Active, path)
+	}
+	for id, key := range k.Keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %q in keyfile %s must be %d bytes long", id, path, KeySize)
+		}
+	}
+	return &k, nil
+}
+
+// Save writes the keyring to the keyfile, readable only by the owner.
+// The file is replaced atomically, so that keys are never lost half-written.
+func (k *Keyring) Save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Rotate generates a new master key and makes it the active one.
+func (k *Keyring) Rotate() error {
+	id := make([]byte, 8)
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	k.Active = hex.EncodeToString(id)
+	k.Keys[k.Active] = key
+	return nil
+}
+
+func (k *Keyring) key(id string) ([]byte, error) {
+	key, found := k.Keys[id]
+	if !found {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
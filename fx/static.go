@@ -0,0 +1,71 @@
+// Package fx implements providers of the exchange rates of payments.
+package fx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/mysza/paymentsapi/service"
+)
+
+// Rate is an exchange rate from one currency into another.
+type Rate struct {
+	From              string `json:"from"`                         // From is the original currency
+	To                string `json:"to"`                           // To is the currency amounts are converted into
+	Rate              string `json:"rate"`                         // Rate converts amounts in From into To
+	ContractReference string `json:"contract_reference,omitempty"` // ContractReference defaults to STATIC followed by both currencies
+}
+
+// StaticRates quotes fixed exchange rates, e.g. in tests and demos.
+// It is safe for concurrent use.
+type StaticRates struct {
+	quotes map[string]*service.FXQuote
+}
+
+// NewStaticRates creates a provider quoting the rates.
+func NewStaticRates(rates []Rate) (*StaticRates, error) {
+	s := &StaticRates{quotes: make(map[string]*service.FXQuote, len(rates))}
+	for _, rate := range rates {
+		from, to := strings.ToUpper(rate.From), strings.ToUpper(rate.To)
+		if value, ok := new(big.Rat).SetString(rate.Rate); !ok || value.Sign() <= 0 {
+			return nil, fmt.Errorf("rate from %s to %s: invalid rate %q", from, to, rate.Rate)
+		}
+		reference := rate.ContractReference
+		if reference == "" {
+			reference = "STATIC" + from + to
+		}
+		s.quotes[from+to] = &service.FXQuote{Rate: rate.Rate, ContractReference: reference}
+	}
+	return s, nil
+}
+
+// LoadStaticRates creates a provider quoting the rates listed in the JSON file,
+// e.g. [{"from": "USD", "to": "GBP", "rate": "0.75"}].
+func LoadStaticRates(path string) (*StaticRates, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rates []Rate
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("parsing rates: %v", err)
+	}
+	return NewStaticRates(rates)
+}
+
+// Quote returns the rate from the original currency into the currency.
+func (s *StaticRates) Quote(ctx context.Context, originalCurrency, currency string) (*service.FXQuote, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	quote, found := s.quotes[strings.ToUpper(originalCurrency)+strings.ToUpper(currency)]
+	if !found {
+		return nil, service.ErrNoFXRate
+	}
+	quoted := *quote
+	return &quoted, nil
+}
@@ -0,0 +1,58 @@
+package fx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/service"
+)
+
+func TestStaticRates(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	t.Run("Rates are quoted by pair of currencies", func(t *testing.T) {
+		rates, err := NewStaticRates([]Rate{
+			{From: "usd", To: "GBP", Rate: "0.75"},
+			{From: "EUR", To: "GBP", Rate: "0.88", ContractReference: "FX123"},
+		})
+
+		usd, usdErr := rates.Quote(ctx, "USD", "gbp")
+		eur, _ := rates.Quote(ctx, "EUR", "GBP")
+		_, inverseErr := rates.Quote(ctx, "GBP", "USD")
+
+		assert.Nil(err)
+		assert.Nil(usdErr)
+		assert.Equal(&service.FXQuote{Rate: "0.75", ContractReference: "STATICUSDGBP"}, usd)
+		assert.Equal("FX123", eur.ContractReference)
+		assert.Equal(service.ErrNoFXRate, inverseErr)
+	})
+
+	t.Run("Rates must be positive numbers", func(t *testing.T) {
+		_, negativeErr := NewStaticRates([]Rate{{From: "USD", To: "GBP", Rate: "-1"}})
+		_, invalidErr := NewStaticRates([]Rate{{From: "USD", To: "GBP", Rate: "high"}})
+
+		assert.Error(negativeErr)
+		assert.Error(invalidErr)
+	})
+
+	t.Run("Rates are loaded from files", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "paymentsapifx")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rates.json")
+		ioutil.WriteFile(path, []byte(`[{"from": "USD", "to": "GBP", "rate": "0.75"}]`), 0600)
+
+		rates, err := LoadStaticRates(path)
+		quote, _ := rates.Quote(ctx, "USD", "GBP")
+		_, missingErr := LoadStaticRates(filepath.Join(dir, "missing.json"))
+
+		assert.Nil(err)
+		assert.Equal("0.75", quote.Rate)
+		assert.Error(missingErr)
+	})
+}
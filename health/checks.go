@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrShuttingDown is reported by the shutdown check once shutdown begins.
+var ErrShuttingDown = errors.New("shutting down")
+
+// Shutdown tracks whether the service is shutting down, so that it stops
+// being ready and load balancers drain it before connections are closed.
+type Shutdown struct {
+	begun int32
+}
+
+// Begin marks the start of the shutdown.
+func (s *Shutdown) Begin() {
+	atomic.StoreInt32(&s.begun, 1)
+}
+
+// Begun reports whether the shutdown has begun.
+func (s *Shutdown) Begun() bool {
+	return atomic.LoadInt32(&s.begun) == 1
+}
+
+// Check fails once the shutdown has begun.
+func (s *Shutdown) Check(context.Context) error {
+	if s.Begun() {
+		return ErrShuttingDown
+	}
+	return nil
+}
+
+// DiskSpace returns a check failing when less than minFree bytes
+// are available to the service on the filesystem holding path.
+func DiskSpace(path string, minFree uint64) Check {
+	return func(context.Context) error {
+		free, err := freeSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%d bytes free in %s, below the minimum of %d", free, path, minFree)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,28 @@
+package health
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// freeSpace returns the number of bytes available to the caller
+// on the volume holding path.
+func freeSpace(path string) (uint64, error) {
+	kernel32, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		return 0, err
+	}
+	proc, err := kernel32.FindProc("GetDiskFreeSpaceExW")
+	if err != nil {
+		return 0, err
+	}
+	dir, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if ok, _, err := proc.Call(uintptr(unsafe.Pointer(dir)), uintptr(unsafe.Pointer(&free)), 0, 0); ok == 0 {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("broken") }
+	hanging := func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return nil
+	}
+
+	t.Run("Report is ok when all checks pass", func(t *testing.T) {
+		registry := NewRegistry(DefaultTimeout)
+		registry.Register("first", ok)
+		registry.Register("second", ok)
+
+		report := registry.Run(context.Background())
+
+		assert.Equal(StatusOK, report.Status)
+		assert.Len(report.Checks, 2)
+	})
+
+	t.Run("Report is failing when any check fails", func(t *testing.T) {
+		registry := NewRegistry(DefaultTimeout)
+		registry.Register("ok", ok)
+		registry.Register("failing", failing)
+
+		report := registry.Run(context.Background())
+
+		assert.Equal(StatusFailing, report.Status)
+		assert.Equal(CheckResult{Status: StatusOK}, report.Checks["ok"])
+		assert.Equal(CheckResult{Status: StatusFailing, Error: "broken"}, report.Checks["failing"])
+	})
+
+	t.Run("Checks exceeding the timeout fail", func(t *testing.T) {
+		registry := NewRegistry(10 * time.Millisecond)
+		registry.Register("hanging", hanging)
+		start := time.Now()
+
+		report := registry.Run(context.Background())
+
+		assert.True(time.Since(start) < time.Second, "Run waited for the hanging check")
+		assert.Equal(StatusFailing, report.Checks["hanging"].Status)
+	})
+
+	t.Run("Handler responds 503 with details when failing", func(t *testing.T) {
+		registry := NewRegistry(DefaultTimeout)
+		registry.Register("failing", failing)
+		recorder := httptest.NewRecorder()
+
+		registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+		var report Report
+		json.NewDecoder(recorder.Body).Decode(&report)
+		assert.Equal(http.StatusServiceUnavailable, recorder.Code)
+		assert.Equal("broken", report.Checks["failing"].Error)
+	})
+}
+
+func TestChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Shutdown check fails once shutdown begins", func(t *testing.T) {
+		shutdown := &Shutdown{}
+
+		before := shutdown.Check(context.Background())
+		shutdown.Begin()
+		after := shutdown.Check(context.Background())
+
+		assert.Nil(before)
+		assert.Equal(ErrShuttingDown, after)
+	})
+
+	t.Run("Disk space check compares free space with the minimum", func(t *testing.T) {
+		dir := os.TempDir()
+
+		assert.Nil(DiskSpace(dir, 0)(context.Background()))
+		assert.Error(DiskSpace(dir, math.MaxUint64)(context.Background()))
+		assert.Error(DiskSpace("/does/not/exist", 0)(context.Background()))
+	})
+}
@@ -0,0 +1,192 @@
+// Package logging configures the application logs and carries
+// request-scoped loggers in contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Configure sets the format, FormatText or FormatJSON, and the minimum level
+// of the standard logger.
+func Configure(format, level string) error {
+	switch format {
+	case FormatText:
+		logrus.SetFormatter(NewRedactingFormatter(&logrus.TextFormatter{}))
+	case FormatJSON:
+		logrus.SetFormatter(NewRedactingFormatter(&logrus.JSONFormatter{}))
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+// Redacter is implemented by values holding personal data, which must be
+// replaced with their redacted copies before being logged.
+type Redacter interface {
+	Redacted() interface{}
+}
+
+// PersonalDataHolder is implemented by Redacter values which list the personal
+// data they hold, so that it is also scrubbed from the message and the other
+// fields of entries logging them, e.g. errors quoting it.
+type PersonalDataHolder interface {
+	PersonalData() []string
+}
+
+// redactedValue replaces personal data scrubbed from messages and fields.
+const redactedValue = "[REDACTED]"
+
+// personalDataField is the field of the personal data registered with
+// AddPersonalData, which is never formatted.
+const personalDataField = "personal_data"
+
+// personalData is the personal data seen while handling a request. It is
+// formatted as redacted by formatters other than the redacting one.
+type personalData []string
+
+func (p personalData) String() string {
+	return redactedValue
+}
+
+func (p personalData) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redactedValue + `"`), nil
+}
+
+// redactingFormatter replaces fields implementing Redacter with their
+// redacted copies, and scrubs the personal data they hold, and the personal
+// data registered with AddPersonalData, from the message, the string and the
+// error fields before formatting the entry.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+// NewRedactingFormatter wraps the formatter so that personal data is never logged.
+func NewRedactingFormatter(formatter logrus.Formatter) logrus.Formatter {
+	return &redactingFormatter{formatter}
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	var scrubbed []string
+	redacting := false
+	for _, value := range entry.Data {
+		switch v := value.(type) {
+		case personalData:
+			redacting = true
+			scrubbed = append(scrubbed, v...)
+		case Redacter:
+			redacting = true
+			if holder, ok := v.(PersonalDataHolder); ok {
+				scrubbed = append(scrubbed, holder.PersonalData()...)
+			}
+		}
+	}
+	if !redacting {
+		return f.Formatter.Format(entry)
+	}
+	scrub := newScrubber(scrubbed)
+	// entry data may be shared with the loggers it was derived from
+	redacted := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case personalData:
+			continue
+		case Redacter:
+			redacted[key] = v.Redacted()
+		case string:
+			redacted[key] = scrub(v)
+		case error:
+			redacted[key] = scrub(v.Error())
+		default:
+			redacted[key] = value
+		}
+	}
+	copied := *entry
+	copied.Data = redacted
+	copied.Message = scrub(entry.Message)
+	return f.Formatter.Format(&copied)
+}
+
+// newScrubber returns the function replacing the personal data in strings,
+// longest values first so that values containing others are fully replaced.
+func newScrubber(personalData []string) func(string) string {
+	sort.Slice(personalData, func(i, j int) bool { return len(personalData[i]) > len(personalData[j]) })
+	var pairs []string
+	for _, value := range personalData {
+		if value != "" {
+			pairs = append(pairs, value, redactedValue)
+		}
+	}
+	if len(pairs) == 0 {
+		return func(s string) string { return s }
+	}
+	return strings.NewReplacer(pairs...).Replace
+}
+
+type ctxKey int
+
+const ctxScope ctxKey = iota
+
+// scope holds the logger of a request. Fields added while handling the
+// request, e.g. once the caller is authenticated, are seen by everyone
+// holding the context, including the access log written after the handler.
+type scope struct {
+	mu    sync.Mutex
+	entry *logrus.Entry
+}
+
+// NewContext returns a copy of ctx carrying the logger.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, ctxScope, &scope{entry: entry})
+}
+
+// FromContext returns the logger carried by ctx, or the standard logger.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if s, ok := ctx.Value(ctxScope).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// AddPersonalData registers personal data seen while handling a request, e.g.
+// in the payment of its body, so that it is scrubbed from all entries of the
+// logger carried by ctx, including errors logged without the values holding
+// it. Without a logger in ctx it does nothing.
+func AddPersonalData(ctx context.Context, values ...string) {
+	if s, ok := ctx.Value(ctxScope).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		registered, _ := s.entry.Data[personalDataField].(personalData)
+		// copied, as entries derived from the logger share the registered slice
+		values = append(append(personalData(nil), registered...), values...)
+		s.entry = s.entry.WithField(personalDataField, personalData(values))
+	}
+}
+
+// AddFields adds the fields to the logger carried by ctx. Without a logger
+// in ctx it does nothing.
+func AddFields(ctx context.Context, fields logrus.Fields) {
+	if s, ok := ctx.Value(ctxScope).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.entry = s.entry.WithFields(fields)
+	}
+}
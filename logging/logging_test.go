@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigure(t *testing.T) {
+	assert := assert.New(t)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	assert.Nil(Configure(FormatJSON, "warning"))
+	if formatter, ok := logrus.StandardLogger().Formatter.(*redactingFormatter); assert.True(ok) {
+		assert.IsType(&logrus.JSONFormatter{}, formatter.Formatter)
+	}
+	assert.Equal(logrus.WarnLevel, logrus.GetLevel())
+	assert.Error(Configure("xml", "info"))
+	assert.Error(Configure(FormatText, "loud"))
+}
+
+type secret string
+
+func (s secret) Redacted() interface{} {
+	return "[REDACTED]"
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = NewRedactingFormatter(&logrus.JSONFormatter{})
+	entry := logger.WithFields(logrus.Fields{"secret": secret("s3cr3t"), "public": "visible"})
+
+	entry.Info("logged")
+
+	var logged map[string]interface{}
+	json.Unmarshal(out.Bytes(), &logged)
+	assert.Equal("[REDACTED]", logged["secret"])
+	assert.Equal("visible", logged["public"])
+	assert.Equal(secret("s3cr3t"), entry.Data["secret"], "Fields of the entry were modified")
+}
+
+// holder holds personal data quoted by errors.
+type holder struct {
+	name string
+}
+
+func (h holder) Redacted() interface{} {
+	return "[REDACTED]"
+}
+
+func (h holder) PersonalData() []string {
+	return []string{h.name}
+}
+
+func TestRedactingFormatterScrubsPersonalData(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = NewRedactingFormatter(&logrus.JSONFormatter{})
+
+	logger.WithFields(logrus.Fields{
+		"payment": holder{"Jane Doe"},
+		"error":   errors.New(`invalid name "Jane Doe"`),
+		"details": "Jane Doe",
+	}).Warnf("Rejected payment of %s", "Jane Doe")
+
+	var logged map[string]interface{}
+	json.Unmarshal(out.Bytes(), &logged)
+	assert.Equal("[REDACTED]", logged["payment"])
+	assert.Equal(`invalid name "[REDACTED]"`, logged["error"])
+	assert.Equal("[REDACTED]", logged["details"])
+	assert.Equal("Rejected payment of [REDACTED]", logged["msg"])
+	assert.NotContains(out.String(), "Jane")
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	t.Run("Fields added to the context are seen by its holders", func(t *testing.T) {
+		ctx := NewContext(context.Background(), logger.WithField("request_id", "req-1"))
+		derived, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		AddFields(derived, logrus.Fields{"payment_id": "pay-1"})
+		FromContext(ctx).Info("handled")
+
+		var entry map[string]interface{}
+		json.Unmarshal(out.Bytes(), &entry)
+		assert.Equal("req-1", entry["request_id"])
+		assert.Equal("pay-1", entry["payment_id"])
+	})
+
+	t.Run("Personal data added to the context is scrubbed from its entries", func(t *testing.T) {
+		out.Reset()
+		logger.Formatter = NewRedactingFormatter(&logrus.JSONFormatter{})
+		defer func() { logger.Formatter = &logrus.JSONFormatter{} }()
+		ctx := NewContext(context.Background(), logger.WithField("request_id", "req-1"))
+
+		AddPersonalData(ctx, "Jane")
+		AddPersonalData(ctx, "Jane Doe")
+		FromContext(ctx).WithField("error", errors.New(`invalid name "Jane Doe"`)).Warn("Rejected Jane")
+
+		var entry map[string]interface{}
+		json.Unmarshal(out.Bytes(), &entry)
+		assert.Equal(`invalid name "[REDACTED]"`, entry["error"])
+		assert.Equal("Rejected [REDACTED]", entry["msg"])
+		assert.NotContains(entry, personalDataField)
+	})
+
+	t.Run("Personal data is redacted by other formatters", func(t *testing.T) {
+		out.Reset()
+		ctx := NewContext(context.Background(), logger.WithField("request_id", "req-1"))
+
+		AddPersonalData(ctx, "Jane Doe")
+		FromContext(ctx).Info("handled")
+
+		assert.NotContains(out.String(), "Jane")
+	})
+
+	t.Run("Standard logger is used without a logger in the context", func(t *testing.T) {
+		AddFields(context.Background(), logrus.Fields{"ignored": true})
+
+		entry := FromContext(context.Background())
+
+		assert.Equal(logrus.StandardLogger(), entry.Logger)
+		assert.Empty(entry.Data)
+	})
+}
@@ -0,0 +1,165 @@
+// Package metrics implements counters, gauges and histograms exposed
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the exposition format.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// Label is a name-value pair identifying a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value of a metric family. Suffix is appended to the family
+// name, e.g. "_bucket" for histogram buckets.
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+// Family is a named group of samples of the same type.
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector is a source of metric families.
+type Collector interface {
+	Collect() []Family
+}
+
+// Registry holds collectors and exposes the metric families they collect.
+// It is safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds collectors to the registry.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Gather collects all metric families, sorted by name.
+func (r *Registry) Gather() []Family {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var families []Family
+	for _, c := range r.collectors {
+		families = append(families, c.Collect()...)
+	}
+	sort.SliceStable(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	return families
+}
+
+// WriteText writes all metric families in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	for _, family := range r.Gather() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.Name, escapeHelp(family.Help), family.Name, family.Type); err != nil {
+			return err
+		}
+		for _, sample := range family.Samples {
+			if _, err := fmt.Fprintf(w, "%s%s%s %s\n", family.Name, sample.Suffix, formatLabels(sample.Labels), formatValue(sample.Value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf(`%s="%s"`, l.Name, escapeLabelValue(l.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return valueEscaper.Replace(s)
+}
+
+// labels pairs label names with values.
+func labels(names, values []string) []Label {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(names), len(values)))
+	}
+	result := make([]Label, len(names))
+	for i := range names {
+		result[i] = Label{names[i], values[i]}
+	}
+	return result
+}
+
+// key identifies the series of given label values.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// sortedKeys returns keys of the series in a stable order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
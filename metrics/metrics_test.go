@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewRegistry()
+	counter := NewCounterVec("requests_total", "Number of requests.", "method", "status")
+	histogram := NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1}, "method")
+	registry.Register(counter, histogram, CollectorFunc(func() []Family {
+		return []Family{{Name: "queue_size", Help: "Size of the \"queue\".", Type: TypeGauge, Samples: []Sample{{Value: 3}}}}
+	}))
+
+	counter.Inc("GET", "200")
+	counter.Add(2, "GET", "200")
+	counter.Inc("POST", "400")
+	histogram.Observe(0.05, "GET")
+	histogram.Observe(0.5, "GET")
+	histogram.Observe(5, "GET")
+
+	var buf bytes.Buffer
+	assert.Nil(registry.WriteText(&buf))
+	assert.Equal(`# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="GET",le="0.1"} 1
+latency_seconds_bucket{method="GET",le="1"} 2
+latency_seconds_bucket{method="GET",le="+Inf"} 3
+latency_seconds_sum{method="GET"} 5.55
+latency_seconds_count{method="GET"} 3
+# HELP queue_size Size of the "queue".
+# TYPE queue_size gauge
+queue_size 3
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 3
+requests_total{method="POST",status="400"} 1
+`, buf.String())
+	assert.Equal(float64(3), counter.Value("GET", "200"))
+}
+
+func TestLabelEscaping(t *testing.T) {
+	counter := NewCounterVec("errors_total", "Errors.", "message")
+	counter.Inc("say \"hi\"\\\n")
+	registry := NewRegistry()
+	registry.Register(counter)
+	recorder := httptest.NewRecorder()
+
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, recorder.Body.String(), `errors_total{message="say \"hi\"\\\n"} 1`)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+}
+
+func TestLabelCardinalityMismatch(t *testing.T) {
+	counter := NewCounterVec("requests_total", "Number of requests.", "method")
+
+	assert.Panics(t, func() { counter.Inc("GET", "200") })
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	name, help string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+// NewCounterVec creates a CounterVec with the given label names.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+		series:     map[string][]string{},
+	}
+}
+
+// Inc increments the counter of the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the counter of the given label values.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	labels(c.labelNames, labelValues)
+	k := key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.series[k]; !found {
+		c.series[k] = append([]string(nil), labelValues...)
+	}
+	c.values[k] += delta
+}
+
+// Value returns the current value of the counter of the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key(labelValues)]
+}
+
+// Collect implements Collector.
+func (c *CounterVec) Collect() []Family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	family := Family{Name: c.name, Help: c.help, Type: TypeCounter}
+	for _, k := range sortedKeys(c.series) {
+		family.Samples = append(family.Samples, Sample{
+			Labels: labels(c.labelNames, c.series[k]),
+			Value:  c.values[k],
+		})
+	}
+	return []Family{family}
+}
+
+// DefaultBuckets are histogram buckets suited to HTTP request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // counts per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	name, help string
+	labelNames []string
+	buckets    []float64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+	series     map[string][]string
+}
+
+// NewHistogramVec creates a HistogramVec with the given sorted upper bounds
+// of buckets and label names.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		histograms: map[string]*histogram{},
+		series:     map[string][]string{},
+	}
+}
+
+// Observe adds an observation to the histogram of the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	labels(h.labelNames, labelValues)
+	k := key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, found := h.histograms[k]
+	if !found {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[k] = hist
+		h.series[k] = append([]string(nil), labelValues...)
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// Collect implements Collector.
+func (h *HistogramVec) Collect() []Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	family := Family{Name: h.name, Help: h.help, Type: TypeHistogram}
+	for _, k := range sortedKeys(h.series) {
+		hist := h.histograms[k]
+		base := labels(h.labelNames, h.series[k])
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			family.Samples = append(family.Samples, Sample{
+				Suffix: "_bucket",
+				Labels: append(append([]Label(nil), base...), Label{"le", formatValue(upper)}),
+				Value:  float64(cumulative),
+			})
+		}
+		family.Samples = append(family.Samples,
+			Sample{Suffix: "_bucket", Labels: append(append([]Label(nil), base...), Label{"le", "+Inf"}), Value: float64(hist.count)},
+			Sample{Suffix: "_sum", Labels: base, Value: hist.sum},
+			Sample{Suffix: "_count", Labels: base, Value: float64(hist.count)},
+		)
+	}
+	return []Family{family}
+}
+
+// CollectorFunc adapts a function to the Collector interface,
+// e.g. to gather gauges on demand.
+type CollectorFunc func() []Family
+
+// Collect implements Collector.
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
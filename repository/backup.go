@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"io"
+)
+
+// Backup writes all versions of entries committed at or after the since
+// version to w, while the repository keeps serving requests. It returns the
+// version to pass as since to the next, incremental, backup; pass 0 for a full
+// backup.
+//
+// Deletions are backed up as empty values, which the repository treats as
+// deleted payments once restored.
+func (r *PaymentsRepository) Backup(w io.Writer, since uint64) (uint64, error) {
+	version, err := r.db.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+// Restore loads a backup written by Backup. Incremental backups must be
+// restored in the order they were taken, after the full backup they are based
+// on. No other transactions may run while restoring.
+func (r *PaymentsRepository) Restore(reader io.Reader) error {
+	return r.db.Load(reader)
+}
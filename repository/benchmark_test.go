@@ -0,0 +1,107 @@
+package repository_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/cache"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/test"
+)
+
+const benchmarkPayments = 1000
+
+// benchmarkRepositories runs the benchmark against the Badger repository,
+// with and without the cache, holding benchmarkPayments payments.
+func benchmarkRepositories(b *testing.B, benchmark func(b *testing.B, repo service.PaymentsRepository, ids []string)) {
+	decorators := []struct {
+		name     string
+		decorate func(service.PaymentsRepository) service.PaymentsRepository
+	}{
+		{"badger", func(repo service.PaymentsRepository) service.PaymentsRepository { return repo }},
+		{"cached", func(repo service.PaymentsRepository) service.PaymentsRepository { return cache.New(repo) }},
+	}
+	for _, decorator := range decorators {
+		b.Run(decorator.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "paymentsapibench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			db, err := repository.Open(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			repo := decorator.decorate(repository.New(db))
+			fixture := filepath.Join("..", "testdata", "validPayment.json")
+			ids := make([]string, benchmarkPayments)
+			for ix := range ids {
+				payment := test.PaymentFromFile(b, fixture)
+				payment.ID = ""
+				if ids[ix], err = repo.Add(context.Background(), payment); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			benchmark(b, repo, ids)
+		})
+	}
+}
+
+func BenchmarkConcurrentGet(b *testing.B) {
+	benchmarkRepositories(b, func(b *testing.B, repo service.PaymentsRepository, ids []string) {
+		b.RunParallel(func(pb *testing.PB) {
+			ctx := context.Background()
+			random := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				if _, err := repo.Get(ctx, ids[random.Intn(len(ids))]); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkConcurrentService measures the service reading nine payments for
+// every one it updates, reading the updated payment before the update.
+func BenchmarkConcurrentService(b *testing.B) {
+	benchmarkRepositories(b, func(b *testing.B, repo service.PaymentsRepository, ids []string) {
+		ps := service.NewPaymentsService(repo)
+		b.RunParallel(func(pb *testing.PB) {
+			ctx := context.Background()
+			random := rand.New(rand.NewSource(rand.Int63()))
+			for ix := 0; pb.Next(); ix++ {
+				payment, err := ps.Get(ctx, ids[random.Intn(len(ids))])
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if ix%10 == 0 {
+					if err := ps.Update(ctx, payment); err != nil {
+						b.Error(err)
+					}
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkConcurrentExists(b *testing.B) {
+	benchmarkRepositories(b, func(b *testing.B, repo service.PaymentsRepository, ids []string) {
+		b.RunParallel(func(pb *testing.PB) {
+			ctx := context.Background()
+			random := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				if !repo.Exists(ctx, ids[random.Intn(len(ids))]) {
+					b.Error("payment does not exist")
+				}
+			}
+		})
+	})
+}
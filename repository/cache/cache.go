@@ -0,0 +1,223 @@
+// Package cache implements a read-through cache of payments decorating any
+// payments repository. Payments read are kept in a bounded LRU cache for a
+// limited time, and dropped from it when they are written through the cache.
+//
+// Writes made by other processes, e.g. replicas sharing a PostgreSQL database,
+// are not seen until the cached payments expire.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/metrics"
+	"github.com/mysza/paymentsapi/service"
+)
+
+// Defaults of the cache, unless configured otherwise.
+const (
+	DefaultSize = 10000       // DefaultSize is the number of payments cached
+	DefaultTTL  = time.Minute // DefaultTTL is how long payments are cached
+)
+
+// PaymentsRepository caches the payments of the decorated repository.
+// It is safe for concurrent use.
+type PaymentsRepository struct {
+	repo     service.PaymentsRepository
+	size     int
+	ttl      time.Duration
+	now      func() time.Time
+	requests *metrics.CounterVec
+
+	mu      sync.RWMutex
+	entries map[string]*list.Element // entries by payment ID, elements of lru
+	lru     *list.List               // entries, the most recently used first
+	writes  uint64                   // writes counts the writes, to detect those racing with reads
+}
+
+type entry struct {
+	payment *domain.Payment
+	expires time.Time
+}
+
+// Option configures optional behaviour of the PaymentsRepository.
+type Option func(*PaymentsRepository)
+
+// WithSize sets the maximum number of payments cached.
+func WithSize(size int) Option {
+	return func(r *PaymentsRepository) {
+		if size > 0 {
+			r.size = size
+		}
+	}
+}
+
+// WithTTL sets how long payments are cached after they are read.
+func WithTTL(ttl time.Duration) Option {
+	return func(r *PaymentsRepository) {
+		if ttl > 0 {
+			r.ttl = ttl
+		}
+	}
+}
+
+// WithMetrics registers the metrics of the cache in the registry.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(r *PaymentsRepository) {
+		registry.Register(r.requests)
+	}
+}
+
+// New creates a new cache of the payments of repo. Repositories which are
+// event stores are decorated with an event store, so that the commands of the
+// service keep appending their events to them, dropping the payments changed
+// from the cache.
+func New(repo service.PaymentsRepository, opts ...Option) service.PaymentsRepository {
+	r := &PaymentsRepository{
+		repo: repo,
+		size: DefaultSize,
+		ttl:  DefaultTTL,
+		now:  time.Now,
+		requests: metrics.NewCounterVec(
+			"payments_cache_requests_total",
+			"Number of payments looked up in the cache, by result.",
+			"result"),
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if store, ok := repo.(service.EventStore); ok {
+		return &eventStore{r, store}
+	}
+	return r
+}
+
+// lookup returns a copy of the cached payment, or nil together with the
+// number of writes so far, to be passed to store once it is read.
+func (r *PaymentsRepository) lookup(id string) (*domain.Payment, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	element, found := r.entries[id]
+	if !found {
+		r.requests.Inc("miss")
+		return nil, r.writes
+	}
+	e := element.Value.(*entry)
+	if r.now().After(e.expires) {
+		r.remove(id, element)
+		r.requests.Inc("expired")
+		return nil, r.writes
+	}
+	r.lru.MoveToFront(element)
+	r.requests.Inc("hit")
+	return e.payment.Clone(), 0
+}
+
+// store caches a copy of the payment read from the repository, unless it was
+// written since the lookup, when the payment read may already be stale.
+func (r *PaymentsRepository) store(payment *domain.Payment, writes uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if writes != r.writes {
+		return
+	}
+	e := &entry{payment: payment.Clone(), expires: r.now().Add(r.ttl)}
+	if element, found := r.entries[payment.ID]; found {
+		element.Value = e
+		r.lru.MoveToFront(element)
+		return
+	}
+	r.entries[payment.ID] = r.lru.PushFront(e)
+	for r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.remove(oldest.Value.(*entry).payment.ID, oldest)
+	}
+}
+
+// invalidate drops the payment from the cache once it was written.
+func (r *PaymentsRepository) invalidate(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes++
+	if element, found := r.entries[id]; found {
+		r.remove(id, element)
+	}
+}
+
+func (r *PaymentsRepository) remove(id string, element *list.Element) {
+	r.lru.Remove(element)
+	delete(r.entries, id)
+}
+
+// Add adds a payment to the repository.
+func (r *PaymentsRepository) Add(ctx context.Context, payment *domain.Payment) (string, error) {
+	return r.repo.Add(ctx, payment)
+}
+
+// Get returns the cached payment, or reads it from the repository and caches it.
+func (r *PaymentsRepository) Get(ctx context.Context, id string) (*domain.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	payment, writes := r.lookup(id)
+	if payment != nil {
+		return payment, nil
+	}
+	payment, err := r.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r.store(payment, writes)
+	return payment, nil
+}
+
+// GetAll reads all payments from the repository, bypassing the cache.
+func (r *PaymentsRepository) GetAll(ctx context.Context) ([]*domain.Payment, error) {
+	return r.repo.GetAll(ctx)
+}
+
+// Update updates the payment in the repository, dropping it from the cache.
+func (r *PaymentsRepository) Update(ctx context.Context, payment *domain.Payment) error {
+	defer r.invalidate(payment.ID)
+	return r.repo.Update(ctx, payment)
+}
+
+// Delete deletes the payment from the repository and the cache.
+func (r *PaymentsRepository) Delete(ctx context.Context, id string) error {
+	defer r.invalidate(id)
+	return r.repo.Delete(ctx, id)
+}
+
+// Exists checks if the payment is cached, or exists in the repository.
+func (r *PaymentsRepository) Exists(ctx context.Context, id string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	r.mu.RLock()
+	element, found := r.entries[id]
+	cached := found && !r.now().After(element.Value.(*entry).expires)
+	r.mu.RUnlock()
+	return cached || r.repo.Exists(ctx, id)
+}
+
+// eventStore is the cache of a repository which is an event store.
+type eventStore struct {
+	*PaymentsRepository
+	store service.EventStore
+}
+
+// Append appends the events to the stream of the payment, dropping it from the cache.
+func (r *eventStore) Append(ctx context.Context, id string, events []domain.Event) error {
+	defer r.invalidate(id)
+	return r.store.Append(ctx, id, events)
+}
+
+// Events returns the events of the payment from the event store.
+func (r *eventStore) Events(ctx context.Context, id string) ([]domain.Event, error) {
+	return r.store.Events(ctx, id)
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository/memory"
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/service"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (service.PaymentsRepository, func()) {
+		return New(memory.New()), func() {}
+	})
+}
+
+// countingRepository counts the payments read from the decorated repository.
+type countingRepository struct {
+	service.PaymentsRepository
+	reads int
+}
+
+func (r *countingRepository) Get(ctx context.Context, id string) (*domain.Payment, error) {
+	r.reads++
+	return r.PaymentsRepository.Get(ctx, id)
+}
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	newCache := func(opts ...Option) (*PaymentsRepository, *countingRepository) {
+		repo := &countingRepository{PaymentsRepository: memory.New()}
+		return New(repo, opts...).(*PaymentsRepository), repo
+	}
+
+	t.Run("Payments read are cached", func(t *testing.T) {
+		cache, repo := newCache()
+		id, _ := cache.Add(ctx, repositorytest.NewPayment(t))
+
+		first, _ := cache.Get(ctx, id)
+		second, err := cache.Get(ctx, id)
+
+		assert.Nil(err)
+		assert.Equal(first, second)
+		assert.Equal(1, repo.reads)
+		assert.Equal(1.0, cache.requests.Value("hit"))
+	})
+
+	t.Run("Written payments are dropped", func(t *testing.T) {
+		cache, repo := newCache()
+		payment := repositorytest.NewPayment(t)
+		id, _ := cache.Add(ctx, payment)
+		cache.Get(ctx, id)
+		payment.Attributes.Reference = "updated"
+
+		cache.Update(ctx, payment)
+		updated, _ := cache.Get(ctx, id)
+		cache.Delete(ctx, id)
+		_, deletedErr := cache.Get(ctx, id)
+
+		assert.Equal("updated", updated.Attributes.Reference)
+		assert.Error(deletedErr)
+		assert.Equal(3, repo.reads)
+	})
+
+	t.Run("Payments expire", func(t *testing.T) {
+		cache, repo := newCache(WithTTL(time.Minute))
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+		id, _ := cache.Add(ctx, repositorytest.NewPayment(t))
+		cache.Get(ctx, id)
+		now = now.Add(2 * time.Minute)
+
+		cache.Get(ctx, id)
+
+		assert.Equal(2, repo.reads)
+		assert.Equal(1.0, cache.requests.Value("expired"))
+	})
+
+	t.Run("Least recently used payments are evicted", func(t *testing.T) {
+		cache, repo := newCache(WithSize(2))
+		var ids []string
+		for ix := 0; ix < 3; ix++ {
+			id, _ := cache.Add(ctx, repositorytest.NewPayment(t))
+			ids = append(ids, id)
+		}
+		cache.Get(ctx, ids[0])
+		cache.Get(ctx, ids[1])
+		cache.Get(ctx, ids[0])
+		cache.Get(ctx, ids[2])
+
+		cache.Get(ctx, ids[0])
+		cache.Get(ctx, ids[1])
+
+		assert.Equal(4, repo.reads, "Only the least recently used payment must be read again")
+		assert.Len(cache.entries, 2)
+	})
+
+	t.Run("Payments written while reading are not cached", func(t *testing.T) {
+		cache, _ := newCache()
+		payment := repositorytest.NewPayment(t)
+		id, _ := cache.Add(ctx, payment)
+		_, writes := cache.lookup(id)
+		cache.Update(ctx, payment)
+
+		cache.store(payment, writes)
+
+		assert.Empty(cache.entries)
+	})
+
+	t.Run("Event stores are decorated with event stores", func(t *testing.T) {
+		store := &fakeEventStore{PaymentsRepository: memory.New()}
+		id, _ := store.Add(ctx, repositorytest.NewPayment(t))
+		cache := New(store)
+		cache.Get(ctx, id)
+
+		_, plainIsStore := New(memory.New()).(service.EventStore)
+		eventStore, isStore := cache.(service.EventStore)
+		eventStore.Append(ctx, id, nil)
+		stored, _ := cache.Get(ctx, id)
+
+		assert.False(plainIsStore)
+		assert.True(isStore)
+		assert.Equal("appended", stored.Attributes.Reference, "Appending must drop the payment")
+	})
+}
+
+// fakeEventStore changes the reference of payments on Append.
+type fakeEventStore struct {
+	service.PaymentsRepository
+}
+
+func (s *fakeEventStore) Append(ctx context.Context, id string, _ []domain.Event) error {
+	payment, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	payment.Attributes.Reference = "appended"
+	return s.Update(ctx, payment)
+}
+
+func (s *fakeEventStore) Events(context.Context, string) ([]domain.Event, error) {
+	return nil, nil
+}
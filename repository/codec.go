@@ -0,0 +1,427 @@
+package repository
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// Codec encodes the payments stored by the repository. Records start with the
+// marker byte of their codec, so that payments stored with different codecs
+// can be read alike, e.g. while the codec is being changed.
+type Codec interface {
+	Name() string
+	Marker() byte
+	Marshal(*domain.Payment) ([]byte, error)
+	Unmarshal([]byte) (*domain.Payment, error)
+}
+
+// Codecs of stored payments.
+var (
+	// JSONCodec stores payments as JSON, in the schema version envelope, so that
+	// its marker is the opening brace of the envelope. It is the default codec,
+	// and the one of payments stored before the codec was configurable.
+	JSONCodec Codec = jsonCodec{}
+
+	// BinaryCodec stores payments in a compact binary encoding, in the protocol
+	// buffers wire format, with integers as int64 varints: every field is tagged
+	// with its number, so that fields can be added, and unknown fields are
+	// skipped.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var codecs = []Codec{JSONCodec, BinaryCodec}
+
+// ErrUnknownCodec is returned for records with an unknown codec marker.
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// CodecByName returns the codec with the name, json or binary.
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("%v: %q", ErrUnknownCodec, name)
+}
+
+func codecByMarker(marker byte) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.Marker() == marker {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("%v: marker %#x", ErrUnknownCodec, marker)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marker() byte { return '{' }
+
+func (jsonCodec) Marshal(payment *domain.Payment) ([]byte, error) {
+	return domain.PaymentToByteSlice(payment)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (*domain.Payment, error) {
+	payment, err := domain.PaymentFromByteSlice(data)
+	if err != nil {
+		return nil, err
+	}
+	return normalise(payment), nil
+}
+
+// normalise makes the payments decoded by all codecs alike, as the binary
+// encoding cannot tell empty repeated fields from missing ones: sender
+// charges, which validation requires, are empty rather than nil, and
+// approvals, omitted from JSON when empty, are nil.
+func normalise(payment *domain.Payment) *domain.Payment {
+	if payment.Attributes.ChargesInformation.SenderCharges == nil {
+		payment.Attributes.ChargesInformation.SenderCharges = []domain.Charge{}
+	}
+	if len(payment.Approvals) == 0 {
+		payment.Approvals = nil
+	}
+	return payment
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Marker() byte { return 0x01 }
+
+// Wire types of the fields.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// The fields of the binary encoding are numbered in the order of the fields
+// of the domain structures. Numbers of removed fields must not be reused.
+
+func (binaryCodec) Marshal(p *domain.Payment) ([]byte, error) {
+	var e encoder
+	e.string(1, p.ID)
+	e.string(2, p.OrganisationID)
+	e.message(3, func(e *encoder) { encodeAttributes(e, &p.Attributes) })
+	e.string(4, p.Status)
+	e.string(5, p.CreatedBy)
+	for _, approval := range p.Approvals {
+		// times keep the offset of their zone
+		approvedAt, err := approval.ApprovedAt.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.message(6, func(e *encoder) {
+			e.string(1, approval.ApprovedBy)
+			e.bytes(2, approvedAt)
+		})
+	}
+	e.string(7, p.UpdatedBy)
+	e.varint(8, p.Version)
+	return e.buf, nil
+}
+
+func encodeAttributes(e *encoder, a *domain.PaymentAttributes) {
+	e.string(1, a.Amount)
+	e.message(2, func(e *encoder) {
+		encodeParty(e, &a.Beneficiary.PaymentParty)
+		e.varint(8, int64(a.Beneficiary.AccountType))
+	})
+	e.message(3, func(e *encoder) {
+		charges := &a.ChargesInformation
+		e.string(1, charges.BearerCode)
+		for _, charge := range charges.SenderCharges {
+			e.message(2, func(e *encoder) {
+				e.string(1, charge.Amount)
+				e.string(2, charge.Currency)
+			})
+		}
+		e.string(3, charges.ReceiverChargesAmount)
+		e.string(4, charges.ReceiverChargesCurrency)
+	})
+	e.string(4, a.Currency)
+	e.message(5, func(e *encoder) { encodeParty(e, &a.Debtor) })
+	e.string(6, a.EndToEndReference)
+	e.message(7, func(e *encoder) {
+		e.string(1, a.FX.ContractReference)
+		e.string(2, a.FX.ExchangeRate)
+		e.string(3, a.FX.OriginalAmount)
+		e.string(4, a.FX.OriginalCurrency)
+	})
+	e.string(8, a.NumericReference)
+	e.string(9, a.PaymentID)
+	e.string(10, a.PaymentPurpose)
+	e.string(11, a.PaymentScheme)
+	e.string(12, a.PaymentType)
+	e.string(13, a.ProcessingDate)
+	e.string(14, a.SchemePaymentType)
+	e.string(15, a.SchemePaymentSubType)
+	e.string(16, a.Reference)
+	e.message(17, func(e *encoder) { encodeAccount(e, &a.Sponsor) })
+}
+
+func encodeParty(e *encoder, p *domain.PaymentParty) {
+	encodeAccount(e, &p.Account)
+	e.string(4, p.AccountName)
+	e.string(5, p.AccountNumberCode)
+	e.string(6, p.Address)
+	e.string(7, p.Name)
+}
+
+func encodeAccount(e *encoder, a *domain.Account) {
+	e.string(1, a.AccountNumber)
+	e.string(2, a.BankID)
+	e.string(3, a.BankIDCode)
+}
+
+func (binaryCodec) Unmarshal(data []byte) (*domain.Payment, error) {
+	var p domain.Payment
+	err := decode(data, func(field int, value []byte) (err error) {
+		switch field {
+		case 1:
+			p.ID = string(value)
+		case 2:
+			p.OrganisationID = string(value)
+		case 3:
+			err = decodeAttributes(value, &p.Attributes)
+		case 4:
+			p.Status = string(value)
+		case 5:
+			p.CreatedBy = string(value)
+		case 6:
+			var approval domain.Approval
+			err = decode(value, func(field int, value []byte) error {
+				switch field {
+				case 1:
+					approval.ApprovedBy = string(value)
+				case 2:
+					return approval.ApprovedAt.UnmarshalBinary(value)
+				}
+				return nil
+			})
+			p.Approvals = append(p.Approvals, approval)
+		case 7:
+			p.UpdatedBy = string(value)
+		case 8:
+			p.Version = varint(value)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return normalise(&p), nil
+}
+
+func decodeAttributes(data []byte, a *domain.PaymentAttributes) error {
+	return decode(data, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			a.Amount = string(value)
+		case 2:
+			return decode(value, func(field int, value []byte) error {
+				if field == 8 {
+					a.Beneficiary.AccountType = int(varint(value))
+					return nil
+				}
+				decodeParty(field, value, &a.Beneficiary.PaymentParty)
+				return nil
+			})
+		case 3:
+			return decodeCharges(value, &a.ChargesInformation)
+		case 4:
+			a.Currency = string(value)
+		case 5:
+			return decode(value, func(field int, value []byte) error {
+				decodeParty(field, value, &a.Debtor)
+				return nil
+			})
+		case 6:
+			a.EndToEndReference = string(value)
+		case 7:
+			return decode(value, func(field int, value []byte) error {
+				switch field {
+				case 1:
+					a.FX.ContractReference = string(value)
+				case 2:
+					a.FX.ExchangeRate = string(value)
+				case 3:
+					a.FX.OriginalAmount = string(value)
+				case 4:
+					a.FX.OriginalCurrency = string(value)
+				}
+				return nil
+			})
+		case 8:
+			a.NumericReference = string(value)
+		case 9:
+			a.PaymentID = string(value)
+		case 10:
+			a.PaymentPurpose = string(value)
+		case 11:
+			a.PaymentScheme = string(value)
+		case 12:
+			a.PaymentType = string(value)
+		case 13:
+			a.ProcessingDate = string(value)
+		case 14:
+			a.SchemePaymentType = string(value)
+		case 15:
+			a.SchemePaymentSubType = string(value)
+		case 16:
+			a.Reference = string(value)
+		case 17:
+			return decode(value, func(field int, value []byte) error {
+				decodeAccount(field, value, &a.Sponsor)
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func decodeCharges(data []byte, c *domain.ChargesInformation) error {
+	return decode(data, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			c.BearerCode = string(value)
+		case 2:
+			var charge domain.Charge
+			err := decode(value, func(field int, value []byte) error {
+				switch field {
+				case 1:
+					charge.Amount = string(value)
+				case 2:
+					charge.Currency = string(value)
+				}
+				return nil
+			})
+			c.SenderCharges = append(c.SenderCharges, charge)
+			return err
+		case 3:
+			c.ReceiverChargesAmount = string(value)
+		case 4:
+			c.ReceiverChargesCurrency = string(value)
+		}
+		return nil
+	})
+}
+
+func decodeParty(field int, value []byte, p *domain.PaymentParty) {
+	switch field {
+	case 4:
+		p.AccountName = string(value)
+	case 5:
+		p.AccountNumberCode = string(value)
+	case 6:
+		p.Address = string(value)
+	case 7:
+		p.Name = string(value)
+	default:
+		decodeAccount(field, value, &p.Account)
+	}
+}
+
+func decodeAccount(field int, value []byte, a *domain.Account) {
+	switch field {
+	case 1:
+		a.AccountNumber = string(value)
+	case 2:
+		a.BankID = string(value)
+	case 3:
+		a.BankIDCode = string(value)
+	}
+}
+
+// encoder appends fields in the binary encoding to buf. Fields with zero
+// values are omitted, except for messages.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) tag(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field<<3|wire))
+}
+
+func (e *encoder) bytes(field int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+func (e *encoder) string(field int, value string) {
+	if value == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+func (e *encoder) varint(field int, value int64) {
+	if value == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	// negative values take ten bytes, as int64 fields of protocol buffers
+	e.buf = binary.AppendUvarint(e.buf, uint64(value))
+}
+
+// message encodes the fields written by fn as a nested message, even if it
+// is empty, so that empty elements of repeated fields are kept.
+func (e *encoder) message(field int, fn func(*encoder)) {
+	var nested encoder
+	fn(&nested)
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(nested.buf)))
+	e.buf = append(e.buf, nested.buf...)
+}
+
+var errTruncated = errors.New("truncated binary record")
+
+// varint decodes the value of a varint field.
+func varint(value []byte) int64 {
+	v, _ := binary.Uvarint(value)
+	return int64(v)
+}
+
+// decode calls fn with the number and the value of every field of the
+// message, in order; the value of varint fields is the encoded varint.
+func decode(data []byte, fn func(field int, value []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		var value []byte
+		switch tag & 7 {
+		case wireVarint:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			value, data = data[:n], data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			value, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("unknown wire type %d in binary record", tag&7)
+		}
+		if err := fn(int(tag>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func codecPayment(t testing.TB) *domain.Payment {
+	payment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	payment.Status = domain.StatusAccepted
+	payment.CreatedBy = "creator"
+	payment.Attributes.Beneficiary.AccountType = -1
+	zone := time.FixedZone("CET", 3600)
+	payment.Approvals = []domain.Approval{
+		{ApprovedBy: "first", ApprovedAt: time.Date(2018, 6, 1, 12, 30, 0, 500, zone)},
+		{ApprovedBy: "second", ApprovedAt: time.Date(2018, 6, 2, 8, 0, 0, 0, time.UTC)},
+	}
+	return payment
+}
+
+// fillFields sets every exported field of the value to a distinct non-zero
+// value, so that fields a codec misses fail the round trip.
+func fillFields(t *testing.T, value reflect.Value, counter *int) {
+	*counter++
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(fmt.Sprintf("value %d", *counter))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value.SetInt(int64(*counter))
+	case reflect.Slice:
+		value.Set(reflect.MakeSlice(value.Type(), 2, 2))
+		for ix := 0; ix < value.Len(); ix++ {
+			fillFields(t, value.Index(ix), counter)
+		}
+	case reflect.Struct:
+		if value.Type() == reflect.TypeOf(time.Time{}) {
+			value.Set(reflect.ValueOf(time.Date(2018, 6, 4, 12, 0, *counter, *counter, time.UTC)))
+			return
+		}
+		for ix := 0; ix < value.NumField(); ix++ {
+			if value.Type().Field(ix).PkgPath == "" {
+				fillFields(t, value.Field(ix), counter)
+			}
+		}
+	default:
+		t.Fatalf("Cannot fill fields of kind %v of type %v", value.Kind(), value.Type())
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	t.Run("Codecs round trip payments", func(t *testing.T) {
+		for _, codec := range codecs {
+			payment := codecPayment(t)
+
+			data, marshalErr := codec.Marshal(payment)
+			decoded, unmarshalErr := codec.Unmarshal(data)
+
+			assert.Nil(marshalErr, codec.Name())
+			assert.Nil(unmarshalErr, codec.Name())
+			assert.Equal(payment.Attributes, decoded.Attributes, codec.Name())
+			for ix, approval := range payment.Approvals {
+				// times keep their offset, if not the name of their zone
+				assert.Equal(approval.ApprovedAt.Format(time.RFC3339Nano), decoded.Approvals[ix].ApprovedAt.Format(time.RFC3339Nano), codec.Name())
+			}
+			payment.Approvals, decoded.Approvals = nil, nil
+			assert.Equal(payment, decoded, codec.Name())
+		}
+	})
+
+	t.Run("Codecs round trip every field of payments", func(t *testing.T) {
+		for _, codec := range codecs {
+			var payment domain.Payment
+			fillFields(t, reflect.ValueOf(&payment).Elem(), new(int))
+
+			data, marshalErr := codec.Marshal(&payment)
+			decoded, unmarshalErr := codec.Unmarshal(data)
+
+			assert.Nil(marshalErr, codec.Name())
+			if assert.Nil(unmarshalErr, codec.Name()) {
+				assert.Equal(&payment, decoded, codec.Name())
+			}
+		}
+	})
+
+	t.Run("Codecs decode empty repeated fields alike", func(t *testing.T) {
+		for _, codec := range codecs {
+			payment := codecPayment(t)
+			payment.Attributes.ChargesInformation.SenderCharges = []domain.Charge{}
+			payment.Approvals = []domain.Approval{}
+
+			data, _ := codec.Marshal(payment)
+			decoded, err := codec.Unmarshal(data)
+
+			if assert.Nil(err, codec.Name()) {
+				assert.Equal([]domain.Charge{}, decoded.Attributes.ChargesInformation.SenderCharges, codec.Name())
+				assert.Nil(decoded.Approvals, codec.Name())
+			}
+		}
+	})
+
+	t.Run("Binary codec encodes integers as protocol buffers int64 varints", func(t *testing.T) {
+		var e encoder
+		e.varint(1, 150)
+		e.varint(2, -1)
+
+		var decoded []int64
+		err := decode(e.buf, func(_ int, value []byte) error {
+			decoded = append(decoded, varint(value))
+			return nil
+		})
+
+		// the example of the encoding documentation, and ten bytes for -1
+		assert.Equal([]byte{0x08, 0x96, 0x01}, e.buf[:3])
+		assert.Len(e.buf, 3+1+10)
+		assert.Nil(err)
+		assert.Equal([]int64{150, -1}, decoded)
+	})
+
+	t.Run("Binary codec is compact", func(t *testing.T) {
+		payment := codecPayment(t)
+
+		binary, _ := BinaryCodec.Marshal(payment)
+		json, _ := JSONCodec.Marshal(payment)
+
+		assert.True(len(binary) < len(json)/2, "binary %d, json %d bytes", len(binary), len(json))
+	})
+
+	t.Run("Binary codec skips unknown fields and rejects truncated records", func(t *testing.T) {
+		data, _ := BinaryCodec.Marshal(codecPayment(t))
+		var e encoder
+		e.varint(99, 42)
+		e.string(100, "added later")
+
+		decoded, unknownErr := BinaryCodec.Unmarshal(append(data, e.buf...))
+		_, truncatedErr := BinaryCodec.Unmarshal(data[:len(data)-1])
+
+		assert.Nil(unknownErr)
+		assert.Equal("creator", decoded.CreatedBy)
+		assert.Equal(errTruncated, truncatedErr)
+	})
+
+	t.Run("Codecs are named", func(t *testing.T) {
+		binary, binaryErr := CodecByName("binary")
+		_, unknownErr := CodecByName("xml")
+		_, _, _, markerErr := unwrap([]byte{0x7f})
+
+		assert.Nil(binaryErr)
+		assert.Equal(BinaryCodec, binary)
+		assert.Contains(unknownErr.Error(), ErrUnknownCodec.Error())
+		assert.Contains(markerErr.Error(), ErrUnknownCodec.Error())
+	})
+
+	t.Run("Payments stored with different codecs coexist", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		jsonRepo := New(db)
+		binaryRepo := New(db, WithCodec(BinaryCodec))
+		payment := codecPayment(t)
+		payment.ID = ""
+		jsonID, _ := jsonRepo.Add(ctx, payment)
+		binaryID, _ := binaryRepo.Add(ctx, payment)
+
+		fromJSON, jsonErr := binaryRepo.Get(ctx, jsonID)
+		fromBinary, binaryErr := jsonRepo.Get(ctx, binaryID)
+		versions, _ := binaryRepo.SchemaVersions(ctx)
+		count, migrateErr := binaryRepo.Migrate(ctx)
+		var markers []byte
+		db.View(func(txn *badger.Txn) error {
+			for _, id := range []string{jsonID, binaryID} {
+				item, _ := txn.Get([]byte(id))
+				value, _ := item.Value()
+				markers = append(markers, value[0])
+			}
+			return nil
+		})
+		migrated, _ := jsonRepo.Get(ctx, jsonID)
+
+		assert.Nil(jsonErr)
+		assert.Nil(binaryErr)
+		assert.Equal(payment.Attributes, fromJSON.Attributes)
+		assert.Equal(payment.Attributes, fromBinary.Attributes)
+		assert.Equal(map[int]int{binaryRepo.SchemaVersion(): 2}, versions)
+		assert.Nil(migrateErr)
+		assert.Equal(1, count, "Only the JSON payment must be migrated")
+		assert.Equal([]byte{BinaryCodec.Marker(), BinaryCodec.Marker()}, markers)
+		assert.Equal(payment.Attributes, migrated.Attributes)
+	})
+
+	t.Run("Binary payments of older schema versions are upgraded", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		previous := New(db, WithCodec(BinaryCodec))
+		payment := codecPayment(t)
+		payment.ID = ""
+		id, _ := previous.Add(ctx, payment)
+		repo := New(db, WithCodec(BinaryCodec))
+		repo.migrations = append(repo.Migrations(), Migration{
+			Version:     previous.SchemaVersion() + 1,
+			Description: "set status",
+			Up: func(payment map[string]interface{}) error {
+				payment["status"] = "migrated"
+				return nil
+			},
+		})
+
+		read, err := repo.Get(ctx, id)
+
+		assert.Nil(err)
+		assert.Equal("migrated", read.Status)
+		assert.Equal(payment.Attributes, read.Attributes)
+	})
+}
+
+// BenchmarkCodecs measures the throughput of the codecs encoding and decoding
+// stored payments, and their size, in the record and on disk.
+func BenchmarkCodecs(b *testing.B) {
+	ctx := context.Background()
+	for _, codec := range codecs {
+		repo := New(nil, WithCodec(codec))
+		payment := codecPayment(b)
+		record, err := repo.encode(payment)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(codec.Name()+"/encode", func(b *testing.B) {
+			b.SetBytes(int64(len(record)))
+			b.ReportAllocs()
+			for ix := 0; ix < b.N; ix++ {
+				if _, err := repo.encode(payment); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(record)), "bytes/record")
+		})
+		b.Run(codec.Name()+"/decode", func(b *testing.B) {
+			b.SetBytes(int64(len(record)))
+			b.ReportAllocs()
+			for ix := 0; ix < b.N; ix++ {
+				if _, err := repo.decode(record); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(codec.Name()+"/store", func(b *testing.B) {
+			db, dir := createDB()
+			defer os.RemoveAll(dir)
+			repo := New(db, WithCodec(codec))
+			b.ReportAllocs()
+			for ix := 0; ix < b.N; ix++ {
+				payment.ID = ""
+				if _, err := repo.Add(ctx, payment); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			db.Close()
+			b.ReportMetric(float64(diskSize(b, dir))/float64(b.N), "disk-bytes/record")
+		})
+	}
+}
+
+// diskSize returns the size of the files of the database in the directory.
+func diskSize(b *testing.B, dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return size
+}
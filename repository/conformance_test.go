@@ -0,0 +1,33 @@
+package repository_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/service"
+)
+
+func TestConformance(t *testing.T) {
+	for _, codec := range []repository.Codec{repository.JSONCodec, repository.BinaryCodec} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			repositorytest.Run(t, func(t *testing.T) (service.PaymentsRepository, func()) {
+				dir, err := ioutil.TempDir("", "paymentsapibadger")
+				if err != nil {
+					t.Fatal(err)
+				}
+				db, err := repository.Open(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return repository.New(db, repository.WithCodec(codec)), func() {
+					db.Close()
+					os.RemoveAll(dir)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+// Reencrypt encrypts payments stored in clear text or with a master key other
+// than the active one with a new data key wrapped with the active master key.
+// It returns the number of payments re-encrypted, and can be run while the
+// repository serves requests.
+func (r *PaymentsRepository) Reencrypt(ctx context.Context) (int, error) {
+	if r.encrypter == nil {
+		return 0, errors.New("encryption is not configured")
+	}
+	var ids [][]byte
+	err := r.scan(ctx, "reencrypt_scan", func(id, value []byte) error {
+		payment, err := r.unmarshal(value)
+		if err != nil {
+			return err
+		}
+		if r.encrypter.NeedsRotation(payment) {
+			ids = append(ids, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return r.rewrite(ctx, "reencrypt", ids, func(value []byte) ([]byte, error) {
+		payment, err := r.decode(value)
+		if err != nil {
+			return nil, err
+		}
+		return r.encode(payment)
+	})
+}
@@ -0,0 +1,424 @@
+// Package eventstore implements a payments repository storing every payment
+// as a stream of domain events in the Badger database, rather than as its
+// latest state. The state is rebuilt by applying the events in order, starting
+// with the latest snapshot of the stream, taken every few events.
+//
+// Streams are never removed, so the history of payments is kept after they
+// are deleted, and can be audited or replayed. As events carry personal data
+// in clear text, which could never be erased, the store does not support
+// encryption at rest.
+package eventstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/tracing"
+)
+
+// The streams are stored under the keys:
+//
+//	head/<id>                  - the version of the last event of the stream
+//	event/<id>/<version>       - the events, with big-endian versions ordering the keys
+//	snapshot/<id>              - the latest snapshot of the payment
+const (
+	headPrefix     = "head/"
+	eventPrefix    = "event/"
+	snapshotPrefix = "snapshot/"
+)
+
+// DefaultSnapshotInterval is the number of events after which the state of
+// a payment is snapshotted, unless configured otherwise.
+const DefaultSnapshotInterval = 20
+
+const (
+	// conflictRetries is how many times a transaction is retried
+	// after conflicting with a concurrent one
+	conflictRetries = 3
+	conflictBackoff = 10 * time.Millisecond
+)
+
+// snapshot is the state of the payment after the event of the version,
+// nil if it was deleted.
+type snapshot struct {
+	Version int             `json:"version"`
+	Payment *domain.Payment `json:"payment"`
+}
+
+// PaymentsRepository provides access to the streams of payment events in the Badger database.
+type PaymentsRepository struct {
+	db               *badger.DB
+	snapshotInterval int
+	now              func() time.Time
+}
+
+// Option configures optional behaviour of the PaymentsRepository.
+type Option func(*PaymentsRepository)
+
+// WithSnapshotInterval sets the number of events after which the state of a
+// payment is snapshotted. Frequent snapshots make reads faster at the cost of
+// space.
+func WithSnapshotInterval(events int) Option {
+	return func(r *PaymentsRepository) {
+		if events > 0 {
+			r.snapshotInterval = events
+		}
+	}
+}
+
+// New creates a new repository using the Badger database opened with repository.Open.
+func New(db *badger.DB, opts ...Option) *PaymentsRepository {
+	r := &PaymentsRepository{db: db, snapshotInterval: DefaultSnapshotInterval, now: time.Now}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func headKey(id string) []byte {
+	return []byte(headPrefix + id)
+}
+
+func snapshotKey(id string) []byte {
+	return []byte(snapshotPrefix + id)
+}
+
+func streamPrefix(id string) []byte {
+	return []byte(eventPrefix + id + "/")
+}
+
+func eventKey(id string, version int) []byte {
+	key := streamPrefix(id)
+	return append(key, encodeVersion(version)...)
+}
+
+func encodeVersion(version int) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, uint64(version))
+	return encoded
+}
+
+// view runs fn in a read-only transaction traced as a span named after the operation.
+func (r *PaymentsRepository) view(ctx context.Context, operation string, fn func(*badger.Txn) error) error {
+	_, span := startSpan(ctx, "badger.View "+operation, operation)
+	defer span.End()
+	if err := ctx.Err(); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	err := r.db.View(fn)
+	if err != repository.ErrNotFound {
+		tracing.RecordError(span, err)
+	}
+	return err
+}
+
+// update runs fn in a read-write transaction traced as a span named after the operation.
+// Transactions conflicting with concurrent ones are retried until ctx is done.
+func (r *PaymentsRepository) update(ctx context.Context, operation string, fn func(*badger.Txn) error) (err error) {
+	_, span := startSpan(ctx, "badger.Update "+operation, operation)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err = r.db.Update(fn)
+		if err != badger.ErrConflict || attempt == conflictRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(conflictBackoff << uint(attempt)):
+		}
+	}
+}
+
+func startSpan(ctx context.Context, name, operation string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name, trace.WithAttributes(
+		attribute.String("db.system", "badger"),
+		attribute.String("db.operation", operation),
+	))
+}
+
+// load returns the current state of the payment, nil if it does not exist,
+// together with the version of its stream and of its latest snapshot.
+func (r *PaymentsRepository) load(txn *badger.Txn, id string) (payment *domain.Payment, version, snapshotVersion int, err error) {
+	item, err := txn.Get(headKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	head, err := item.Value()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	version = int(binary.BigEndian.Uint64(head))
+	var s snapshot
+	item, err = txn.Get(snapshotKey(id))
+	switch err {
+	case nil:
+		value, err := item.Value()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if err := json.Unmarshal(value, &s); err != nil {
+			return nil, 0, 0, err
+		}
+	case badger.ErrKeyNotFound:
+	default:
+		return nil, 0, 0, err
+	}
+	events, err := readEvents(txn, id, s.Version+1)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	payment = domain.Replay(s.Payment, events)
+	if payment != nil {
+		payment.Version = int64(version)
+	}
+	return payment, version, s.Version, nil
+}
+
+// readEvents returns the events of the stream of the payment starting with the version.
+func readEvents(txn *badger.Txn, id string, from int) ([]domain.Event, error) {
+	prefix := streamPrefix(id)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	var events []domain.Event
+	for it.Seek(eventKey(id, from)); it.ValidForPrefix(prefix); it.Next() {
+		value, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+		var event domain.Event
+		if err := json.Unmarshal(value, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// appendEvents appends the events to the stream of the payment, snapshotting
+// its state once snapshotInterval events were appended since the last
+// snapshot. The events must follow the stream: payments which do not exist
+// can only be created, and those which do cannot be created again; events
+// with versions must have the next ones. Otherwise domain.ErrVersionConflict
+// is returned. It returns the version of the last event.
+func (r *PaymentsRepository) appendEvents(ctx context.Context, txn *badger.Txn, id string, events []domain.Event) (int, error) {
+	payment, version, snapshotVersion, err := r.load(txn, id)
+	if err != nil || len(events) == 0 {
+		return version, err
+	}
+	actor := ""
+	if principal, ok := auth.FromContext(ctx); ok {
+		actor = principal.Subject
+	}
+	now := r.now().UTC()
+	for _, event := range events {
+		version++
+		if event.Version != 0 && event.Version != version {
+			return 0, domain.ErrVersionConflict
+		}
+		if (payment == nil) != (event.Type == domain.EventPaymentCreated) {
+			return 0, domain.ErrVersionConflict
+		}
+		event.PaymentID = id
+		event.Version = version
+		event.OccurredAt = now
+		event.Actor = actor
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+		if err := txn.Set(eventKey(id, version), encoded); err != nil {
+			return 0, err
+		}
+		payment = domain.Replay(payment, []domain.Event{event})
+	}
+	if err := txn.Set(headKey(id), encodeVersion(version)); err != nil {
+		return 0, err
+	}
+	if version-snapshotVersion < r.snapshotInterval {
+		return version, nil
+	}
+	encoded, err := json.Marshal(snapshot{Version: version, Payment: payment})
+	if err != nil {
+		return 0, err
+	}
+	return version, txn.Set(snapshotKey(id), encoded)
+}
+
+// Append appends the events to the stream of the payment with given ID,
+// setting their versions, the time they occurred, and the subject of the
+// principal in ctx as their actor. Events with versions set are only
+// appended if they are the next ones of the stream, so that events of commands
+// on a payment read before are not appended after concurrent changes.
+// It returns domain.ErrVersionConflict for events which do not follow the stream.
+func (r *PaymentsRepository) Append(ctx context.Context, id string, events []domain.Event) error {
+	return r.update(ctx, "append", func(txn *badger.Txn) error {
+		_, err := r.appendEvents(ctx, txn, id, events)
+		return err
+	})
+}
+
+// Events returns the events of the payment with given ID in order, including
+// those of deleted payments.
+func (r *PaymentsRepository) Events(ctx context.Context, id string) ([]domain.Event, error) {
+	var events []domain.Event
+	err := r.view(ctx, "events", func(txn *badger.Txn) (err error) {
+		events, err = readEvents(txn, id, 1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Add adds a payment, appending the PaymentCreated event to its new stream.
+func (r *PaymentsRepository) Add(ctx context.Context, payment *domain.Payment) (string, error) {
+	payment.ID = uuid.New().String()
+	payment.Version = 1
+	err := r.Append(ctx, payment.ID, []domain.Event{{Type: domain.EventPaymentCreated, Version: 1, Payment: payment}})
+	if err != nil {
+		return "", err
+	}
+	return payment.ID, nil
+}
+
+// Get rebuilds a single payment from its stream.
+// It returns repository.ErrNotFound if the payment does not exist.
+func (r *PaymentsRepository) Get(ctx context.Context, id string) (*domain.Payment, error) {
+	var payment *domain.Payment
+	err := r.view(ctx, "get", func(txn *badger.Txn) (err error) {
+		payment, _, _, err = r.load(txn, id)
+		if err == nil && payment == nil {
+			return repository.ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// GetAll rebuilds all payments from their streams, ordered by their IDs.
+func (r *PaymentsRepository) GetAll(ctx context.Context) ([]*domain.Payment, error) {
+	var payments []*domain.Payment
+	err := r.view(ctx, "get_all", func(txn *badger.Txn) error {
+		// the iterator must be closed before loading, which iterates the streams
+		for _, id := range streamIDs(txn) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			payment, _, _, err := r.load(txn, id)
+			if err != nil {
+				return err
+			}
+			if payment != nil {
+				payments = append(payments, payment)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// streamIDs returns the IDs of the payments with streams, ordered.
+func streamIDs(txn *badger.Txn) []string {
+	it := txn.NewIterator(badger.IteratorOptions{})
+	defer it.Close()
+	prefix := []byte(headPrefix)
+	var ids []string
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		ids = append(ids, string(bytes.TrimPrefix(it.Item().Key(), prefix)))
+	}
+	return ids
+}
+
+// Update appends the PaymentAmended event carrying the payment to its stream,
+// if the version of the payment is the one of the stream, and sets it to the
+// version of the event. The events of the commands of the service are
+// appended by it instead. It returns repository.ErrNotFound if the payment
+// does not exist, e.g. was deleted concurrently, and domain.ErrVersionConflict
+// if it was changed since it was read.
+func (r *PaymentsRepository) Update(ctx context.Context, payment *domain.Payment) error {
+	var version int
+	err := r.update(ctx, "update", func(txn *badger.Txn) error {
+		stored, _, _, err := r.load(txn, payment.ID)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return repository.ErrNotFound
+		}
+		amended := domain.Event{Type: domain.EventPaymentAmended, Version: int(payment.Version) + 1, Payment: payment}
+		version, err = r.appendEvents(ctx, txn, payment.ID, []domain.Event{amended})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	payment.Version = int64(version)
+	return nil
+}
+
+// Delete appends the PaymentDeleted event to the stream of the payment,
+// unless it does not exist.
+func (r *PaymentsRepository) Delete(ctx context.Context, id string) error {
+	return r.update(ctx, "delete", func(txn *badger.Txn) error {
+		stored, _, _, err := r.load(txn, id)
+		if err != nil || stored == nil {
+			return err
+		}
+		_, err = r.appendEvents(ctx, txn, id, []domain.Event{{Type: domain.EventPaymentDeleted}})
+		return err
+	})
+}
+
+// Exists is a helper function to check if payment with give ID exists.
+func (r *PaymentsRepository) Exists(ctx context.Context, id string) bool {
+	payment, _ := r.Get(ctx, id)
+	return payment != nil
+}
+
+// Backup writes all versions of entries committed at or after the since
+// version to w, while the repository keeps serving requests. It returns the
+// version to pass as since to the next, incremental, backup; pass 0 for a full
+// backup.
+func (r *PaymentsRepository) Backup(w io.Writer, since uint64) (uint64, error) {
+	version, err := r.db.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+// Restore loads a backup written by Backup. No other transactions may run
+// while restoring.
+func (r *PaymentsRepository) Restore(reader io.Reader) error {
+	return r.db.Load(reader)
+}
@@ -0,0 +1,169 @@
+package eventstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/service"
+)
+
+func openTestRepository(t *testing.T, opts ...Option) (*PaymentsRepository, func()) {
+	dir, err := ioutil.TempDir("", "paymentsapievents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := repository.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(db, opts...), func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (service.PaymentsRepository, func()) {
+		return openTestRepository(t)
+	})
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "clerk"})
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("Commands of the service are recorded as events", func(t *testing.T) {
+		repo, cleanup := openTestRepository(t)
+		defer cleanup()
+		repo.now = func() time.Time { return now }
+		ps := service.NewPaymentsService(repo, service.WithApprovals(service.ApprovalConfig{Thresholds: map[string]string{"GBP": "0"}}))
+		payment := repositorytest.NewPayment(t)
+		clerk := auth.NewContext(context.Background(), &auth.Principal{Subject: "clerk", OrganisationID: payment.OrganisationID})
+		approver := auth.NewContext(context.Background(), &auth.Principal{Subject: "approver", OrganisationID: payment.OrganisationID})
+		id, addErr := ps.Add(clerk, payment)
+		payment.Attributes.Amount = "250.00"
+		payment.Attributes.Beneficiary.Name = "New Beneficiary"
+		updateErr := ps.Update(clerk, payment)
+		approved, approveErr := ps.Approve(approver, id)
+		deleteErr := ps.Delete(clerk, id)
+
+		events, err := repo.Events(ctx, id)
+
+		assert.Nil(addErr)
+		assert.Nil(updateErr)
+		assert.Nil(approveErr)
+		assert.Nil(deleteErr)
+		assert.Nil(err)
+		var types []string
+		for ix, event := range events {
+			types = append(types, event.Type)
+			assert.Equal(ix+1, event.Version)
+			assert.Equal(id, event.PaymentID)
+			assert.Equal(now, event.OccurredAt)
+		}
+		assert.Equal([]string{
+			domain.EventPaymentCreated,
+			domain.EventBeneficiaryChanged,
+			domain.EventAmountAmended,
+			domain.EventPaymentAmended,
+			domain.EventPaymentApproved,
+			domain.EventPaymentDeleted,
+		}, types)
+		assert.Equal("New Beneficiary", events[1].Beneficiary.Name)
+		assert.Equal("250.00", events[2].Amount)
+		assert.Equal("approver", events[4].Actor)
+		assert.Equal("approver", events[4].Approval.ApprovedBy)
+		assert.Equal(domain.StatusAccepted, events[4].Status)
+		assert.Equal(int64(5), approved.Version)
+		assert.Equal("clerk", events[5].Actor)
+		assert.False(repo.Exists(ctx, id), "Deleted payments must not exist")
+	})
+
+	t.Run("Updates are recorded as amendments of stored payments", func(t *testing.T) {
+		repo, cleanup := openTestRepository(t)
+		defer cleanup()
+		payment := repositorytest.NewPayment(t)
+		id, _ := repo.Add(ctx, payment)
+		stale, _ := repo.Get(ctx, id)
+		payment.Attributes.Reference = "amended"
+
+		err := repo.Update(ctx, payment)
+		staleErr := repo.Update(ctx, stale)
+		events, _ := repo.Events(ctx, id)
+
+		assert.Nil(err)
+		assert.Equal(int64(2), payment.Version)
+		assert.Equal(domain.ErrVersionConflict, staleErr, "Payments changed since read must not be overwritten")
+		assert.Len(events, 2)
+		assert.Equal(domain.EventPaymentAmended, events[1].Type)
+	})
+
+	t.Run("Payments are rebuilt from snapshots", func(t *testing.T) {
+		repo, cleanup := openTestRepository(t, WithSnapshotInterval(3))
+		defer cleanup()
+		payment := repositorytest.NewPayment(t)
+		id, _ := repo.Add(ctx, payment)
+		for _, amount := range []string{"1.00", "2.00", "3.00", "4.00"} {
+			payment.Attributes.Amount = amount
+			repo.Update(ctx, payment)
+		}
+
+		var snapshotVersion, version int
+		repo.db.View(func(txn *badger.Txn) (err error) {
+			_, version, snapshotVersion, err = repo.load(txn, id)
+			return err
+		})
+		stored, err := repo.Get(ctx, id)
+
+		assert.Nil(err)
+		assert.Equal(5, version)
+		assert.Equal(3, snapshotVersion)
+		assert.Equal(payment, stored)
+	})
+
+	t.Run("Events must follow the stream", func(t *testing.T) {
+		repo, cleanup := openTestRepository(t)
+		defer cleanup()
+		payment := repositorytest.NewPayment(t)
+		id, _ := repo.Add(ctx, payment)
+		amended := *payment
+		amended.Attributes.Reference = "amended"
+
+		staleErr := repo.Append(ctx, id, []domain.Event{{Type: domain.EventAmountAmended, Version: 1, Amount: "1.00"}})
+		nextErr := repo.Append(ctx, id, []domain.Event{{Type: domain.EventAmountAmended, Version: 2, Amount: "2.00"}})
+		createdErr := repo.Append(ctx, id, []domain.Event{{Type: domain.EventPaymentCreated, Payment: payment}})
+		repo.Delete(ctx, id)
+		resurrectErr := repo.Append(ctx, id, []domain.Event{{Type: domain.EventPaymentAmended, Payment: &amended}})
+		updateErr := repo.Update(ctx, &amended)
+		events, _ := repo.Events(ctx, id)
+
+		assert.Equal(domain.ErrVersionConflict, staleErr)
+		assert.Nil(nextErr)
+		assert.Equal(domain.ErrVersionConflict, createdErr)
+		assert.Equal(domain.ErrVersionConflict, resurrectErr)
+		assert.Equal(repository.ErrNotFound, updateErr)
+		assert.Len(events, 3)
+		assert.False(repo.Exists(ctx, id), "Deleted payments must stay deleted")
+	})
+
+	t.Run("Events of missing payments are empty", func(t *testing.T) {
+		repo, cleanup := openTestRepository(t)
+		defer cleanup()
+
+		events, err := repo.Events(ctx, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+
+		assert.Nil(err)
+		assert.Empty(events)
+	})
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/mysza/paymentsapi/health"
+)
+
+// healthKey is written by the writability check. It is an internal key,
+// so it is never returned as a payment.
+var healthKey = []byte(internalKeyPrefix + "health")
+
+// WritableCheck returns a check failing unless the database accepts writes.
+func WritableCheck(db *badger.DB) health.Check {
+	return func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		now, _ := time.Now().UTC().MarshalBinary()
+		return db.Update(func(txn *badger.Txn) error {
+			return txn.Set(healthKey, now)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// DefaultDiscardRatio is the fraction of a value log file which must be
+// stale for the garbage collection to rewrite it.
+const DefaultDiscardRatio = 0.5
+
+// Stats describes the size and the shape of the Badger database.
+type Stats struct {
+	Keys           int   // number of keys, including internal ones
+	LSMSize        int64 // size of the LSM tree files in bytes
+	VLogSize       int64 // size of the value log files in bytes
+	TablesPerLevel []int // number of tables on every level of the LSM tree, starting with level 0
+}
+
+// GetStats gathers the statistics of the database. Sizes are refreshed by
+// Badger periodically, and may be up to a minute old.
+func GetStats(db *badger.DB) Stats {
+	stats := tableStats(db)
+	stats.Keys = countKeys(db)
+	return stats
+}
+
+// tableStats gathers the statistics of the database other than the number of
+// keys, which takes iterating all of them.
+func tableStats(db *badger.DB) Stats {
+	stats := Stats{TablesPerLevel: []int{0}}
+	stats.LSMSize, stats.VLogSize = db.Size()
+	for _, table := range db.Tables() {
+		for len(stats.TablesPerLevel) <= table.Level {
+			stats.TablesPerLevel = append(stats.TablesPerLevel, 0)
+		}
+		stats.TablesPerLevel[table.Level]++
+	}
+	return stats
+}
+
+// RunGC rewrites value log files in which at least discardRatio of the space
+// is taken by stale values, until there are none left. It returns the number
+// of files rewritten.
+func RunGC(db *badger.DB, discardRatio float64) (int, error) {
+	rewritten := 0
+	for {
+		err := db.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite {
+			return rewritten, nil
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+}
+
+// RunPeriodicGC runs the value log garbage collection every interval
+// until ctx is cancelled.
+func RunPeriodicGC(ctx context.Context, db *badger.DB, interval time.Duration, discardRatio float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		rewritten, err := RunGC(db, discardRatio)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"location": "repository/maintenance/RunPeriodicGC",
+				"details":  "RunGC",
+				"error":    err,
+			}).Error("Value log garbage collection failed")
+			continue
+		}
+		if rewritten > 0 {
+			logrus.WithField("location", "repository/maintenance/RunPeriodicGC").Infof("Value log garbage collection rewrote %d files", rewritten)
+		}
+	}
+}
+
+// InvalidRecord is a stored payment which cannot be decoded or does not pass
+// the validation.
+type InvalidRecord struct {
+	ID  string
+	Err error
+}
+
+// Verify decodes every stored payment and checks it with validate,
+// returning the records which failed.
+func (r *PaymentsRepository) Verify(ctx context.Context, validate func(*domain.Payment) error) ([]InvalidRecord, error) {
+	var invalid []InvalidRecord
+	err := r.scan(ctx, "verify", func(key, value []byte) error {
+		id := string(key)
+		payment, err := r.decode(value)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("decoding: %v", err)
+		case payment.ID != id:
+			err = fmt.Errorf("stored with ID %s", payment.ID)
+		default:
+			err = validate(payment)
+		}
+		if err != nil {
+			invalid = append(invalid, InvalidRecord{id, err})
+		}
+		return nil
+	})
+	return invalid, err
+}
@@ -0,0 +1,145 @@
+// Package memory implements a payments repository keeping the payments in
+// memory, e.g. for tests and demos. Payments are lost when the process exits.
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository"
+)
+
+// PaymentsRepository keeps payments in memory. It is safe for concurrent use.
+type PaymentsRepository struct {
+	mu       sync.RWMutex
+	payments map[string][]byte // encoded, so that callers never share memory with stored payments
+}
+
+// New creates an empty repository.
+func New() *PaymentsRepository {
+	return &PaymentsRepository{payments: map[string][]byte{}}
+}
+
+func (r *PaymentsRepository) set(ctx context.Context, payment *domain.Payment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	encoded, err := domain.PaymentToByteSlice(payment)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payments[payment.ID] = encoded
+	return nil
+}
+
+// Add adds a payment, setting its ID to a new UUID.
+func (r *PaymentsRepository) Add(ctx context.Context, payment *domain.Payment) (string, error) {
+	payment.ID = uuid.New().String()
+	payment.Version = 1
+	if err := r.set(ctx, payment); err != nil {
+		return "", err
+	}
+	return payment.ID, nil
+}
+
+// Get retrieves single payment.
+// It returns repository.ErrNotFound if the payment does not exist.
+func (r *PaymentsRepository) Get(ctx context.Context, id string) (*domain.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	encoded, found := r.payments[id]
+	r.mu.RUnlock()
+	if !found {
+		return nil, repository.ErrNotFound
+	}
+	return domain.PaymentFromByteSlice(encoded)
+}
+
+// GetAll retrieves all payments, ordered by their IDs.
+func (r *PaymentsRepository) GetAll(ctx context.Context) ([]*domain.Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	ids := make([]string, 0, len(r.payments))
+	for id := range r.payments {
+		ids = append(ids, id)
+	}
+	encoded := make([][]byte, len(ids))
+	sort.Strings(ids)
+	for ix, id := range ids {
+		encoded[ix] = r.payments[id]
+	}
+	r.mu.RUnlock()
+	var payments []*domain.Payment
+	for _, data := range encoded {
+		payment, err := domain.PaymentFromByteSlice(data)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// Update stores the payment, replacing the one with the same ID, if its
+// version is the stored one, and increments the version. It returns
+// repository.ErrNotFound if the payment does not exist and
+// domain.ErrVersionConflict if it was changed since it was read.
+func (r *PaymentsRepository) Update(ctx context.Context, payment *domain.Payment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	updated := *payment
+	updated.Version++
+	encoded, err := domain.PaymentToByteSlice(&updated)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, found := r.payments[payment.ID]
+	if !found {
+		return repository.ErrNotFound
+	}
+	existing, err := domain.PaymentFromByteSlice(stored)
+	if err != nil {
+		return err
+	}
+	if existing.Version != payment.Version {
+		return domain.ErrVersionConflict
+	}
+	r.payments[payment.ID] = encoded
+	payment.Version = updated.Version
+	return nil
+}
+
+// Delete deletes a payment. Deleting a payment which does not exist is not an error.
+func (r *PaymentsRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.payments, id)
+	return nil
+}
+
+// Exists checks if payment with given ID exists.
+func (r *PaymentsRepository) Exists(ctx context.Context, id string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, found := r.payments[id]
+	return found
+}
@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/service"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (service.PaymentsRepository, func()) {
+		return New(), func() {}
+	})
+}
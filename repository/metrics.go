@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/mysza/paymentsapi/metrics"
+)
+
+// keyCountInterval is how often keys are counted at most, as counting them
+// iterates all of them.
+const keyCountInterval = time.Minute
+
+// NewStatsCollector creates a metrics collector gathering statistics of the
+// Badger database on every scrape. The keys are counted once a minute at
+// most, by the first scrape after the count expires.
+func NewStatsCollector(db *badger.DB) metrics.Collector {
+	keys := &keyCounter{db: db, interval: keyCountInterval, now: time.Now}
+	return metrics.CollectorFunc(func() []metrics.Family {
+		stats := tableStats(db)
+		tablesFamily := metrics.Family{Name: "badger_tables", Help: "Number of tables per LSM tree level.", Type: metrics.TypeGauge}
+		for level, tables := range stats.TablesPerLevel {
+			tablesFamily.Samples = append(tablesFamily.Samples, metrics.Sample{
+				Labels: []metrics.Label{{Name: "level", Value: strconv.Itoa(level)}},
+				Value:  float64(tables),
+			})
+		}
+		return []metrics.Family{
+			gauge("badger_lsm_size_bytes", "Size of the LSM tree files.", float64(stats.LSMSize)),
+			gauge("badger_vlog_size_bytes", "Size of the value log files.", float64(stats.VLogSize)),
+			gauge("badger_keys", "Number of keys stored, counted once a minute at most.", float64(keys.count())),
+			gauge("badger_pending_compaction_tables", "Number of level 0 tables awaiting compaction into level 1.", float64(stats.TablesPerLevel[0])),
+			tablesFamily,
+		}
+	})
+}
+
+// keyCounter caches the number of keys of the database for the interval.
+type keyCounter struct {
+	db       *badger.DB
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex // mu serialises counting, so that concurrent scrapes count once
+	keys      int
+	countedAt time.Time
+}
+
+func (c *keyCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := c.now(); c.countedAt.IsZero() || now.Sub(c.countedAt) >= c.interval {
+		c.keys, c.countedAt = countKeys(c.db), now
+	}
+	return c.keys
+}
+
+func gauge(name, help string, value float64) metrics.Family {
+	return metrics.Family{Name: name, Help: help, Type: metrics.TypeGauge, Samples: []metrics.Sample{{Value: value}}}
+}
+
+// countKeys counts the keys without reading the values from the value log.
+func countKeys(db *badger.DB) int {
+	count := 0
+	db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
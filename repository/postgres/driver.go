@@ -0,0 +1,8 @@
+//go:build postgres
+
+package postgres
+
+import (
+	// registers the PostgreSQL driver as DriverName
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,16 @@
+-- payments are stored as JSONB documents, with the columns queried most
+-- often extracted and indexed
+CREATE TABLE payments (
+    id              TEXT PRIMARY KEY,
+    organisation_id TEXT NOT NULL,
+    processing_date TEXT NOT NULL,
+    status          TEXT NOT NULL DEFAULT '',
+    version         BIGINT NOT NULL DEFAULT 1,
+    body            JSONB NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payments_organisation_id ON payments (organisation_id);
+CREATE INDEX payments_processing_date ON payments (processing_date);
+CREATE INDEX payments_status ON payments (status);
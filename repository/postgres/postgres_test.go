@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/service"
+)
+
+// defaultTestDSN is the database of a local postgres, e.g. started with
+// docker run -e POSTGRES_HOST_AUTH_METHOD=trust -p 5432:5432 postgres
+const defaultTestDSN = "postgres://postgres@localhost:5432/postgres?sslmode=disable"
+
+// openTestDB connects to the database of PAYMENTSAPI_TEST_POSTGRES_DSN, or the
+// local one, with its payments removed. Tests are skipped if no server is
+// reachable, but fail on any other error, e.g. of authentication or migrations.
+func openTestDB(t *testing.T) (*PaymentsRepository, func()) {
+	if !driverLinked() {
+		t.Skip(ErrNoDriver)
+	}
+	dsn := os.Getenv("PAYMENTSAPI_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		dsn = defaultTestDSN
+	}
+	db, err := Open(Config{DSN: dsn, MaxOpenConns: 10, MaxIdleConns: 2})
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		t.Skipf("PostgreSQL unreachable: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`TRUNCATE payments`); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return New(db), func() { db.Close() }
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (service.PaymentsRepository, func()) {
+		return openTestDB(t)
+	})
+}
+
+func TestIndexedColumns(t *testing.T) {
+	repo, cleanup := openTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	payment := repositorytest.NewPayment(t)
+	id, _ := repo.Add(ctx, payment)
+	payment.Status = "accepted"
+
+	updateErr := repo.Update(ctx, payment)
+	var status string
+	var version int64
+	err := repo.db.QueryRow(`SELECT status, version FROM payments
+		WHERE organisation_id = $1 AND processing_date = $2`,
+		payment.OrganisationID, payment.Attributes.ProcessingDate).Scan(&status, &version)
+
+	assert.Nil(t, updateErr)
+	assert.Nil(t, err)
+	assert.Equal(t, "accepted", status)
+	assert.Equal(t, int64(2), version, "Updates must increment the version")
+	assert.True(t, repo.Exists(ctx, id))
+	assert.Nil(t, repo.Check(ctx))
+}
+
+func TestStaleUpdates(t *testing.T) {
+	repo, cleanup := openTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	id, _ := repo.Add(ctx, repositorytest.NewPayment(t))
+	first, _ := repo.Get(ctx, id)
+	second, _ := repo.Get(ctx, id)
+	first.Attributes.Reference = "first"
+	second.Attributes.Reference = "second"
+
+	firstErr := repo.Update(ctx, first)
+	secondErr := repo.Update(ctx, second)
+	stored, _ := repo.Get(ctx, id)
+	repo.Delete(ctx, id)
+	deletedErr := repo.Update(ctx, stored)
+
+	assert.Nil(t, firstErr)
+	assert.Equal(t, domain.ErrVersionConflict, secondErr, "Updates of payments read before the last one must fail")
+	assert.Equal(t, "first", stored.Attributes.Reference)
+	assert.Equal(t, int64(2), stored.Version)
+	assert.Equal(t, first.Version, stored.Version)
+	assert.Equal(t, repository.ErrNotFound, deletedErr, "Deleted payments must not be stored again")
+	assert.False(t, repo.Exists(ctx, id))
+}
@@ -1,37 +1,255 @@
 package repository
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
 	"github.com/dgraph-io/badger"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/encryption"
+	"github.com/mysza/paymentsapi/tracing"
 )
 
+const (
+	// conflictRetries is how many times a transaction is retried
+	// after conflicting with a concurrent one
+	conflictRetries = 3
+	conflictBackoff = 10 * time.Millisecond
+
+	// internalKeyPrefix starts the keys of data other than payments,
+	// which cannot collide with the UUIDs of payments
+	internalKeyPrefix = "!"
+
+	// rewriteBatch is the number of payments rewritten in a transaction
+	// by the operations rewriting all of them, e.g. re-encryption
+	rewriteBatch = 100
+)
+
+// ErrNotFound is returned by repositories for payments which do not exist.
+var ErrNotFound = errors.New("payment not found")
+
 // PaymentsRepository provides access to the payments database.
 type PaymentsRepository struct {
-	db *badger.DB
+	db         *badger.DB
+	encrypter  *encryption.Encrypter
+	codec      Codec
+	migrations []Migration
+}
+
+// Option configures optional behaviour of the PaymentsRepository.
+type Option func(*PaymentsRepository)
+
+// WithEncryption encrypts personal data of payments at rest.
+func WithEncryption(encrypter *encryption.Encrypter) Option {
+	return func(r *PaymentsRepository) {
+		r.encrypter = encrypter
+	}
+}
+
+// WithCodec sets the codec of the payments written. Payments stored with
+// other codecs remain readable. By default payments are stored as JSON.
+func WithCodec(codec Codec) Option {
+	return func(r *PaymentsRepository) {
+		r.codec = codec
+	}
+}
+
+// New creates a new repository using the Badger database.
+func New(db *badger.DB, opts ...Option) *PaymentsRepository {
+	r := &PaymentsRepository{db: db, codec: JSONCodec, migrations: migrations}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
-// New creates a new repository using SQLite database.
-func New(db *badger.DB) *PaymentsRepository {
-	return &PaymentsRepository{db}
+// encode encodes the payment for storage in the current schema version,
+// encrypting it if configured.
+func (r *PaymentsRepository) encode(payment *domain.Payment) ([]byte, error) {
+	if r.encrypter != nil {
+		encrypted, err := r.encrypter.EncryptPayment(payment)
+		if err != nil {
+			return nil, err
+		}
+		payment = encrypted
+	}
+	return r.marshal(payment)
 }
 
-func (r *PaymentsRepository) set(payment *domain.Payment) error {
-	encoded, err := domain.PaymentToByteSlice(payment)
+// marshal encodes the payment for storage in the current schema version with
+// the configured codec, as it is.
+func (r *PaymentsRepository) marshal(payment *domain.Payment) ([]byte, error) {
+	data, err := r.codec.Marshal(payment)
 	if err != nil {
+		return nil, err
+	}
+	return wrap(r.codec, r.SchemaVersion(), data)
+}
+
+// decode decodes the stored payment, upgrading it to the current schema
+// version and decrypting it if configured.
+func (r *PaymentsRepository) decode(data []byte) (*domain.Payment, error) {
+	payment, err := r.unmarshal(data)
+	if err != nil || r.encrypter == nil {
+		return payment, err
+	}
+	return r.encrypter.DecryptPayment(payment)
+}
+
+// unmarshal decodes the stored payment, upgrading it to the current schema
+// version, but leaves personal data encrypted.
+func (r *PaymentsRepository) unmarshal(data []byte) (*domain.Payment, error) {
+	_, payment, err := r.upgrade(data)
+	return payment, err
+}
+
+// view runs fn in a read-only transaction traced as a span named after the operation.
+func (r *PaymentsRepository) view(ctx context.Context, operation string, fn func(*badger.Txn) error) error {
+	_, span := tracing.Start(ctx, "badger.View "+operation, trace.WithAttributes(
+		attribute.String("db.system", "badger"),
+		attribute.String("db.operation", operation),
+	))
+	defer span.End()
+	if err := ctx.Err(); err != nil {
+		tracing.RecordError(span, err)
 		return err
 	}
-	return r.db.Update(func(txn *badger.Txn) error {
+	err := r.db.View(fn)
+	if err != badger.ErrKeyNotFound {
+		tracing.RecordError(span, err)
+	}
+	return err
+}
+
+// update runs fn in a read-write transaction traced as a span named after the operation.
+// Transactions conflicting with concurrent ones are retried until ctx is done.
+func (r *PaymentsRepository) update(ctx context.Context, operation string, fn func(*badger.Txn) error) (err error) {
+	_, span := tracing.Start(ctx, "badger.Update "+operation, trace.WithAttributes(
+		attribute.String("db.system", "badger"),
+		attribute.String("db.operation", operation),
+	))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err = r.db.Update(fn)
+		if err != badger.ErrConflict || attempt == conflictRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(conflictBackoff << uint(attempt)):
+		}
+	}
+}
+
+func (r *PaymentsRepository) set(ctx context.Context, operation string, payment *domain.Payment) error {
+	encoded, err := r.encode(payment)
+	if err != nil {
+		return err
+	}
+	return r.update(ctx, operation, func(txn *badger.Txn) error {
 		err := txn.Set([]byte(payment.ID), encoded)
 		return err
 	})
 }
 
+// scan calls fn with the ID and the stored value of every payment, in a
+// read-only transaction traced as a span named after the operation. The value
+// is only valid until fn returns.
+func (r *PaymentsRepository) scan(ctx context.Context, operation string, fn func(id, value []byte) error) error {
+	return r.view(ctx, operation, func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+		})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			if bytes.HasPrefix(item.Key(), []byte(internalKeyPrefix)) {
+				continue
+			}
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if len(value) == 0 {
+				continue // deletion restored from a backup
+			}
+			if err := fn(item.Key(), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rewrite replaces the stored values of the payments with the results of fn,
+// in transactions of rewriteBatch payments. Payments deleted meanwhile are
+// skipped. It returns the number of payments rewritten.
+func (r *PaymentsRepository) rewrite(ctx context.Context, operation string, ids [][]byte, fn func(value []byte) ([]byte, error)) (int, error) {
+	rewritten := 0
+	for start := 0; start < len(ids); start += rewriteBatch {
+		end := start + rewriteBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := 0
+		err := r.update(ctx, operation, func(txn *badger.Txn) error {
+			batch = 0
+			for _, id := range ids[start:end] {
+				item, err := txn.Get(id)
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				value, err := item.Value()
+				if err != nil {
+					return err
+				}
+				if len(value) == 0 {
+					continue
+				}
+				rewrittenValue, err := fn(value)
+				if err != nil {
+					return err
+				}
+				if err := txn.Set(id, rewrittenValue); err != nil {
+					return err
+				}
+				batch++
+			}
+			return nil
+		})
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += batch
+	}
+	return rewritten, nil
+}
+
 // Add adds a payment to the database.
-func (r *PaymentsRepository) Add(payment *domain.Payment) (string, error) {
+func (r *PaymentsRepository) Add(ctx context.Context, payment *domain.Payment) (string, error) {
 	payment.ID = uuid.New().String()
-	err := r.set(payment)
+	payment.Version = 1
+	err := r.set(ctx, "add", payment)
 	if err != nil {
 		return "", err
 	}
@@ -39,40 +257,39 @@ func (r *PaymentsRepository) Add(payment *domain.Payment) (string, error) {
 }
 
 // Get retrieves single payment from the database.
-func (r *PaymentsRepository) Get(id string) (*domain.Payment, error) {
+// It returns ErrNotFound if the payment does not exist.
+func (r *PaymentsRepository) Get(ctx context.Context, id string) (*domain.Payment, error) {
 	var encodedPayment []byte
-	err := r.db.View(func(txn *badger.Txn) error {
+	err := r.view(ctx, "get", func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(id))
 		if err != nil {
 			return err
 		}
 		encodedPayment, err = item.ValueCopy(nil)
+		if err == nil && len(encodedPayment) == 0 {
+			// deletion restored from a backup
+			return badger.ErrKeyNotFound
+		}
 		return err
 	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	return domain.PaymentFromByteSlice(encodedPayment)
+	return r.decode(encodedPayment)
 }
 
 // GetAll retrieves all payments from the database.
-func (r *PaymentsRepository) GetAll() ([]*domain.Payment, error) {
-	var encodedPayment []byte
+func (r *PaymentsRepository) GetAll(ctx context.Context) ([]*domain.Payment, error) {
 	var payments []*domain.Payment
-	err := r.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.IteratorOptions{
-			PrefetchValues: true,
-			PrefetchSize:   100,
-		})
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			encodedPayment, err := it.Item().ValueCopy(encodedPayment)
-			p, err := domain.PaymentFromByteSlice(encodedPayment)
-			if err != nil {
-				return err
-			}
-			payments = append(payments, p)
+	err := r.scan(ctx, "get_all", func(_, value []byte) error {
+		p, err := r.decode(value)
+		if err != nil {
+			return err
 		}
+		payments = append(payments, p)
 		return nil
 	})
 	if err != nil {
@@ -81,20 +298,73 @@ func (r *PaymentsRepository) GetAll() ([]*domain.Payment, error) {
 	return payments, nil
 }
 
-// Update updates a payment in the database.
-func (r *PaymentsRepository) Update(payment *domain.Payment) error {
-	return r.set(payment)
+// Update updates a payment in the database if its version is the stored one,
+// and increments the version. It returns ErrNotFound if the payment does not
+// exist, e.g. was deleted concurrently, and domain.ErrVersionConflict if it
+// was changed since it was read.
+func (r *PaymentsRepository) Update(ctx context.Context, payment *domain.Payment) error {
+	updated := *payment
+	updated.Version++
+	encoded, err := r.encode(&updated)
+	if err != nil {
+		return err
+	}
+	err = r.update(ctx, "update", func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(payment.ID))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		if len(value) == 0 {
+			return ErrNotFound // deletion restored from a backup
+		}
+		stored, err := r.unmarshal(value)
+		if err != nil {
+			return err
+		}
+		if stored.Version != payment.Version {
+			return domain.ErrVersionConflict
+		}
+		return txn.Set([]byte(payment.ID), encoded)
+	})
+	if err != nil {
+		return err
+	}
+	payment.Version = updated.Version
+	return nil
 }
 
 // Delete deletes a payment from the database.
-func (r *PaymentsRepository) Delete(id string) error {
-	return r.db.Update(func(txn *badger.Txn) error {
+func (r *PaymentsRepository) Delete(ctx context.Context, id string) error {
+	return r.update(ctx, "delete", func(txn *badger.Txn) error {
 		return txn.Delete([]byte(id))
 	})
 }
 
 // Exists is a helper function to check if payment with give ID exists.
-func (r *PaymentsRepository) Exists(id string) bool {
-	payment, _ := r.Get(id)
-	return payment != nil
+// It neither reads the payment from the value log nor decodes it.
+func (r *PaymentsRepository) Exists(ctx context.Context, id string) bool {
+	err := r.view(ctx, "exists", func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(id))
+		// the size of empty values, deletions restored from a backup, is the size of their key
+		if err == nil && item.EstimatedSize() <= int64(len(item.Key())) {
+			return badger.ErrKeyNotFound
+		}
+		return err
+	})
+	return err == nil
+}
+
+// Open opens the Badger database stored in the directory.
+func Open(dir string) (*badger.DB, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	return badger.Open(opts)
 }
@@ -1,14 +1,24 @@
 package repository
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/encryption"
 	"github.com/mysza/paymentsapi/test"
+	"github.com/mysza/paymentsapi/tracing"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func createDB() (*badger.DB, string) {
@@ -34,6 +44,7 @@ func prepareRepository() (*PaymentsRepository, func()) {
 
 func TestRepository(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 	testDataDir := filepath.Join("..", "testdata")
 	validPaymentNoID := test.PaymentFromFile(t, filepath.Join(testDataDir, "validPayment.json"))
 	validPaymentNoID.ID = ""
@@ -42,7 +53,7 @@ func TestRepository(t *testing.T) {
 		repo, cleanup := prepareRepository()
 		defer cleanup()
 
-		id, err := repo.Add(validPaymentNoID)
+		id, err := repo.Add(ctx, validPaymentNoID)
 
 		assert.Nilf(err, "Error adding to repo: %v", err)
 		assert.NotEmpty(id, "No ID was created")
@@ -52,9 +63,9 @@ func TestRepository(t *testing.T) {
 		repo, cleanup := prepareRepository()
 		defer cleanup()
 
-		id, _ := repo.Add(validPaymentNoID)
+		id, _ := repo.Add(ctx, validPaymentNoID)
 
-		retPayment, err := repo.Get(id)
+		retPayment, err := repo.Get(ctx, id)
 
 		assert.Nilf(err, "Error getting from repo: %v", err)
 		assert.NotEmpty(retPayment, "No payment returned")
@@ -67,40 +78,285 @@ func TestRepository(t *testing.T) {
 
 		// create 10 instances of payments
 		for ix := 0; ix < 10; ix++ {
-			repo.Add(validPaymentNoID)
+			repo.Add(ctx, validPaymentNoID)
 		}
 
-		payments, err := repo.GetAll()
+		payments, err := repo.GetAll(ctx)
 
 		assert.Nilf(err, "Error getting all from repo: %v", err)
 		assert.NotEmpty(payments, "No payments returned")
 		assert.Equalf(10, len(payments), "Number of payments is incorrect; expected: %v, actual: %v", 10, len(payments))
 	})
 
+	t.Run("Repository writability check", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		repo := New(db)
+		repo.Add(ctx, validPaymentNoID)
+
+		err := WritableCheck(db)(ctx)
+		payments, _ := repo.GetAll(ctx)
+
+		assert.Nil(err)
+		assert.Len(payments, 1, "Health check key returned as payment")
+	})
+
+	t.Run("Repository honours cancelled context", func(t *testing.T) {
+		repo, cleanup := prepareRepository()
+		defer cleanup()
+		id, _ := repo.Add(ctx, validPaymentNoID)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		payments, getAllErr := repo.GetAll(cancelled)
+		_, getErr := repo.Get(cancelled, id)
+		deleteErr := repo.Delete(cancelled, id)
+
+		assert.Equal(context.Canceled, getAllErr)
+		assert.Empty(payments)
+		assert.Equal(context.Canceled, getErr)
+		assert.Equal(context.Canceled, deleteErr)
+		assert.True(repo.Exists(ctx, id), "Payment deleted despite cancelled context")
+	})
+
 	t.Run("Repository delete", func(t *testing.T) {
 		repo, cleanup := prepareRepository()
 		defer cleanup()
 
-		id, _ := repo.Add(validPaymentNoID)
+		id, _ := repo.Add(ctx, validPaymentNoID)
 
-		err := repo.Delete(id)
+		err := repo.Delete(ctx, id)
 
 		assert.Nilf(err, "Error deleting payment: %v", err)
-		assert.False(repo.Exists(id), "Repo reports payment still exists")
+		assert.False(repo.Exists(ctx, id), "Repo reports payment still exists")
 	})
 
 	t.Run("Repository update", func(t *testing.T) {
 		repo, cleanup := prepareRepository()
 		defer cleanup()
 
-		id, _ := repo.Add(validPaymentNoID)
-		payment, _ := repo.Get(id)
+		id, _ := repo.Add(ctx, validPaymentNoID)
+		payment, _ := repo.Get(ctx, id)
 		orgID := "ACME Inc."
 		payment.OrganisationID = orgID
-		err := repo.Update(payment)
-		updated, _ := repo.Get(id)
+		err := repo.Update(ctx, payment)
+		updated, _ := repo.Get(ctx, id)
 
 		assert.Nilf(err, "Error updating payment: %v", err)
 		assert.Equalf(orgID, updated.OrganisationID, "Payment not updated; expected: %v, got: %v", orgID, updated.OrganisationID)
 	})
+
+	t.Run("Repository transactions are traced", func(t *testing.T) {
+		repo, cleanup := prepareRepository()
+		defer cleanup()
+		recorder := tracetest.NewSpanRecorder()
+		tracing.SetProvider(tracing.NewProvider(recorder, "paymentsapi", 1))
+		defer tracing.SetProvider(noop.NewTracerProvider())
+		ctx, parent := tracing.Start(ctx, "parent")
+
+		id, _ := repo.Add(ctx, validPaymentNoID)
+		repo.Get(ctx, id)
+
+		spans := recorder.Ended()
+		if assert.Len(spans, 2) {
+			assert.Equal("badger.Update add", spans[0].Name())
+			assert.Equal("badger.View get", spans[1].Name())
+			assert.Equal(parent.SpanContext().SpanID(), spans[1].Parent().SpanID())
+		}
+	})
+
+	t.Run("Repository encrypts personal data", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		plain := New(db)
+		legacyID, _ := plain.Add(ctx, validPaymentNoID)
+		keyring, _ := encryption.NewKeyring()
+		repo := New(db, WithEncryption(encryption.NewEncrypter(keyring)))
+
+		id, _ := repo.Add(ctx, validPaymentNoID)
+		stored, _ := plain.Get(ctx, id)
+		read, err := repo.Get(ctx, id)
+		legacy, legacyErr := repo.Get(ctx, legacyID)
+
+		assert.Nil(err)
+		assert.NotEqual(validPaymentNoID.Attributes.Debtor.Name, stored.Attributes.Debtor.Name, "Name stored in clear text")
+		assert.Equal(validPaymentNoID.Attributes.Debtor.Name, read.Attributes.Debtor.Name)
+		assert.Nil(legacyErr)
+		assert.Equal(validPaymentNoID.Attributes.Debtor.Name, legacy.Attributes.Debtor.Name)
+
+		keyring.Rotate()
+		count, err := repo.Reencrypt(ctx)
+		again, _ := repo.Reencrypt(ctx)
+		read, readErr := repo.Get(ctx, legacyID)
+
+		assert.Nil(err)
+		assert.Equal(2, count, "Both payments must be re-encrypted with the new key")
+		assert.Equal(0, again)
+		assert.Nil(readErr)
+		assert.Equal(validPaymentNoID.Attributes.Debtor.Name, read.Attributes.Debtor.Name)
+	})
+
+	t.Run("Repository stats collector", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		repo := New(db)
+		for ix := 0; ix < 3; ix++ {
+			repo.Add(ctx, validPaymentNoID)
+		}
+
+		families := NewStatsCollector(db).Collect()
+
+		var keys float64 = -1
+		for _, family := range families {
+			if family.Name == "badger_keys" {
+				keys = family.Samples[0].Value
+			}
+		}
+		assert.Equal(float64(3), keys, "Number of keys is incorrect")
+	})
+
+	t.Run("Keys are counted once per interval", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		repo := New(db)
+		repo.Add(ctx, validPaymentNoID)
+		now := time.Now()
+		counter := &keyCounter{db: db, interval: time.Minute, now: func() time.Time { return now }}
+
+		first := counter.count()
+		repo.Add(ctx, validPaymentNoID)
+		cached := counter.count()
+		now = now.Add(time.Minute)
+		refreshed := counter.count()
+
+		assert.Equal(1, first)
+		assert.Equal(1, cached)
+		assert.Equal(2, refreshed)
+	})
+
+	t.Run("Repository restores full and incremental backups", func(t *testing.T) {
+		repo, cleanup := prepareRepository()
+		defer cleanup()
+		kept, _ := repo.Add(ctx, validPaymentNoID)
+		deleted, _ := repo.Add(ctx, validPaymentNoID)
+		var full, incremental bytes.Buffer
+		since, fullErr := repo.Backup(&full, 0)
+		repo.Delete(ctx, deleted)
+		added, _ := repo.Add(ctx, validPaymentNoID)
+		_, incrementalErr := repo.Backup(&incremental, since)
+
+		restored, restoredCleanup := prepareRepository()
+		defer restoredCleanup()
+		restoreFullErr := restored.Restore(&full)
+		restoreIncrementalErr := restored.Restore(&incremental)
+		payments, err := restored.GetAll(ctx)
+
+		assert.Nil(fullErr)
+		assert.Nil(incrementalErr)
+		assert.Nil(restoreFullErr)
+		assert.Nil(restoreIncrementalErr)
+		assert.Nil(err)
+		assert.Len(payments, 2, "Deleted payment must not be restored")
+		assert.True(restored.Exists(ctx, kept))
+		assert.True(restored.Exists(ctx, added))
+		assert.False(restored.Exists(ctx, deleted))
+	})
+
+	t.Run("Repository verify reports corrupt and invalid records", func(t *testing.T) {
+		repo, cleanup := prepareRepository()
+		defer cleanup()
+		valid, _ := repo.Add(ctx, validPaymentNoID)
+		invalid, _ := repo.Add(ctx, validPaymentNoID)
+		repo.db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("corrupt"), []byte("{not json"))
+		})
+		errInvalid := errors.New("invalid")
+
+		records, err := repo.Verify(ctx, func(p *domain.Payment) error {
+			if p.ID == invalid {
+				return errInvalid
+			}
+			return nil
+		})
+
+		assert.Nil(err)
+		ids := map[string]error{}
+		for _, record := range records {
+			ids[record.ID] = record.Err
+		}
+		assert.Len(ids, 2)
+		assert.NotContains(ids, valid)
+		assert.Contains(ids, "corrupt")
+		assert.Equal(errInvalid, ids[invalid])
+	})
+
+	t.Run("Repository maintenance", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		repo := New(db)
+		repo.Add(ctx, validPaymentNoID)
+
+		rewritten, err := RunGC(db, DefaultDiscardRatio)
+		_, invalidErr := RunGC(db, 1)
+		stats := GetStats(db)
+
+		assert.Nil(err)
+		assert.Equal(0, rewritten, "Nothing to collect in a fresh database")
+		assert.Equal(badger.ErrInvalidRequest, invalidErr)
+		assert.Equal(1, stats.Keys)
+		assert.NotEmpty(stats.TablesPerLevel)
+	})
+
+	t.Run("Repository upgrades schema versions", func(t *testing.T) {
+		db, dir := createDB()
+		defer os.RemoveAll(dir)
+		defer db.Close()
+		previous := New(db)
+		currentID, _ := previous.Add(ctx, validPaymentNoID)
+		legacy := *validPaymentNoID
+		legacy.ID = "legacy"
+		legacyData, _ := domain.PaymentToByteSlice(&legacy)
+		db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(legacy.ID), legacyData)
+		})
+		repo := New(db)
+		repo.migrations = append(repo.Migrations(), Migration{
+			Version:     previous.SchemaVersion() + 1,
+			Description: "set status",
+			Up: func(payment map[string]interface{}) error {
+				payment["status"] = "migrated"
+				return nil
+			},
+		})
+
+		versions, versionsErr := repo.SchemaVersions(ctx)
+		read, readErr := repo.Get(ctx, legacy.ID)
+		count, migrateErr := repo.Migrate(ctx)
+		again, _ := repo.Migrate(ctx)
+		migrated, _ := repo.SchemaVersions(ctx)
+		current, _ := repo.Get(ctx, currentID)
+		_, newerErr := previous.Get(ctx, currentID)
+
+		assert.Nil(versionsErr)
+		assert.Equal(map[int]int{0: 1, 1: 1}, versions)
+		assert.Nil(readErr)
+		assert.Equal("migrated", read.Status, "Legacy payment must be upgraded on read")
+		assert.Equal(validPaymentNoID.Attributes.Amount, read.Attributes.Amount)
+		assert.Nil(migrateErr)
+		assert.Equal(2, count)
+		assert.Equal(0, again)
+		assert.Equal(map[int]int{2: 2}, migrated)
+		assert.Equal("migrated", current.Status)
+		assert.Contains(fmt.Sprint(newerErr), ErrUnknownSchemaVersion.Error())
+	})
+
+	t.Run("Repository migrations must have consecutive versions", func(t *testing.T) {
+		assert.Nil(checkMigrations(migrations))
+		assert.NotNil(checkMigrations([]Migration{{Version: 1}, {Version: 3}}))
+	})
 }
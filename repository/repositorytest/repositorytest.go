@@ -0,0 +1,229 @@
+// Package repositorytest provides the conformance test suite which every
+// implementation of service.PaymentsRepository must pass.
+package repositorytest
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/service"
+	"github.com/mysza/paymentsapi/test"
+)
+
+// Factory creates an empty repository, and the function releasing it.
+type Factory func(t *testing.T) (service.PaymentsRepository, func())
+
+// Run runs the conformance test suite against repositories created by newRepository.
+func Run(t *testing.T, newRepository Factory) {
+	ctx := context.Background()
+	fixture := NewPayment(t)
+	newPayment := func() *domain.Payment { return NewPayment(t) }
+
+	t.Run("Add sets a new ID", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		payment := newPayment()
+
+		id, err := repo.Add(ctx, payment)
+		otherID, otherErr := repo.Add(ctx, newPayment())
+
+		assert.Nil(t, err)
+		assert.Nil(t, otherErr)
+		assert.NotEmpty(t, id)
+		assert.Equal(t, id, payment.ID, "Payment ID must be set to the returned one")
+		assert.NotEqual(t, id, otherID, "IDs must be unique")
+	})
+
+	t.Run("Get returns the stored payment", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		payment := newPayment()
+		id, _ := repo.Add(ctx, payment)
+
+		stored, err := repo.Get(ctx, id)
+
+		assert.Nil(t, err)
+		assert.Equal(t, payment, stored)
+	})
+
+	t.Run("Get returns ErrNotFound for missing payments", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+
+		stored, err := repo.Get(ctx, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+
+		assert.Nil(t, stored)
+		assert.Equal(t, repository.ErrNotFound, err)
+	})
+
+	t.Run("Exists reports stored payments", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		id, _ := repo.Add(ctx, newPayment())
+
+		assert.True(t, repo.Exists(ctx, id))
+		assert.False(t, repo.Exists(ctx, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"))
+	})
+
+	t.Run("GetAll returns all payments", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		empty, emptyErr := repo.GetAll(ctx)
+		ids := map[string]bool{}
+		for ix := 0; ix < 3; ix++ {
+			id, _ := repo.Add(ctx, newPayment())
+			ids[id] = true
+		}
+
+		payments, err := repo.GetAll(ctx)
+
+		assert.Nil(t, emptyErr)
+		assert.Empty(t, empty)
+		assert.Nil(t, err)
+		assert.Len(t, payments, len(ids))
+		for _, payment := range payments {
+			assert.True(t, ids[payment.ID], "Unexpected payment %s", payment.ID)
+		}
+	})
+
+	t.Run("Update replaces the payment", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		payment := newPayment()
+		id, _ := repo.Add(ctx, payment)
+		payment.Attributes.Reference = "updated"
+		payment.Status = domain.StatusAccepted
+		payment.Approvals = []domain.Approval{
+			{ApprovedBy: "approver", ApprovedAt: time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)},
+		}
+
+		err := repo.Update(ctx, payment)
+		stored, _ := repo.Get(ctx, id)
+		payments, _ := repo.GetAll(ctx)
+
+		assert.Nil(t, err)
+		assert.Equal(t, payment, stored)
+		assert.Len(t, payments, 1)
+	})
+
+	t.Run("Update of payments changed since read conflicts", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		id, _ := repo.Add(ctx, newPayment())
+		first, _ := repo.Get(ctx, id)
+		second, _ := repo.Get(ctx, id)
+		first.Attributes.Reference = "first"
+		second.Attributes.Reference = "second"
+
+		firstErr := repo.Update(ctx, first)
+		secondErr := repo.Update(ctx, second)
+		stored, _ := repo.Get(ctx, id)
+
+		assert.Nil(t, firstErr)
+		assert.Equal(t, domain.ErrVersionConflict, secondErr)
+		assert.Equal(t, first, stored)
+		assert.True(t, stored.Version > second.Version, "Updates must increment the version")
+	})
+
+	t.Run("Update of missing payments returns ErrNotFound", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		payment := newPayment()
+		id, _ := repo.Add(ctx, payment)
+		repo.Delete(ctx, id)
+
+		err := repo.Update(ctx, payment)
+
+		assert.Equal(t, repository.ErrNotFound, err)
+		assert.False(t, repo.Exists(ctx, id), "Updates must not recreate payments")
+	})
+
+	t.Run("Delete removes the payment", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		id, _ := repo.Add(ctx, newPayment())
+		keptID, _ := repo.Add(ctx, newPayment())
+
+		err := repo.Delete(ctx, id)
+		_, getErr := repo.Get(ctx, id)
+		missingErr := repo.Delete(ctx, id)
+
+		assert.Nil(t, err)
+		assert.Equal(t, repository.ErrNotFound, getErr)
+		assert.Nil(t, missingErr, "Deleting a missing payment is not an error")
+		assert.True(t, repo.Exists(ctx, keptID))
+	})
+
+	t.Run("Stored payments are not shared with callers", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		payment := newPayment()
+		id, _ := repo.Add(ctx, payment)
+		payment.Attributes.Reference = "changed after add"
+		read, _ := repo.Get(ctx, id)
+		read.Attributes.Reference = "changed after get"
+
+		stored, _ := repo.Get(ctx, id)
+
+		assert.Equal(t, fixture.Attributes.Reference, stored.Attributes.Reference)
+	})
+
+	t.Run("Operations honour cancelled context", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		payment := newPayment()
+		id, _ := repo.Add(ctx, payment)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, addErr := repo.Add(cancelled, newPayment())
+		_, getErr := repo.Get(cancelled, id)
+		_, getAllErr := repo.GetAll(cancelled)
+		updateErr := repo.Update(cancelled, payment)
+		deleteErr := repo.Delete(cancelled, id)
+
+		assert.Equal(t, context.Canceled, addErr)
+		assert.Equal(t, context.Canceled, getErr)
+		assert.Equal(t, context.Canceled, getAllErr)
+		assert.Equal(t, context.Canceled, updateErr)
+		assert.Equal(t, context.Canceled, deleteErr)
+		assert.True(t, repo.Exists(ctx, id), "Cancelled delete must not remove the payment")
+	})
+
+	t.Run("Concurrent writes are not lost", func(t *testing.T) {
+		repo, cleanup := newRepository(t)
+		defer cleanup()
+		const writers = 20
+		var wg sync.WaitGroup
+		for ix := 0; ix < writers; ix++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				repo.Add(ctx, newPayment())
+			}()
+		}
+		wg.Wait()
+
+		payments, err := repo.GetAll(ctx)
+
+		assert.Nil(t, err)
+		assert.Len(t, payments, writers)
+	})
+}
+
+// NewPayment returns the valid payment of the repository test data,
+// without an ID, to be added to repositories.
+func NewPayment(t *testing.T) *domain.Payment {
+	_, file, _, _ := runtime.Caller(0)
+	payment := test.PaymentFromFile(t, filepath.Join(filepath.Dir(file), "..", "..", "testdata", "validPayment.json"))
+	payment.ID = ""
+	return payment
+}
@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// Stored payments are wrapped in an envelope recording the version of their
+// schema. With the JSON codec, the envelope is:
+//
+//	{"schema_version": 1, "payment": {...}}
+//
+// and with other codecs, the marker byte of the codec followed by the version
+// as a varint, and the encoded payment.
+//
+// Payments stored before the schema was versioned are bare payment documents,
+// read as version 0. Payments of older versions are upgraded on read by the
+// migrations registered after their version, and stored in the current version
+// on their next write, or by Migrate.
+
+// Migration upgrades stored payments from the previous schema version.
+type Migration struct {
+	Version     int    // Version is the schema version the migration upgrades to
+	Description string // Description tells what the migration changes
+
+	// Up upgrades the payment document in place. Numbers are decoded as
+	// json.Number, and personal data may be encrypted.
+	Up func(payment map[string]interface{}) error
+}
+
+// migrations is the ordered registry of schema migrations; the version of the
+// last one is the current schema version. New migrations are appended with the
+// next version whenever the stored form of domain.Payment changes.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "wrap payments in the schema version envelope",
+		Up:          func(map[string]interface{}) error { return nil },
+	},
+}
+
+func init() {
+	if err := checkMigrations(migrations); err != nil {
+		panic(err)
+	}
+}
+
+// checkMigrations ensures the migrations upgrade to consecutive versions starting with 1.
+func checkMigrations(migrations []Migration) error {
+	for ix, migration := range migrations {
+		if migration.Version != ix+1 {
+			return fmt.Errorf("migration %q upgrades to version %d, expected %d", migration.Description, migration.Version, ix+1)
+		}
+	}
+	return nil
+}
+
+// ErrUnknownSchemaVersion is returned for payments stored in a schema version
+// newer than the current one, e.g. by a newer release of the service.
+var ErrUnknownSchemaVersion = errors.New("unknown schema version")
+
+type envelope struct {
+	SchemaVersion *int            `json:"schema_version"`
+	Payment       json.RawMessage `json:"payment"`
+}
+
+// wrap wraps the payment encoded by the codec in the envelope of the schema version.
+func wrap(codec Codec, version int, payment []byte) ([]byte, error) {
+	if codec == JSONCodec {
+		return json.Marshal(envelope{&version, payment})
+	}
+	data := make([]byte, 0, 1+binary.MaxVarintLen64+len(payment))
+	data = append(data, codec.Marker())
+	data = binary.AppendUvarint(data, uint64(version))
+	return append(data, payment...), nil
+}
+
+// unwrap returns the schema version, the codec and the encoded payment of the stored value.
+func unwrap(data []byte) (int, Codec, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil, errors.New("empty record")
+	}
+	codec, err := codecByMarker(data[0])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if codec != JSONCodec {
+		version, n := binary.Uvarint(data[1:])
+		if n <= 0 {
+			return 0, nil, nil, errTruncated
+		}
+		return int(version), codec, data[1+n:], nil
+	}
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return 0, nil, nil, err
+	}
+	if e.SchemaVersion == nil {
+		return 0, codec, data, nil
+	}
+	return *e.SchemaVersion, codec, e.Payment, nil
+}
+
+// SchemaVersion returns the current schema version of stored payments.
+func (r *PaymentsRepository) SchemaVersion() int {
+	if len(r.migrations) == 0 {
+		return 0
+	}
+	return r.migrations[len(r.migrations)-1].Version
+}
+
+// Migrations returns the registered migrations in the order they are run.
+func (r *PaymentsRepository) Migrations() []Migration {
+	return r.migrations
+}
+
+// upgrade decodes the stored value, returning its schema version and the
+// payment upgraded to the current version. Payments of older versions are
+// upgraded as JSON documents, whatever their codec.
+func (r *PaymentsRepository) upgrade(data []byte) (int, *domain.Payment, error) {
+	version, codec, payment, err := unwrap(data)
+	current := r.SchemaVersion()
+	switch {
+	case err != nil:
+		return 0, nil, err
+	case version == current:
+		decoded, err := codec.Unmarshal(payment)
+		return version, decoded, err
+	case version > current || version < 0:
+		return version, nil, fmt.Errorf("%v: %d", ErrUnknownSchemaVersion, version)
+	}
+	if codec != JSONCodec {
+		decoded, err := codec.Unmarshal(payment)
+		if err != nil {
+			return version, nil, err
+		}
+		if payment, err = JSONCodec.Marshal(decoded); err != nil {
+			return version, nil, err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payment))
+	decoder.UseNumber()
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return version, nil, err
+	}
+	// migrations are registered with consecutive versions starting with 1
+	for _, migration := range r.migrations[version:] {
+		if err := migration.Up(document); err != nil {
+			return version, nil, fmt.Errorf("migrating to schema version %d: %v", migration.Version, err)
+		}
+	}
+	upgraded, err := json.Marshal(document)
+	if err != nil {
+		return version, nil, err
+	}
+	decoded, err := JSONCodec.Unmarshal(upgraded)
+	return version, decoded, err
+}
+
+// SchemaVersions returns the number of stored payments by their schema version.
+func (r *PaymentsRepository) SchemaVersions(ctx context.Context) (map[int]int, error) {
+	versions := map[int]int{}
+	err := r.scan(ctx, "schema_versions", func(_, value []byte) error {
+		version, _, _, err := unwrap(value)
+		if err != nil {
+			return err
+		}
+		versions[version]++
+		return nil
+	})
+	return versions, err
+}
+
+// Migrate stores the payments of older schema versions, or encoded by a
+// codec other than the configured one, in the current version with the
+// configured codec. It returns the number of payments migrated, and can be run
+// while the repository serves requests. Personal data is migrated as stored,
+// without the need to decrypt it.
+func (r *PaymentsRepository) Migrate(ctx context.Context) (int, error) {
+	current := r.SchemaVersion()
+	var ids [][]byte
+	err := r.scan(ctx, "migrate_scan", func(id, value []byte) error {
+		version, codec, _, err := unwrap(value)
+		if err != nil {
+			return err
+		}
+		if version != current || codec != r.codec {
+			ids = append(ids, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return r.rewrite(ctx, "migrate", ids, func(value []byte) ([]byte, error) {
+		payment, err := r.unmarshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return r.marshal(payment)
+	})
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package sqlite
+
+import (
+	// registers the pure-Go SQLite driver as DriverName
+	_ "modernc.org/sqlite"
+)
@@ -0,0 +1,60 @@
+CREATE TABLE payments (
+    id                        TEXT PRIMARY KEY,
+    organisation_id           TEXT NOT NULL,
+    status                    TEXT NOT NULL DEFAULT '',
+    created_by                TEXT NOT NULL DEFAULT '',
+    amount                    TEXT NOT NULL,
+    currency                  TEXT NOT NULL,
+    end_to_end_reference      TEXT NOT NULL,
+    numeric_reference         TEXT NOT NULL,
+    payment_id                TEXT NOT NULL,
+    payment_purpose           TEXT NOT NULL,
+    payment_scheme            TEXT NOT NULL,
+    payment_type              TEXT NOT NULL,
+    processing_date           TEXT NOT NULL,
+    reference                 TEXT NOT NULL,
+    scheme_payment_type       TEXT NOT NULL,
+    scheme_payment_sub_type   TEXT NOT NULL,
+    bearer_code               TEXT NOT NULL,
+    receiver_charges_amount   TEXT NOT NULL,
+    receiver_charges_currency TEXT NOT NULL,
+    fx_contract_reference     TEXT NOT NULL,
+    fx_exchange_rate          TEXT NOT NULL,
+    fx_original_amount        TEXT NOT NULL,
+    fx_original_currency      TEXT NOT NULL
+);
+
+CREATE INDEX payments_organisation_id ON payments (organisation_id);
+CREATE INDEX payments_processing_date ON payments (processing_date);
+
+-- parties of payments by role; sponsors only have the account columns set
+CREATE TABLE parties (
+    payment_id          TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+    role                TEXT NOT NULL CHECK (role IN ('beneficiary', 'debtor', 'sponsor')),
+    account_number      TEXT NOT NULL,
+    bank_id             TEXT NOT NULL,
+    bank_id_code        TEXT NOT NULL,
+    account_name        TEXT NOT NULL DEFAULT '',
+    account_number_code TEXT NOT NULL DEFAULT '',
+    account_type        INTEGER NOT NULL DEFAULT 0,
+    address             TEXT NOT NULL DEFAULT '',
+    name                TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (payment_id, role)
+);
+
+-- sender charges of payments in their order
+CREATE TABLE charges (
+    payment_id TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+    position   INTEGER NOT NULL,
+    amount     TEXT NOT NULL,
+    currency   TEXT NOT NULL,
+    PRIMARY KEY (payment_id, position)
+);
+
+CREATE TABLE approvals (
+    payment_id  TEXT NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+    position    INTEGER NOT NULL,
+    approved_by TEXT NOT NULL,
+    approved_at TEXT NOT NULL,
+    PRIMARY KEY (payment_id, position)
+);
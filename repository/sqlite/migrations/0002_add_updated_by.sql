@@ -0,0 +1,2 @@
+-- the subject of the last principal updating the payment
+ALTER TABLE payments ADD COLUMN updated_by TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- the version of the payment, incremented by every update
+ALTER TABLE payments ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,395 @@
+// Package sqlite implements a payments repository storing payments in a
+// normalised SQLite schema of payments, their parties, charges and approvals,
+// which can be queried ad hoc with SQL.
+//
+// The pure-Go driver of modernc.org/sqlite is linked when building with the
+// sqlite tag, keeping the default build free of it.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/repository"
+	"github.com/mysza/paymentsapi/repository/sqlmigrate"
+	"github.com/mysza/paymentsapi/tracing"
+)
+
+// DriverName is the name the SQLite driver is registered with.
+const DriverName = "sqlite"
+
+// ErrNoDriver is returned when the binary was built without the SQLite driver.
+var ErrNoDriver = errors.New("SQLite driver not linked, build with -tags sqlite")
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Open opens the SQLite database in the file, creating it if needed,
+// and migrates its schema to the current version.
+func Open(path string) (*sql.DB, error) {
+	if !driverLinked() {
+		return nil, ErrNoDriver
+	}
+	db, err := sql.Open(DriverName, path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serialises the writes, which SQLite cannot run
+	// concurrently, and keeps in-memory databases alive
+	db.SetMaxOpenConns(1)
+	if err := setup(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func setup(db *sql.DB) error {
+	ctx := context.Background()
+	for _, pragma := range []string{
+		"PRAGMA foreign_keys = ON",
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA journal_mode = WAL",
+	} {
+		if _, err := db.ExecContext(ctx, pragma); err != nil {
+			return fmt.Errorf("%s: %v", pragma, err)
+		}
+	}
+	files, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+	migrations, err := sqlmigrate.Load(files)
+	if err != nil {
+		return err
+	}
+	_, err = sqlmigrate.Apply(ctx, db, migrations)
+	return err
+}
+
+func driverLinked() bool {
+	for _, driver := range sql.Drivers() {
+		if driver == DriverName {
+			return true
+		}
+	}
+	return false
+}
+
+// PaymentsRepository provides access to the payments in the SQLite database.
+type PaymentsRepository struct {
+	db *sql.DB
+}
+
+// New creates a new repository using the SQLite database opened with Open.
+func New(db *sql.DB) *PaymentsRepository {
+	return &PaymentsRepository{db}
+}
+
+// tx runs fn in a transaction traced as a span named after the operation,
+// committing it if fn succeeds.
+func (r *PaymentsRepository) tx(ctx context.Context, operation string, fn func(*sql.Tx) error) (err error) {
+	ctx, span := tracing.Start(ctx, "sqlite.Tx "+operation, trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("db.operation", operation),
+	))
+	defer func() {
+		if err != repository.ErrNotFound {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Add adds a payment to the database.
+func (r *PaymentsRepository) Add(ctx context.Context, payment *domain.Payment) (string, error) {
+	payment.ID = uuid.New().String()
+	payment.Version = 1
+	err := r.tx(ctx, "add", func(tx *sql.Tx) error {
+		return insert(ctx, tx, payment)
+	})
+	if err != nil {
+		return "", err
+	}
+	return payment.ID, nil
+}
+
+// Get retrieves single payment from the database.
+// It returns repository.ErrNotFound if the payment does not exist.
+func (r *PaymentsRepository) Get(ctx context.Context, id string) (*domain.Payment, error) {
+	var payments []*domain.Payment
+	err := r.tx(ctx, "get", func(tx *sql.Tx) error {
+		var err error
+		payments, err = query(ctx, tx, "WHERE id = ?", id)
+		if err == nil && len(payments) == 0 {
+			return repository.ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payments[0], nil
+}
+
+// GetAll retrieves all payments from the database, ordered by their IDs.
+func (r *PaymentsRepository) GetAll(ctx context.Context) ([]*domain.Payment, error) {
+	var payments []*domain.Payment
+	err := r.tx(ctx, "get_all", func(tx *sql.Tx) error {
+		var err error
+		payments, err = query(ctx, tx, "")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// Update stores the payment, replacing the one with the same ID, if its
+// version is the stored one, and increments the version. It returns
+// repository.ErrNotFound if the payment does not exist, e.g. was deleted
+// concurrently, and domain.ErrVersionConflict if it was changed since it was
+// read.
+func (r *PaymentsRepository) Update(ctx context.Context, payment *domain.Payment) error {
+	updated := *payment
+	updated.Version++
+	err := r.tx(ctx, "update", func(tx *sql.Tx) error {
+		var version int64
+		err := tx.QueryRowContext(ctx, `SELECT version FROM payments WHERE id = ?`, payment.ID).Scan(&version)
+		switch {
+		case err == sql.ErrNoRows:
+			return repository.ErrNotFound
+		case err != nil:
+			return err
+		case version != payment.Version:
+			return domain.ErrVersionConflict
+		}
+		if err := remove(ctx, tx, payment.ID); err != nil {
+			return err
+		}
+		return insert(ctx, tx, &updated)
+	})
+	if err != nil {
+		return err
+	}
+	payment.Version = updated.Version
+	return nil
+}
+
+// Delete deletes a payment from the database.
+func (r *PaymentsRepository) Delete(ctx context.Context, id string) error {
+	return r.tx(ctx, "delete", func(tx *sql.Tx) error {
+		return remove(ctx, tx, id)
+	})
+}
+
+// Exists is a helper function to check if payment with give ID exists.
+func (r *PaymentsRepository) Exists(ctx context.Context, id string) bool {
+	var exists bool
+	err := r.tx(ctx, "exists", func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM payments WHERE id = ?)`, id).Scan(&exists)
+	})
+	return err == nil && exists
+}
+
+// Check returns an error if the database cannot be queried.
+func (r *PaymentsRepository) Check(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+// party roles of the parties table
+const (
+	roleBeneficiary = "beneficiary"
+	roleDebtor      = "debtor"
+	roleSponsor     = "sponsor"
+)
+
+func insert(ctx context.Context, tx *sql.Tx, p *domain.Payment) error {
+	a := p.Attributes
+	_, err := tx.ExecContext(ctx, `INSERT INTO payments (
+		id, organisation_id, status, created_by, amount, currency, end_to_end_reference, numeric_reference,
+		payment_id, payment_purpose, payment_scheme, payment_type, processing_date, reference,
+		scheme_payment_type, scheme_payment_sub_type, bearer_code, receiver_charges_amount,
+		receiver_charges_currency, fx_contract_reference, fx_exchange_rate, fx_original_amount, fx_original_currency, updated_by, version
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.ID, p.OrganisationID, p.Status, p.CreatedBy, a.Amount, a.Currency, a.EndToEndReference, a.NumericReference,
+		a.PaymentID, a.PaymentPurpose, a.PaymentScheme, a.PaymentType, a.ProcessingDate, a.Reference,
+		a.SchemePaymentType, a.SchemePaymentSubType, a.ChargesInformation.BearerCode, a.ChargesInformation.ReceiverChargesAmount,
+		a.ChargesInformation.ReceiverChargesCurrency, a.FX.ContractReference, a.FX.ExchangeRate, a.FX.OriginalAmount, a.FX.OriginalCurrency, p.UpdatedBy, p.Version,
+	)
+	if err != nil {
+		return err
+	}
+	parties := []struct {
+		role        string
+		party       domain.PaymentParty
+		accountType int
+	}{
+		{roleBeneficiary, a.Beneficiary.PaymentParty, a.Beneficiary.AccountType},
+		{roleDebtor, a.Debtor, 0},
+		{roleSponsor, domain.PaymentParty{Account: a.Sponsor}, 0},
+	}
+	for _, party := range parties {
+		_, err := tx.ExecContext(ctx, `INSERT INTO parties (
+			payment_id, role, account_number, bank_id, bank_id_code, account_name, account_number_code, account_type, address, name
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.ID, party.role, party.party.AccountNumber, party.party.BankID, party.party.BankIDCode, party.party.AccountName,
+			party.party.AccountNumberCode, party.accountType, party.party.Address, party.party.Name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for position, charge := range a.ChargesInformation.SenderCharges {
+		_, err := tx.ExecContext(ctx, `INSERT INTO charges (payment_id, position, amount, currency) VALUES (?, ?, ?, ?)`,
+			p.ID, position, charge.Amount, charge.Currency)
+		if err != nil {
+			return err
+		}
+	}
+	for position, approval := range p.Approvals {
+		_, err := tx.ExecContext(ctx, `INSERT INTO approvals (payment_id, position, approved_by, approved_at) VALUES (?, ?, ?, ?)`,
+			p.ID, position, approval.ApprovedBy, approval.ApprovedAt.UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remove(ctx context.Context, tx *sql.Tx, id string) error {
+	for _, statement := range []string{
+		`DELETE FROM approvals WHERE payment_id = ?`,
+		`DELETE FROM charges WHERE payment_id = ?`,
+		`DELETE FROM parties WHERE payment_id = ?`,
+		`DELETE FROM payments WHERE id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, statement, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query returns the payments matching the filter, a WHERE clause of the
+// payments table, ordered by their IDs. Rows are read fully before the next
+// query, as the single connection cannot serve two queries at once.
+func query(ctx context.Context, tx *sql.Tx, filter string, args ...interface{}) ([]*domain.Payment, error) {
+	var payments []*domain.Payment
+	byID := map[string]*domain.Payment{}
+	err := scanRows(ctx, tx, `SELECT
+		id, organisation_id, status, created_by, amount, currency, end_to_end_reference, numeric_reference,
+		payment_id, payment_purpose, payment_scheme, payment_type, processing_date, reference,
+		scheme_payment_type, scheme_payment_sub_type, bearer_code, receiver_charges_amount,
+		receiver_charges_currency, fx_contract_reference, fx_exchange_rate, fx_original_amount, fx_original_currency, updated_by, version
+	FROM payments `+filter+` ORDER BY id`, args, func(rows *sql.Rows) error {
+		p := &domain.Payment{}
+		a := &p.Attributes
+		err := rows.Scan(
+			&p.ID, &p.OrganisationID, &p.Status, &p.CreatedBy, &a.Amount, &a.Currency, &a.EndToEndReference, &a.NumericReference,
+			&a.PaymentID, &a.PaymentPurpose, &a.PaymentScheme, &a.PaymentType, &a.ProcessingDate, &a.Reference,
+			&a.SchemePaymentType, &a.SchemePaymentSubType, &a.ChargesInformation.BearerCode, &a.ChargesInformation.ReceiverChargesAmount,
+			&a.ChargesInformation.ReceiverChargesCurrency, &a.FX.ContractReference, &a.FX.ExchangeRate, &a.FX.OriginalAmount, &a.FX.OriginalCurrency, &p.UpdatedBy, &p.Version,
+		)
+		payments = append(payments, p)
+		byID[p.ID] = p
+		return err
+	})
+	if err != nil || len(payments) == 0 {
+		return payments, err
+	}
+	ofPayments := ` WHERE payment_id IN (SELECT id FROM payments ` + filter + `)`
+
+	err = scanRows(ctx, tx, `SELECT
+		payment_id, role, account_number, bank_id, bank_id_code, account_name, account_number_code, account_type, address, name
+	FROM parties`+ofPayments, args, func(rows *sql.Rows) error {
+		var id, role string
+		var party domain.PaymentParty
+		var accountType int
+		err := rows.Scan(&id, &role, &party.AccountNumber, &party.BankID, &party.BankIDCode, &party.AccountName,
+			&party.AccountNumberCode, &accountType, &party.Address, &party.Name)
+		if err != nil {
+			return err
+		}
+		a := &byID[id].Attributes
+		switch role {
+		case roleBeneficiary:
+			a.Beneficiary = domain.BeneficiaryPaymentParty{PaymentParty: party, AccountType: accountType}
+		case roleDebtor:
+			a.Debtor = party
+		case roleSponsor:
+			a.Sponsor = party.Account
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(ctx, tx, `SELECT payment_id, amount, currency FROM charges`+ofPayments+` ORDER BY payment_id, position`, args, func(rows *sql.Rows) error {
+		var id string
+		var charge domain.Charge
+		if err := rows.Scan(&id, &charge.Amount, &charge.Currency); err != nil {
+			return err
+		}
+		charges := &byID[id].Attributes.ChargesInformation.SenderCharges
+		*charges = append(*charges, charge)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(ctx, tx, `SELECT payment_id, approved_by, approved_at FROM approvals`+ofPayments+` ORDER BY payment_id, position`, args, func(rows *sql.Rows) error {
+		var id, approvedAt string
+		var approval domain.Approval
+		if err := rows.Scan(&id, &approval.ApprovedBy, &approvedAt); err != nil {
+			return err
+		}
+		var err error
+		if approval.ApprovedAt, err = time.Parse(time.RFC3339Nano, approvedAt); err != nil {
+			return err
+		}
+		byID[id].Approvals = append(byID[id].Approvals, approval)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// scanRows calls fn for every row of the query.
+func scanRows(ctx context.Context, tx *sql.Tx, query string, args []interface{}, fn func(*sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
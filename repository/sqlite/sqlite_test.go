@@ -0,0 +1,125 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/repository/repositorytest"
+	"github.com/mysza/paymentsapi/repository/sqlmigrate"
+	"github.com/mysza/paymentsapi/service"
+)
+
+func openTestDB(t *testing.T) (*PaymentsRepository, func()) {
+	if !driverLinked() {
+		t.Skip(ErrNoDriver)
+	}
+	dir, err := ioutil.TempDir("", "paymentsapisqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(filepath.Join(dir, "payments.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return New(db), func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) (service.PaymentsRepository, func()) {
+		return openTestDB(t)
+	})
+}
+
+func TestSchema(t *testing.T) {
+	repo, cleanup := openTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	files, _ := os.ReadDir("migrations")
+
+	version, err := sqlmigrate.Version(ctx, repo.db)
+	var indexes []string
+	rows, _ := repo.db.Query(`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'payments' AND sql IS NOT NULL`)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), version, "All migrations must be applied")
+	assert.ElementsMatch(t, []string{"payments_organisation_id", "payments_processing_date"}, indexes)
+	assert.Nil(t, repo.Check(ctx))
+}
+
+func TestMigrateUpdatedBy(t *testing.T) {
+	if !driverLinked() {
+		t.Skip(ErrNoDriver)
+	}
+	dir, err := ioutil.TempDir("", "paymentsapisqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "payments.sqlite")
+	ctx := context.Background()
+
+	// a database created before updated_by was added, holding a payment
+	files, _ := fs.Sub(migrationFiles, "migrations")
+	migrations, err := sqlmigrate.Load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := sql.Open(DriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sqlmigrate.Apply(ctx, old, migrations[:1])
+	if err == nil {
+		_, err = old.Exec(`INSERT INTO payments (
+			id, organisation_id, created_by, amount, currency, end_to_end_reference, numeric_reference,
+			payment_id, payment_purpose, payment_scheme, payment_type, processing_date, reference,
+			scheme_payment_type, scheme_payment_sub_type, bearer_code, receiver_charges_amount,
+			receiver_charges_currency, fx_contract_reference, fx_exchange_rate, fx_original_amount, fx_original_currency
+		) VALUES ('old', 'org', 'creator', '1.00', 'GBP', '', '', '', '', '', '', '2017-01-18', '', '', '', '', '', '', '', '', '', '')`)
+	}
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	repo := New(db)
+	version, versionErr := sqlmigrate.Version(ctx, db)
+	var updatedBy string
+	selectErr := db.QueryRow(`SELECT updated_by FROM payments WHERE id = 'old'`).Scan(&updatedBy)
+	payment := repositorytest.NewPayment(t)
+	payment.UpdatedBy = "updater"
+	id, addErr := repo.Add(ctx, payment)
+	stored, getErr := repo.Get(ctx, id)
+
+	assert.Nil(t, versionErr)
+	assert.Equal(t, len(migrations), version)
+	assert.Nil(t, selectErr)
+	assert.Equal(t, "", updatedBy, "Existing payments must not have an updater")
+	assert.Nil(t, addErr)
+	assert.Nil(t, getErr)
+	if stored != nil {
+		assert.Equal(t, "updater", stored.UpdatedBy)
+	}
+}
@@ -0,0 +1,103 @@
+// Package sqlmigrate applies the schema migrations of the SQL repositories.
+package sqlmigrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migration is a SQL script upgrading the schema to its version.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Load reads the migrations from the .sql files of fsys, named
+// <version>_<description>.sql, ordered by their versions.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, file := range files {
+		prefix := strings.SplitN(file, "_", 2)[0]
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must start with a positive version", file)
+		}
+		script, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{version, file, string(script)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for ix := 1; ix < len(migrations); ix++ {
+		if migrations[ix].Version == migrations[ix-1].Version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[ix-1].Name, migrations[ix].Name)
+		}
+	}
+	return migrations, nil
+}
+
+// DB is a database or a single connection to it, e.g. one holding a lock
+// which serialises the migrations of concurrently started services.
+type DB interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Apply runs the migrations not applied to db yet, each in its own
+// transaction, recording the applied versions in the schema_migrations table.
+// It returns the number of migrations applied.
+func Apply(ctx context.Context, db DB, migrations []Migration) (int, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return 0, err
+	}
+	current, err := Version(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		if err := apply(ctx, db, migration); err != nil {
+			return applied, fmt.Errorf("applying migration %s: %v", migration.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func apply(ctx context.Context, db DB, migration Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+		return err
+	}
+	// the version is an integer, and formatting it avoids placeholders differing between databases
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ("+strconv.Itoa(migration.Version)+")"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Version returns the version of the last migration applied to db.
+func Version(ctx context.Context, db DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	return int(version.Int64), err
+}
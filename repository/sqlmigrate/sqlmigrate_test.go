@@ -0,0 +1,35 @@
+package sqlmigrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	script := &fstest.MapFile{Data: []byte("CREATE TABLE t (id INTEGER)")}
+
+	cases := []struct {
+		name          string
+		files         fstest.MapFS
+		expectedNames []string
+		expectedErr   bool
+	}{
+		{"Ordered by version", fstest.MapFS{"0010_b.sql": script, "0002_a.sql": script, "README": script}, []string{"0002_a.sql", "0010_b.sql"}, false},
+		{"Missing version", fstest.MapFS{"create.sql": script}, nil, true},
+		{"Duplicate version", fstest.MapFS{"0001_a.sql": script, "1_b.sql": script}, nil, true},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			migrations, err := Load(testCase.files)
+
+			var names []string
+			for _, migration := range migrations {
+				names = append(names, migration.Name)
+			}
+			assert.Equal(t, testCase.expectedErr, err != nil)
+			assert.Equal(t, testCase.expectedNames, names)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// ApprovalConfig configures which payments need to be approved
+// before they can proceed, and by how many principals.
+type ApprovalConfig struct {
+	Thresholds        map[string]string // Thresholds maps currencies to amounts above which approval is needed
+	RequiredApprovals int               // RequiredApprovals is the default number of approvals needed
+	Organisations     map[string]int    // Organisations overrides RequiredApprovals per organisation ID
+}
+
+type approvals struct {
+	thresholds    map[string]*big.Rat
+	required      int
+	organisations map[string]int
+	now           func() time.Time
+}
+
+// Validate checks the thresholds are amounts, and the numbers of approvals
+// required by organisations are positive.
+func (config ApprovalConfig) Validate() error {
+	_, err := newApprovals(config)
+	return err
+}
+
+// WithApprovals enables the four-eyes approval workflow for payments
+// above the configured per-currency thresholds. It panics if the
+// configuration is invalid, as reported by its Validate method.
+func WithApprovals(config ApprovalConfig) Option {
+	a, err := newApprovals(config)
+	if err != nil {
+		panic(err)
+	}
+	return func(ps *PaymentsService) {
+		ps.approvals = a
+	}
+}
+
+func newApprovals(config ApprovalConfig) (*approvals, error) {
+	a := &approvals{
+		thresholds:    make(map[string]*big.Rat, len(config.Thresholds)),
+		required:      config.RequiredApprovals,
+		organisations: config.Organisations,
+		now:           time.Now,
+	}
+	if a.required < 1 {
+		a.required = 1
+	}
+	for currency, amount := range config.Thresholds {
+		threshold, ok := new(big.Rat).SetString(amount)
+		if !ok {
+			return nil, fmt.Errorf("approval threshold of %v: invalid amount %q", currency, amount)
+		}
+		a.thresholds[strings.ToUpper(currency)] = threshold
+	}
+	for organisation, required := range config.Organisations {
+		if required < 1 {
+			return nil, fmt.Errorf("approvals required by organisation %v: %d is not positive", organisation, required)
+		}
+	}
+	return a, nil
+}
+
+// defaultApprovals requires no approvals, as no thresholds are configured.
+func defaultApprovals() *approvals {
+	a, _ := newApprovals(ApprovalConfig{})
+	return a
+}
+
+// requiredFor returns the number of approvals the payment of the organisation needs.
+func (a *approvals) requiredFor(organisation string, payment *domain.Payment) int {
+	threshold, found := a.thresholds[strings.ToUpper(payment.Attributes.Currency)]
+	if !found {
+		return 0
+	}
+	amount, ok := new(big.Rat).SetString(payment.Attributes.Amount)
+	if !ok || amount.Cmp(threshold) <= 0 {
+		return 0
+	}
+	if required, found := a.organisations[organisation]; found {
+		return required
+	}
+	return a.required
+}
+
+// updateStatus sets the status of the payment of the organisation based on
+// the approvals collected.
+func (a *approvals) updateStatus(organisation string, payment *domain.Payment) {
+	if len(payment.Approvals) < a.requiredFor(organisation, payment) {
+		payment.Status = domain.StatusPendingApproval
+	} else {
+		payment.Status = domain.StatusAccepted
+	}
+}
+
+// Approve records the approval of the payment with given ID by the calling
+// principal. The principal must differ from the creator of the payment, the
+// last principal who updated it, and principals who already approved it.
+// The approval is stored only if the payment was not changed since it was
+// read, e.g. approved concurrently, and is a ConflictError otherwise.
+func (ps *PaymentsService) Approve(ctx context.Context, id string) (payment *domain.Payment, err error) {
+	ctx, end := startSpan(ctx, "Approve")
+	defer func() {
+		ps.metrics.observe("approve", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionApprove); err != nil {
+		return nil, err
+	}
+	principal, ok := auth.FromContext(ctx)
+	if !ok || principal.Subject == "" {
+		return nil, NewForbiddenError("Approving payments requires an authenticated caller")
+	}
+	payment, getErr := ps.repo.Get(ctx, id)
+	if getErr != nil || !accessible(ctx, payment) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, NewNotFoundError(fmt.Sprintf("Payment with id %v not found", id))
+	}
+	if payment.Status != domain.StatusPendingApproval {
+		return nil, NewConflictError(fmt.Sprintf("Payment with ID %v is not pending approval", id))
+	}
+	if payment.CreatedBy == principal.Subject {
+		return nil, NewForbiddenError("Payments cannot be approved by their creator")
+	}
+	if payment.UpdatedBy == principal.Subject {
+		return nil, NewForbiddenError("Payments cannot be approved by their last modifier")
+	}
+	for _, approval := range payment.Approvals {
+		if approval.ApprovedBy == principal.Subject {
+			return nil, NewConflictError(fmt.Sprintf("Payment with ID %v already approved by %v", id, principal.Subject))
+		}
+	}
+	approval := domain.Approval{
+		ApprovedBy: principal.Subject,
+		ApprovedAt: ps.approvals.now().UTC(),
+	}
+	payment.Approvals = append(payment.Approvals, approval)
+	ps.approvals.updateStatus(organisationOf(ctx, payment), payment)
+	approved := domain.Event{Type: domain.EventPaymentApproved, PaymentID: id, Approval: &approval, Status: payment.Status}
+	if err := ps.save(ctx, payment, []domain.Event{approved}); err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/copier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+func asPrincipal(subject, organisation string) context.Context {
+	return auth.NewContext(context.Background(), &auth.Principal{Subject: subject, OrganisationID: organisation})
+}
+
+func TestApprovals(t *testing.T) {
+	assert := assert.New(t)
+	validPayment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	config := ApprovalConfig{
+		Thresholds:        map[string]string{"gbp": "100.00"},
+		RequiredApprovals: 1,
+		Organisations:     map[string]int{"strict-org": 2},
+	}
+	newPayment := func(amount, organisation string) *domain.Payment {
+		payment := &domain.Payment{}
+		copier.Copy(payment, validPayment)
+		payment.ID = ""
+		payment.Attributes.Amount = amount
+		payment.OrganisationID = organisation
+		return payment
+	}
+
+	t.Run("Payments above threshold are pending approval", func(t *testing.T) {
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Add", mock.Anything, mock.Anything).Return("id", nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+		below := newPayment("100.00", "org")
+		above := newPayment("100.01", "org")
+
+		ps.Add(asPrincipal("creator", "org"), below)
+		ps.Add(asPrincipal("creator", "org"), above)
+
+		assert.Equal(domain.StatusAccepted, below.Status)
+		assert.Equal(domain.StatusPendingApproval, above.Status)
+		assert.Equal("creator", above.CreatedBy)
+	})
+
+	t.Run("Creator cannot approve own payment", func(t *testing.T) {
+		payment := newPayment("500", "org")
+		payment.ID, payment.CreatedBy, payment.Status = "id", "creator", domain.StatusPendingApproval
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		_, err := ps.Approve(asPrincipal("creator", "org"), "id")
+
+		assert.IsType(&ForbiddenError{}, err)
+		repo.AssertExpectations(t)
+	})
+
+	t.Run("Approval by another principal accepts payment", func(t *testing.T) {
+		payment := newPayment("500", "org")
+		payment.ID, payment.CreatedBy, payment.Status = "id", "creator", domain.StatusPendingApproval
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		repo.On("Update", mock.Anything, payment).Return(nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		approved, err := ps.Approve(asPrincipal("approver", "org"), "id")
+
+		assert.Nil(err)
+		assert.Equal(domain.StatusAccepted, approved.Status)
+		assert.Equal("approver", approved.Approvals[0].ApprovedBy)
+		repo.AssertExpectations(t)
+	})
+
+	t.Run("Concurrent approvals conflict", func(t *testing.T) {
+		payment := newPayment("500", "strict-org")
+		payment.ID, payment.CreatedBy, payment.Status = "id", "creator", domain.StatusPendingApproval
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		repo.On("Update", mock.Anything, payment).Return(domain.ErrVersionConflict)
+		repo.On("Exists", mock.Anything, "id").Return(true)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		approved, err := ps.Approve(asPrincipal("approver", "strict-org"), "id")
+
+		assert.Nil(approved)
+		assert.IsType(&ConflictError{}, err)
+		repo.AssertExpectations(t)
+	})
+
+	t.Run("Organisation can require more approvals", func(t *testing.T) {
+		payment := newPayment("500", "strict-org")
+		payment.ID, payment.CreatedBy, payment.Status = "id", "creator", domain.StatusPendingApproval
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		repo.On("Update", mock.Anything, payment).Return(nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		first, err := ps.Approve(asPrincipal("first", "strict-org"), "id")
+		assert.Nil(err)
+		assert.Equal(domain.StatusPendingApproval, first.Status)
+
+		_, err = ps.Approve(asPrincipal("first", "strict-org"), "id")
+		assert.IsType(&ConflictError{}, err, "Same principal cannot approve twice")
+
+		second, err := ps.Approve(asPrincipal("second", "strict-org"), "id")
+		assert.Nil(err)
+		assert.Equal(domain.StatusAccepted, second.Status)
+	})
+
+	t.Run("Approvals required are those of the organisation of the caller", func(t *testing.T) {
+		payment := newPayment("500", "org")
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Add", mock.Anything, payment).Return("id", nil)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		repo.On("Update", mock.Anything, payment).Return(nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		_, addErr := ps.Add(asPrincipal("creator", "strict-org"), payment)
+		payment.ID = "id"
+		approved, approveErr := ps.Approve(asPrincipal("approver", "strict-org"), "id")
+
+		assert.Nil(addErr)
+		assert.Nil(approveErr)
+		assert.Equal("strict-org", payment.OrganisationID)
+		assert.Equal(domain.StatusPendingApproval, approved.Status)
+	})
+
+	t.Run("Last modifier cannot approve the payment", func(t *testing.T) {
+		payment := newPayment("500", "org")
+		payment.ID, payment.CreatedBy, payment.UpdatedBy, payment.Status = "id", "creator", "editor", domain.StatusPendingApproval
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		_, err := ps.Approve(asPrincipal("editor", "org"), "id")
+
+		assert.IsType(&ForbiddenError{}, err)
+		repo.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Invalid configuration is reported", func(t *testing.T) {
+		assert.Nil(config.Validate())
+		assert.Error(ApprovalConfig{Thresholds: map[string]string{"GBP": "1O0"}}.Validate())
+		assert.Error(ApprovalConfig{Organisations: map[string]int{"lax-org": 0}}.Validate())
+		assert.Panics(func() { WithApprovals(ApprovalConfig{Organisations: map[string]int{"lax-org": -1}}) })
+	})
+
+	t.Run("Accepted payments cannot be approved", func(t *testing.T) {
+		payment := newPayment("50", "org")
+		payment.ID, payment.CreatedBy, payment.Status = "id", "creator", domain.StatusAccepted
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(payment, nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		_, err := ps.Approve(asPrincipal("approver", "org"), "id")
+
+		assert.IsType(&ConflictError{}, err)
+	})
+
+	t.Run("Update discards collected approvals", func(t *testing.T) {
+		existing := newPayment("500", "org")
+		existing.ID, existing.CreatedBy, existing.Status = "id", "creator", domain.StatusAccepted
+		existing.Approvals = []domain.Approval{{ApprovedBy: "approver"}}
+		update := newPayment("600", "org")
+		update.ID, update.Status = "id", domain.StatusAccepted
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, "id").Return(existing, nil)
+		repo.On("Update", mock.Anything, update).Return(nil)
+		ps := NewPaymentsService(repo, WithApprovals(config))
+
+		err := ps.Update(asPrincipal("creator", "org"), update)
+
+		assert.Nil(err)
+		assert.Equal(domain.StatusPendingApproval, update.Status)
+		assert.Equal("creator", update.CreatedBy)
+		assert.Equal("creator", update.UpdatedBy)
+		assert.Empty(update.Approvals)
+	})
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mysza/paymentsapi/calendar"
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// CalendarConfig configures the business-day calendars the processing dates
+// of payments must fall on.
+type CalendarConfig struct {
+	Calendars  map[string]*calendar.Calendar // Calendars by name
+	Schemes    map[string]string             // Schemes maps payment schemes to calendar names; schemes mapped to no name process payments every day
+	Currencies map[string]string             // Currencies maps currencies to calendar names, for payments of schemes not mapped
+	Roll       bool                          // Roll moves processing dates to the next business day, rather than rejecting the payments
+}
+
+// Calendars of payment schemes and currencies used unless configured otherwise.
+var (
+	DefaultCalendarSchemes = map[string]string{
+		"FPS":   "", // Faster Payments run every day
+		"BACS":  calendar.UK,
+		"CHAPS": calendar.UK,
+		"SEPA":  calendar.TARGET2,
+	}
+	DefaultCalendarCurrencies = map[string]string{
+		"GBP": calendar.UK,
+		"EUR": calendar.TARGET2,
+	}
+)
+
+// MaxBusinessDaysRange limits the dates business days are listed between.
+const MaxBusinessDaysRange = 366 * 24 * time.Hour
+
+type calendars struct {
+	calendars  map[string]*calendar.Calendar
+	schemes    map[string]string
+	currencies map[string]string
+	roll       bool
+}
+
+// WithCalendars enables checking the processing dates of payments against
+// the calendars of their schemes, or of their currencies.
+func WithCalendars(config CalendarConfig) Option {
+	return func(ps *PaymentsService) {
+		ps.calendars = newCalendars(config)
+	}
+}
+
+func newCalendars(config CalendarConfig) *calendars {
+	c := &calendars{
+		calendars:  make(map[string]*calendar.Calendar, len(config.Calendars)),
+		schemes:    make(map[string]string, len(config.Schemes)),
+		currencies: make(map[string]string, len(config.Currencies)),
+		roll:       config.Roll,
+	}
+	for name, cal := range config.Calendars {
+		c.calendars[strings.ToUpper(name)] = cal
+	}
+	for scheme, name := range config.Schemes {
+		c.schemes[strings.ToUpper(scheme)] = strings.ToUpper(name)
+	}
+	for currency, name := range config.Currencies {
+		c.currencies[strings.ToUpper(currency)] = strings.ToUpper(name)
+	}
+	return c
+}
+
+// forScheme returns the calendar of the scheme, or of the currency for
+// schemes not mapped to calendars. It returns nil for schemes and currencies
+// processing payments every day.
+func (c *calendars) forScheme(scheme, currency string) *calendar.Calendar {
+	name, found := c.schemes[strings.ToUpper(scheme)]
+	if !found {
+		name = c.currencies[strings.ToUpper(currency)]
+	}
+	return c.calendars[name]
+}
+
+// check returns the violation of the processing date of the payment which is
+// not a business day, or rolls it to the next business day if configured.
+// Dates after the holidays of the calendar are known are violations too, as
+// whether they are business days is not known.
+func (c *calendars) check(payment *domain.Payment) []Violation {
+	attributes := &payment.Attributes
+	cal := c.forScheme(attributes.PaymentScheme, attributes.Currency)
+	date, err := time.Parse(calendar.DateLayout, attributes.ProcessingDate)
+	if cal == nil || err != nil {
+		return nil
+	}
+	if !cal.Covers(date) {
+		return []Violation{uncovered(cal)}
+	}
+	if cal.IsBusinessDay(date) {
+		return nil
+	}
+	nextDate := cal.Next(date)
+	if !cal.Covers(nextDate) {
+		return []Violation{uncovered(cal)}
+	}
+	next := nextDate.Format(calendar.DateLayout)
+	if c.roll {
+		attributes.ProcessingDate = next
+		return nil
+	}
+	return []Violation{{
+		Field:   "attributes.processing_date",
+		Rule:    "business_day",
+		Message: fmt.Sprintf("must be a business day of the %s calendar, e.g. %s", cal.Name, next),
+	}}
+}
+
+// uncovered returns the violation of processing dates after the holidays of
+// the calendar are known.
+func uncovered(cal *calendar.Calendar) Violation {
+	return Violation{
+		Field:   "attributes.processing_date",
+		Rule:    "calendar_coverage",
+		Message: fmt.Sprintf("must be at most %s, the last date of the %s calendar", cal.Until().Format(calendar.DateLayout), cal.Name),
+	}
+}
+
+// BusinessDays returns the name of the calendar of the payment scheme and its
+// business days from one date to another, inclusive. Schemes processing
+// payments every day have no calendar, and every day is a business day.
+// Dates after the holidays of the calendar are known are rejected.
+func (ps *PaymentsService) BusinessDays(ctx context.Context, scheme string, from, to time.Time) (name string, days []time.Time, err error) {
+	ctx, end := startSpan(ctx, "BusinessDays")
+	defer func() {
+		ps.metrics.observe("business_days", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionRead); err != nil {
+		return "", nil, err
+	}
+	if ps.calendars == nil {
+		return "", nil, NewNotFoundError("Business-day calendars are not configured")
+	}
+	name, found := ps.calendars.schemes[strings.ToUpper(scheme)]
+	if !found {
+		return "", nil, NewNotFoundError(fmt.Sprintf("Payment scheme %v has no calendar", scheme))
+	}
+	if to.Before(from) || to.Sub(from) > MaxBusinessDaysRange {
+		return "", nil, NewInputError("Dates must be in order and at most a year apart")
+	}
+	cal := ps.calendars.calendars[name]
+	if cal == nil {
+		for date := calendar.Day(from); !date.After(to); date = date.AddDate(0, 0, 1) {
+			days = append(days, date)
+		}
+		return "", days, nil
+	}
+	if !cal.Covers(to) {
+		return "", nil, NewInputError(fmt.Sprintf("Calendar %v covers dates until %v", cal.Name, cal.Until().Format(calendar.DateLayout)))
+	}
+	return cal.Name, cal.BusinessDays(from, to), nil
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/copier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/calendar"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+func TestCalendars(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	validPayment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	calendars, err := calendar.Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := CalendarConfig{
+		Calendars:  calendars,
+		Schemes:    DefaultCalendarSchemes,
+		Currencies: DefaultCalendarCurrencies,
+	}
+	newPayment := func(scheme, currency, date string) *domain.Payment {
+		payment := &domain.Payment{}
+		copier.Copy(payment, validPayment)
+		payment.ID = ""
+		payment.Attributes.PaymentScheme = scheme
+		payment.Attributes.Currency = currency
+		payment.Attributes.ProcessingDate = date
+		return payment
+	}
+	newService := func(config CalendarConfig) *PaymentsService {
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Add", mock.Anything, mock.Anything).Return("id", nil)
+		return NewPaymentsService(repo, WithCalendars(config))
+	}
+
+	t.Run("Processing dates must be business days of the calendar of the scheme or currency", func(t *testing.T) {
+		ps := newService(config)
+		cases := []struct {
+			scheme, currency, date string
+			valid                  bool
+		}{
+			{"Bacs", "GBP", "2018-12-24", true},
+			{"Bacs", "GBP", "2018-12-25", false},
+			{"Bacs", "GBP", "2018-12-29", false},
+			{"FPS", "GBP", "2018-12-25", true},
+			{"SEPA", "EUR", "2018-08-27", true},
+			{"SEPA", "EUR", "2018-05-01", false},
+			{"SWIFT", "GBP", "2018-08-27", false},
+			{"SWIFT", "USD", "2018-08-27", true},
+		}
+		for _, testCase := range cases {
+			_, err := ps.Add(ctx, newPayment(testCase.scheme, testCase.currency, testCase.date))
+
+			if testCase.valid {
+				assert.Nil(err, "%+v", testCase)
+			} else if assert.IsType(&ValidationError{}, err, "%+v", testCase) {
+				assert.Equal("business_day", err.(*ValidationError).Violations[0].Rule)
+			}
+		}
+	})
+
+	t.Run("Processing dates are rolled to the next business day", func(t *testing.T) {
+		rolling := config
+		rolling.Roll = true
+		payment := newPayment("Bacs", "GBP", "2018-12-25")
+
+		_, err := newService(rolling).Add(ctx, payment)
+
+		assert.Nil(err)
+		assert.Equal("2018-12-27", payment.Attributes.ProcessingDate)
+	})
+
+	t.Run("Processing dates after the holidays are known are rejected", func(t *testing.T) {
+		rolling := config
+		rolling.Roll = true
+		covered := newPayment("Bacs", "GBP", "2027-12-31")
+		uncovered := newPayment("Bacs", "GBP", "2028-01-04")
+		weekend := newPayment("SEPA", "EUR", "2028-01-01")
+
+		_, coveredErr := newService(config).Add(ctx, covered)
+		_, uncoveredErr := newService(config).Add(ctx, uncovered)
+		_, weekendErr := newService(rolling).Add(ctx, weekend)
+		_, _, daysErr := newService(config).BusinessDays(ctx, "Bacs", time.Date(2027, 12, 20, 0, 0, 0, 0, time.UTC), time.Date(2028, 1, 10, 0, 0, 0, 0, time.UTC))
+
+		assert.Nil(coveredErr)
+		for _, err := range []error{uncoveredErr, weekendErr} {
+			if assert.IsType(&ValidationError{}, err) {
+				assert.Equal("calendar_coverage", err.(*ValidationError).Violations[0].Rule)
+			}
+		}
+		assert.IsType(&InputError{}, daysErr)
+	})
+
+	t.Run("Processing dates must be ISO dates", func(t *testing.T) {
+		err := newService(config).Validate(newPayment("Bacs", "GBP", "25/12/2018"))
+
+		if assert.IsType(&ValidationError{}, err) {
+			assert.Equal("date", err.(*ValidationError).Violations[0].Rule)
+		}
+	})
+
+	t.Run("Business days of schemes", func(t *testing.T) {
+		ps := newService(config)
+		from := time.Date(2018, 12, 24, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2018, 12, 27, 0, 0, 0, 0, time.UTC)
+
+		name, bacs, err := ps.BusinessDays(ctx, "bacs", from, to)
+		_, fps, _ := ps.BusinessDays(ctx, "FPS", from, to)
+		_, _, unknownErr := ps.BusinessDays(ctx, "SWIFT", from, to)
+		_, _, rangeErr := ps.BusinessDays(ctx, "FPS", to, from)
+		_, _, disabledErr := NewPaymentsService(nil).BusinessDays(ctx, "FPS", from, to)
+
+		assert.Nil(err)
+		assert.Equal(calendar.UK, name)
+		assert.Equal([]time.Time{from, to}, bacs)
+		assert.Len(fps, 4)
+		assert.IsType(&NotFoundError{}, unknownErr)
+		assert.IsType(&InputError{}, rangeErr)
+		assert.IsType(&NotFoundError{}, disabledErr)
+	})
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// Bearer codes, deciding who bears the charges of payments.
+const (
+	BearerDebtor         = "DEBT" // BearerDebtor bears the charges of both sides
+	BearerCreditor       = "CRED" // BearerCreditor bears the charges of both sides, deducted from the amount received
+	BearerShared         = "SHAR" // BearerShared shares the charges, each side bearing its own
+	BearerServiceLevel   = "SLEV" // BearerServiceLevel follows the service level of the scheme, sharing the charges
+	chargeDecimals       = 2
+	chargesInformationAt = "attributes.charges_information"
+)
+
+var bearerCodes = []string{BearerDebtor, BearerCreditor, BearerShared, BearerServiceLevel}
+
+// Fee is a flat fee plus a percentage of the amount of payments, limited by
+// a minimum and a maximum. Amounts are in the currency of the payments.
+type Fee struct {
+	Flat       string `mapstructure:"flat"`       // Flat is charged for every payment
+	Percentage string `mapstructure:"percentage"` // Percentage of the amount is charged on top of the flat fee
+	Min        string `mapstructure:"min"`        // Min is the least charged; empty is no minimum
+	Max        string `mapstructure:"max"`        // Max is the most charged; empty is no maximum
+}
+
+// Tariff is the fees of both sides of payments.
+type Tariff struct {
+	Sender   Fee `mapstructure:"sender"`   // Sender is the fee of the sending side
+	Receiver Fee `mapstructure:"receiver"` // Receiver is the fee of the receiving side
+}
+
+// Tariffs are tariffs by payment scheme, then by currency.
+type Tariffs map[string]map[string]Tariff
+
+// TariffConfig configures the tariffs the charges of payments are calculated with.
+type TariffConfig struct {
+	Tariffs       Tariffs            `mapstructure:"tariffs"`       // Tariffs of organisations not configured otherwise
+	Organisations map[string]Tariffs `mapstructure:"organisations"` // Organisations overrides Tariffs per organisation ID
+}
+
+type charges struct {
+	tariffs       tariffs
+	organisations map[string]tariffs
+}
+
+// tariffs are the tariffs by upper case payment scheme, then currency, with
+// their fees parsed.
+type tariffs map[string]map[string]tariff
+
+type tariff struct {
+	sender, receiver fee
+}
+
+// fee is a parsed Fee, where nil limits are no limits.
+type fee struct {
+	flat, percentage, min, max *big.Rat
+}
+
+// Validate checks the fees of the tariffs are non-negative amounts.
+func (config TariffConfig) Validate() error {
+	_, err := newCharges(config)
+	return err
+}
+
+// WithTariffs enables calculating the charges of payments, filling them in
+// for payments submitted without them, and checking those submitted.
+// Payments without a tariff are charged nothing. It panics if the
+// configuration is invalid, as reported by its Validate method.
+func WithTariffs(config TariffConfig) Option {
+	c, err := newCharges(config)
+	if err != nil {
+		panic(err)
+	}
+	return func(ps *PaymentsService) {
+		ps.charges = c
+	}
+}
+
+func newCharges(config TariffConfig) (*charges, error) {
+	parsed, err := parseTariffs("", config.Tariffs)
+	if err != nil {
+		return nil, err
+	}
+	c := &charges{
+		tariffs:       parsed,
+		organisations: make(map[string]tariffs, len(config.Organisations)),
+	}
+	for organisation, organisationTariffs := range config.Organisations {
+		if c.organisations[organisation], err = parseTariffs(organisation, organisationTariffs); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// parseTariffs returns the tariffs of the organisation, if any, with the
+// schemes and currencies in upper case.
+func parseTariffs(organisation string, config Tariffs) (tariffs, error) {
+	parsed := make(tariffs, len(config))
+	for scheme, currencies := range config {
+		parsed[strings.ToUpper(scheme)] = make(map[string]tariff, len(currencies))
+		for currency, configured := range currencies {
+			name := fmt.Sprintf("tariff of %v in %v", scheme, currency)
+			if organisation != "" {
+				name = fmt.Sprintf("%v of organisation %v", name, organisation)
+			}
+			sender, err := configured.Sender.parse()
+			if err != nil {
+				return nil, fmt.Errorf("sender %v: %v", name, err)
+			}
+			receiver, err := configured.Receiver.parse()
+			if err != nil {
+				return nil, fmt.Errorf("receiver %v: %v", name, err)
+			}
+			parsed[strings.ToUpper(scheme)][strings.ToUpper(currency)] = tariff{sender: sender, receiver: receiver}
+		}
+	}
+	return parsed, nil
+}
+
+// parse returns the fee with its amounts parsed, where empty flat fees and
+// percentages are zero, and empty limits are no limits.
+func (f Fee) parse() (fee, error) {
+	var parsed fee
+	for _, amount := range []struct {
+		name, value string
+		parsed      **big.Rat
+		optional    bool
+	}{
+		{"flat", f.Flat, &parsed.flat, false},
+		{"percentage", f.Percentage, &parsed.percentage, false},
+		{"min", f.Min, &parsed.min, true},
+		{"max", f.Max, &parsed.max, true},
+	} {
+		if amount.value == "" {
+			if !amount.optional {
+				*amount.parsed = new(big.Rat)
+			}
+			continue
+		}
+		value, ok := new(big.Rat).SetString(amount.value)
+		if !ok || value.Sign() < 0 {
+			return fee{}, fmt.Errorf("%v: invalid amount %q", amount.name, amount.value)
+		}
+		*amount.parsed = value
+	}
+	if parsed.min != nil && parsed.max != nil && parsed.min.Cmp(parsed.max) > 0 {
+		return fee{}, fmt.Errorf("min %v exceeds max %v", f.Min, f.Max)
+	}
+	return parsed, nil
+}
+
+// tariff returns the tariff of the organisation for payments of the scheme
+// in the currency, if any.
+func (c *charges) tariff(organisation, scheme, currency string) (tariff, bool) {
+	scheme, currency = strings.ToUpper(scheme), strings.ToUpper(currency)
+	if found, ok := c.organisations[organisation][scheme][currency]; ok {
+		return found, true
+	}
+	found, ok := c.tariffs[scheme][currency]
+	return found, ok
+}
+
+// calculate returns the charges of the payment of the organisation, borne as
+// its bearer code decides, or the violations preventing their calculation.
+func (c *charges) calculate(organisation string, payment *domain.Payment) (*domain.ChargesInformation, []Violation) {
+	attributes := &payment.Attributes
+	var v violations
+	bearer := attributes.ChargesInformation.BearerCode
+	if !contains(bearerCodes, bearer) {
+		v.add(chargesInformationAt+".bearer_code", "bearer_code", "must be one of %s", strings.Join(bearerCodes, ", "))
+	}
+	amount, ok := new(big.Rat).SetString(attributes.Amount)
+	if !ok {
+		v.add("attributes.amount", "numeric", "must be numeric")
+	}
+	if len(v) > 0 {
+		return nil, v
+	}
+	sender, receiver := new(big.Rat), new(big.Rat)
+	if tariff, found := c.tariff(organisation, attributes.PaymentScheme, attributes.Currency); found {
+		sender, receiver = tariff.sender.charge(amount), tariff.receiver.charge(amount)
+	}
+	switch bearer {
+	case BearerDebtor:
+		sender, receiver = sender.Add(sender, receiver), new(big.Rat)
+	case BearerCreditor:
+		sender, receiver = new(big.Rat), receiver.Add(sender, receiver)
+	}
+	currency := strings.ToUpper(attributes.Currency)
+	return &domain.ChargesInformation{
+		BearerCode:              bearer,
+		SenderCharges:           []domain.Charge{{Amount: sender.FloatString(chargeDecimals), Currency: currency}},
+		ReceiverChargesAmount:   receiver.FloatString(chargeDecimals),
+		ReceiverChargesCurrency: currency,
+	}, nil
+}
+
+// charge returns the fee charged for the amount.
+func (f *fee) charge(amount *big.Rat) *big.Rat {
+	charged := new(big.Rat).Set(f.flat)
+	charged.Add(charged, new(big.Rat).Mul(amount, new(big.Rat).Quo(f.percentage, big.NewRat(100, 1))))
+	if f.min != nil && charged.Cmp(f.min) < 0 {
+		charged.Set(f.min)
+	}
+	if f.max != nil && charged.Cmp(f.max) > 0 {
+		charged.Set(f.max)
+	}
+	return round(charged, chargeDecimals, RoundHalfUp)
+}
+
+// fill fills in the charges of payments of the organisation submitted without them.
+func (c *charges) fill(organisation string, payment *domain.Payment) {
+	information := &payment.Attributes.ChargesInformation
+	if len(information.SenderCharges) > 0 || information.ReceiverChargesAmount != "" {
+		return
+	}
+	if calculated, invalid := c.calculate(organisation, payment); len(invalid) == 0 {
+		*information = *calculated
+	}
+}
+
+// check returns the violations of the charges of the payment of the
+// organisation which differ from the calculated ones: all charges must be in
+// the currency of the payment, and sum up to the calculated ones.
+func (c *charges) check(organisation string, payment *domain.Payment) []Violation {
+	calculated, invalid := c.calculate(organisation, payment)
+	if len(invalid) > 0 {
+		return invalid
+	}
+	var v violations
+	information := &payment.Attributes.ChargesInformation
+	currency := calculated.ReceiverChargesCurrency
+	sender := new(big.Rat)
+	senderValid := true
+	for _, charge := range information.SenderCharges {
+		amount, ok := new(big.Rat).SetString(charge.Amount)
+		senderValid = senderValid && ok && strings.EqualFold(charge.Currency, currency)
+		if ok {
+			sender.Add(sender, amount)
+		}
+	}
+	expected := calculated.SenderCharges[0].Amount
+	if !senderValid || sender.FloatString(chargeDecimals) != expected {
+		v.add(chargesInformationAt+".sender_charges", "charges", "must total %s %s", expected, currency)
+	}
+	receiver, ok := new(big.Rat).SetString(information.ReceiverChargesAmount)
+	if !ok || receiver.FloatString(chargeDecimals) != calculated.ReceiverChargesAmount {
+		v.add(chargesInformationAt+".receiver_charges_amount", "charges", "must be %s", calculated.ReceiverChargesAmount)
+	}
+	if !strings.EqualFold(information.ReceiverChargesCurrency, currency) {
+		v.add(chargesInformationAt+".receiver_charges_currency", "charges", "must be %s", currency)
+	}
+	return v
+}
+
+// Quote returns the charges of the payment, calculated as they would be if it
+// was added by the caller, without adding it. Payments submitted with only the original
+// amount and currency of their FX get the exchange rate quoted first.
+func (ps *PaymentsService) Quote(ctx context.Context, payment *domain.Payment) (quoted *domain.Payment, err error) {
+	ctx, end := startSpan(ctx, "Quote")
+	defer func() {
+		ps.metrics.observe("quote", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionRead); err != nil {
+		return nil, err
+	}
+	if ps.charges == nil {
+		return nil, NewNotFoundError("Charges of payments are not calculated")
+	}
+	if payment == nil {
+		return nil, NewInputError("Payment is nil")
+	}
+	if ps.fx != nil {
+		if err := ps.fx.quote(ctx, payment); err != nil {
+			return nil, err
+		}
+	}
+	var v violations
+	if payment.Attributes.Currency == "" {
+		v.add("attributes.currency", "required", "is required")
+	}
+	calculated, invalid := ps.charges.calculate(organisationOf(ctx, payment), payment)
+	v = append(v, invalid...)
+	if len(v) > 0 {
+		return nil, &ValidationError{Violations: v}
+	}
+	payment.Attributes.ChargesInformation = *calculated
+	return payment, nil
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/copier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+func TestCharges(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	validPayment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	config := TariffConfig{
+		Tariffs: Tariffs{"fps": {"gbp": {
+			Sender:   Fee{Flat: "0.50", Percentage: "0.1", Min: "0.60", Max: "5"},
+			Receiver: Fee{Flat: "0.25"},
+		}}},
+		Organisations: map[string]Tariffs{"7f172e5a-5e4c-4d3a-8b2e-0c5d1f3a9b11": {"FPS": {"GBP": {
+			Receiver: Fee{Flat: "0.10"},
+		}}}},
+	}
+	newPayment := func(amount, bearer string) *domain.Payment {
+		payment := &domain.Payment{}
+		copier.Copy(payment, validPayment)
+		payment.ID = ""
+		payment.Attributes.Amount = amount
+		payment.Attributes.ChargesInformation = domain.ChargesInformation{BearerCode: bearer}
+		return payment
+	}
+	newService := func(config TariffConfig) *PaymentsService {
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Add", mock.Anything, mock.Anything).Return("id", nil)
+		return NewPaymentsService(repo, WithTariffs(config))
+	}
+
+	t.Run("Charges are borne as the bearer code decides", func(t *testing.T) {
+		ps := newService(config)
+		cases := []struct {
+			amount, bearer   string
+			sender, receiver string
+		}{
+			{"1000", BearerDebtor, "1.75", "0.00"},
+			{"1000", BearerCreditor, "0.00", "1.75"},
+			{"1000", BearerShared, "1.50", "0.25"},
+			{"1000", BearerServiceLevel, "1.50", "0.25"},
+			{"10", BearerShared, "0.60", "0.25"},
+			{"10000", BearerShared, "5.00", "0.25"},
+		}
+		for _, testCase := range cases {
+			quoted, err := ps.Quote(ctx, newPayment(testCase.amount, testCase.bearer))
+
+			if assert.Nil(err, "%+v", testCase) {
+				charges := quoted.Attributes.ChargesInformation
+				assert.Equal([]domain.Charge{{Amount: testCase.sender, Currency: "GBP"}}, charges.SenderCharges, "%+v", testCase)
+				assert.Equal(testCase.receiver, charges.ReceiverChargesAmount, "%+v", testCase)
+				assert.Equal("GBP", charges.ReceiverChargesCurrency, "%+v", testCase)
+			}
+		}
+	})
+
+	t.Run("Organisations override the tariffs, and payments without tariffs are charged nothing", func(t *testing.T) {
+		ps := newService(config)
+		overridden := newPayment("1000", BearerShared)
+		overridden.OrganisationID = "7f172e5a-5e4c-4d3a-8b2e-0c5d1f3a9b11"
+		untariffed := newPayment("1000", BearerShared)
+		untariffed.Attributes.PaymentScheme = "Bacs"
+
+		overridden, overriddenErr := ps.Quote(ctx, overridden)
+		untariffed, untariffedErr := ps.Quote(ctx, untariffed)
+
+		assert.Nil(overriddenErr)
+		assert.Equal("0.00", overridden.Attributes.ChargesInformation.SenderCharges[0].Amount)
+		assert.Equal("0.10", overridden.Attributes.ChargesInformation.ReceiverChargesAmount)
+		assert.Nil(untariffedErr)
+		assert.Equal("0.00", untariffed.Attributes.ChargesInformation.SenderCharges[0].Amount)
+		assert.Equal("0.00", untariffed.Attributes.ChargesInformation.ReceiverChargesAmount)
+	})
+
+	t.Run("Tariffs of authenticated callers are the ones of their organisation", func(t *testing.T) {
+		ps := newService(config)
+		caller := auth.NewContext(ctx, &auth.Principal{Subject: "clerk", OrganisationID: "other-org"})
+		claimed := newPayment("1000", BearerShared)
+		claimed.OrganisationID = "7f172e5a-5e4c-4d3a-8b2e-0c5d1f3a9b11"
+
+		quoted, err := ps.Quote(caller, claimed)
+
+		assert.Nil(err)
+		assert.Equal("0.25", quoted.Attributes.ChargesInformation.ReceiverChargesAmount)
+	})
+
+	t.Run("Invalid fees are rejected", func(t *testing.T) {
+		for _, invalid := range []Fee{{Flat: "half"}, {Percentage: "-1"}, {Min: "1,00"}, {Max: "none"}, {Min: "5", Max: "1"}} {
+			err := TariffConfig{Organisations: map[string]Tariffs{"org": {"FPS": {"GBP": {Sender: invalid}}}}}.Validate()
+
+			assert.Error(err, "%+v", invalid)
+			assert.Panics(func() { WithTariffs(TariffConfig{Tariffs: Tariffs{"FPS": {"GBP": {Receiver: invalid}}}}) }, "%+v", invalid)
+		}
+		assert.Nil(config.Validate())
+	})
+
+	t.Run("Charges of payments added without them are calculated", func(t *testing.T) {
+		payment := newPayment("1000", BearerShared)
+
+		_, err := newService(config).Add(ctx, payment)
+
+		assert.Nil(err)
+		assert.Equal("1.50", payment.Attributes.ChargesInformation.SenderCharges[0].Amount)
+		assert.Equal("0.25", payment.Attributes.ChargesInformation.ReceiverChargesAmount)
+	})
+
+	t.Run("Charges submitted must be the calculated ones", func(t *testing.T) {
+		ps := newService(config)
+		matching := newPayment("1000", BearerShared)
+		matching.Attributes.ChargesInformation.SenderCharges = []domain.Charge{{Amount: "1", Currency: "GBP"}, {Amount: "0.5", Currency: "gbp"}}
+		matching.Attributes.ChargesInformation.ReceiverChargesAmount = "0.25"
+		matching.Attributes.ChargesInformation.ReceiverChargesCurrency = "GBP"
+		differing := &domain.Payment{}
+		copier.Copy(differing, validPayment)
+		differing.ID = ""
+
+		_, matchingErr := ps.Add(ctx, matching)
+		_, differingErr := ps.Add(ctx, differing)
+
+		assert.Nil(matchingErr)
+		if assert.IsType(&ValidationError{}, differingErr) {
+			assert.Equal([]Violation{
+				{Field: "attributes.charges_information.sender_charges", Rule: "charges", Message: "must total 0.60 GBP"},
+				{Field: "attributes.charges_information.receiver_charges_amount", Rule: "charges", Message: "must be 0.25"},
+				{Field: "attributes.charges_information.receiver_charges_currency", Rule: "charges", Message: "must be GBP"},
+			}, differingErr.(*ValidationError).Violations)
+		}
+	})
+
+	t.Run("Quotes need a bearer code and an amount", func(t *testing.T) {
+		_, invalidErr := newService(config).Quote(ctx, newPayment("many", "OUR"))
+		_, disabledErr := NewPaymentsService(nil).Quote(ctx, newPayment("1000", BearerShared))
+
+		if assert.IsType(&ValidationError{}, invalidErr) {
+			violations := invalidErr.(*ValidationError).Violations
+			assert.Equal("bearer_code", violations[0].Rule)
+			assert.Equal("attributes.amount", violations[1].Field)
+		}
+		assert.IsType(&NotFoundError{}, disabledErr)
+	})
+}
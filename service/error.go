@@ -1,5 +1,7 @@
 package service
 
+import "strings"
+
 // InputError indicates that there was something wrong with the input.
 type InputError struct {
 	message string
@@ -14,6 +16,26 @@ func NewInputError(message string) *InputError {
 	return &InputError{message: message}
 }
 
+// Violation describes a rule violated by a field of a payment.
+type Violation struct {
+	Field   string `json:"field"`   // Field is the path of the field in the JSON representation of the payment
+	Rule    string `json:"rule"`    // Rule names the violated rule
+	Message string `json:"message"` // Message explains the rule
+}
+
+// ValidationError indicates that the payment violates the validation rules.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for ix, violation := range e.Violations {
+		messages[ix] = violation.Field + " " + violation.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
 // NotFoundError indicates that the request failed because element was not found.
 type NotFoundError struct {
 	message string
@@ -27,3 +49,31 @@ func (e *NotFoundError) Error() string {
 func NewNotFoundError(message string) *NotFoundError {
 	return &NotFoundError{message: message}
 }
+
+// ForbiddenError indicates that the caller is not allowed to perform the operation.
+type ForbiddenError struct {
+	message string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.message
+}
+
+// NewForbiddenError creates a new ForbiddenError.
+func NewForbiddenError(message string) *ForbiddenError {
+	return &ForbiddenError{message: message}
+}
+
+// ConflictError indicates that the operation conflicts with the current state of the resource.
+type ConflictError struct {
+	message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.message
+}
+
+// NewConflictError creates a new ConflictError.
+func NewConflictError(message string) *ConflictError {
+	return &ConflictError{message: message}
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// FXRateProvider quotes exchange rates, for payments submitted without them.
+type FXRateProvider interface {
+	// Quote returns the rate converting amounts in the original currency
+	// into the currency, or ErrNoFXRate if it is not quoted.
+	Quote(ctx context.Context, originalCurrency, currency string) (*FXQuote, error)
+}
+
+// FXQuote is an exchange rate quoted by an FXRateProvider.
+type FXQuote struct {
+	Rate              string // Rate converts amounts in the original currency into the currency
+	ContractReference string // ContractReference identifies the quote with the provider
+}
+
+// ErrNoFXRate is returned by FXRateProviders for pairs of currencies they do not quote.
+var ErrNoFXRate = errors.New("no exchange rate quoted")
+
+// Rounding is a mode of rounding amounts.
+type Rounding string
+
+// Rounding modes of amounts.
+const (
+	RoundHalfUp   Rounding = "half_up"   // RoundHalfUp rounds halves away from zero
+	RoundHalfEven Rounding = "half_even" // RoundHalfEven rounds halves to the even neighbour
+	RoundDown     Rounding = "down"      // RoundDown truncates towards zero
+)
+
+// ParseRounding returns the rounding mode with the name.
+func ParseRounding(name string) (Rounding, error) {
+	for _, rounding := range []Rounding{RoundHalfUp, RoundHalfEven, RoundDown} {
+		if string(rounding) == name {
+			return rounding, nil
+		}
+	}
+	return "", fmt.Errorf("unknown rounding %q", name)
+}
+
+// FXConfig configures the checks of the FX of payments, that the amount is
+// the original amount converted at the exchange rate.
+type FXConfig struct {
+	Tolerance string         // Tolerance is the largest difference allowed between the amount and the converted original amount, e.g. 0.01
+	Decimals  int            // Decimals is the number of decimal places converted amounts are rounded to
+	Rounding  Rounding       // Rounding is the mode of rounding converted amounts, RoundHalfUp by default
+	Provider  FXRateProvider // Provider quotes the rates of payments submitted without them; nil requires clients to submit them
+}
+
+type fx struct {
+	tolerance *big.Rat
+	decimals  int
+	rounding  Rounding
+	provider  FXRateProvider
+}
+
+// Validate checks the tolerance is a non-negative amount, empty for none, and
+// the decimal places are not negative.
+func (config FXConfig) Validate() error {
+	_, err := newFX(config)
+	return err
+}
+
+// WithFX enables the checks of the FX of payments, and quoting the rates of
+// payments submitted with only the original amount and currency. It panics
+// if the configuration is invalid, as reported by its Validate method.
+func WithFX(config FXConfig) Option {
+	f, err := newFX(config)
+	if err != nil {
+		panic(err)
+	}
+	return func(ps *PaymentsService) {
+		ps.fx = f
+	}
+}
+
+func newFX(config FXConfig) (*fx, error) {
+	f := &fx{
+		tolerance: new(big.Rat),
+		decimals:  config.Decimals,
+		rounding:  config.Rounding,
+		provider:  config.Provider,
+	}
+	if config.Tolerance != "" {
+		tolerance, ok := new(big.Rat).SetString(config.Tolerance)
+		if !ok || tolerance.Sign() < 0 {
+			return nil, fmt.Errorf("FX tolerance: invalid amount %q", config.Tolerance)
+		}
+		f.tolerance = tolerance
+	}
+	if f.decimals < 0 {
+		return nil, fmt.Errorf("FX decimals: %d is negative", config.Decimals)
+	}
+	if f.rounding == "" {
+		f.rounding = RoundHalfUp
+	}
+	return f, nil
+}
+
+// convert returns the original amount converted at the rate, rounded.
+func (f *fx) convert(originalAmount, rate *big.Rat) *big.Rat {
+	return round(new(big.Rat).Mul(originalAmount, rate), f.decimals, f.rounding)
+}
+
+// quote fills in the exchange rate and the contract reference of payments
+// submitted with only the original amount and currency, and the amount if it
+// is missing too. Pairs of currencies the provider does not quote are
+// reported as violations.
+func (f *fx) quote(ctx context.Context, payment *domain.Payment) error {
+	attributes := &payment.Attributes
+	if f.provider == nil || attributes.FX.ExchangeRate != "" ||
+		attributes.FX.OriginalAmount == "" || attributes.FX.OriginalCurrency == "" || attributes.Currency == "" {
+		return nil
+	}
+	originalAmount, ok := new(big.Rat).SetString(attributes.FX.OriginalAmount)
+	if !ok {
+		// reported by the validation
+		return nil
+	}
+	quote, err := f.provider.Quote(ctx, strings.ToUpper(attributes.FX.OriginalCurrency), strings.ToUpper(attributes.Currency))
+	if err == ErrNoFXRate {
+		return &ValidationError{Violations: []Violation{{
+			Field:   "attributes.fx.original_currency",
+			Rule:    "fx_rate",
+			Message: fmt.Sprintf("has no exchange rate quoted into %s", attributes.Currency),
+		}}}
+	}
+	if err != nil {
+		return fmt.Errorf("quoting exchange rate: %v", err)
+	}
+	rate, ok := new(big.Rat).SetString(quote.Rate)
+	if !ok {
+		return fmt.Errorf("quoting exchange rate: invalid rate %q", quote.Rate)
+	}
+	attributes.FX.ExchangeRate = quote.Rate
+	attributes.FX.ContractReference = quote.ContractReference
+	if attributes.Amount == "" {
+		attributes.Amount = f.convert(originalAmount, rate).FloatString(f.decimals)
+	}
+	return nil
+}
+
+// check returns the violations of the FX of the payment: the original
+// currency must differ from the currency, and the amount must be the
+// original amount converted at the exchange rate, within the tolerance.
+func (f *fx) check(payment *domain.Payment) []Violation {
+	attributes := &payment.Attributes
+	var v violations
+	if strings.EqualFold(attributes.FX.OriginalCurrency, attributes.Currency) {
+		v.add("attributes.fx.original_currency", "fx_currency", "must differ from the currency")
+	}
+	rate, rateOK := new(big.Rat).SetString(attributes.FX.ExchangeRate)
+	if rateOK && rate.Sign() <= 0 {
+		v.add("attributes.fx.exchange_rate", "fx_rate", "must be positive")
+		return v
+	}
+	originalAmount, originalOK := new(big.Rat).SetString(attributes.FX.OriginalAmount)
+	amount, amountOK := new(big.Rat).SetString(attributes.Amount)
+	if !rateOK || !originalOK || !amountOK {
+		// reported by the validation
+		return v
+	}
+	converted := f.convert(originalAmount, rate)
+	difference := new(big.Rat).Sub(amount, converted)
+	if difference.Abs(difference).Cmp(f.tolerance) > 0 {
+		v.add("attributes.amount", "fx_amount", "must be the original amount converted at the exchange rate, %s, within %s",
+			converted.FloatString(f.decimals), f.tolerance.FloatString(f.decimals))
+	}
+	return v
+}
+
+// round rounds the number to the decimal places in the rounding mode.
+func round(number *big.Rat, decimals int, rounding Rounding) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	scaled := new(big.Rat).Mul(number, new(big.Rat).SetInt(scale))
+	quotient, remainder := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if remainder.Sign() != 0 && rounding != RoundDown {
+		// compare the fraction dropped with a half
+		twice := new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2))
+		half := twice.Cmp(scaled.Denom())
+		if half > 0 || half == 0 && (rounding == RoundHalfUp || quotient.Bit(0) == 1) {
+			quotient.Add(quotient, big.NewInt(int64(scaled.Sign())))
+		}
+	}
+	return new(big.Rat).SetFrac(quotient, scale)
+}
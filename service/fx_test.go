@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/copier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+// fakeRates quotes the rate from USD into GBP, and fails for EUR.
+type fakeRates struct{}
+
+func (fakeRates) Quote(ctx context.Context, originalCurrency, currency string) (*FXQuote, error) {
+	switch {
+	case originalCurrency == "USD" && currency == "GBP":
+		return &FXQuote{Rate: "0.7512", ContractReference: "FX42"}, nil
+	case originalCurrency == "EUR":
+		return nil, errors.New("provider unavailable")
+	}
+	return nil, ErrNoFXRate
+}
+
+func TestFX(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	validPayment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	config := FXConfig{Tolerance: "0.01", Decimals: 2, Provider: fakeRates{}}
+	newPayment := func(amount, originalAmount, rate string) *domain.Payment {
+		payment := &domain.Payment{}
+		copier.Copy(payment, validPayment)
+		payment.ID = ""
+		payment.Attributes.Amount = amount
+		payment.Attributes.FX.OriginalAmount = originalAmount
+		payment.Attributes.FX.ExchangeRate = rate
+		return payment
+	}
+	newService := func(config FXConfig) *PaymentsService {
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Add", mock.Anything, mock.Anything).Return("id", nil)
+		return NewPaymentsService(repo, WithFX(config))
+	}
+	rules := func(err error) map[string]string {
+		invalid, ok := err.(*ValidationError)
+		if !ok {
+			return nil
+		}
+		rules := map[string]string{}
+		for _, violation := range invalid.Violations {
+			rules[violation.Field] = violation.Rule
+		}
+		return rules
+	}
+
+	t.Run("Amounts must be the original amounts converted at the exchange rate", func(t *testing.T) {
+		ps := newService(config)
+		cases := []struct {
+			amount, originalAmount, rate string
+			valid                        bool
+		}{
+			{"400.84", "200.42", "2.00000", true},
+			{"400.85", "200.42", "2.00000", true},
+			{"400.86", "200.42", "2.00000", false},
+			{"100.21", "200.42", "2.00000", false},
+			{"0.50", "1", "0.5", true},
+		}
+		for _, testCase := range cases {
+			_, err := ps.Add(ctx, newPayment(testCase.amount, testCase.originalAmount, testCase.rate))
+
+			if testCase.valid {
+				assert.Nil(err, "%+v", testCase)
+			} else {
+				assert.Equal(map[string]string{"attributes.amount": "fx_amount"}, rules(err), "%+v", testCase)
+			}
+		}
+	})
+
+	t.Run("Original currencies must differ and rates must be positive", func(t *testing.T) {
+		payment := newPayment("0.00", "200.42", "-2")
+		payment.Attributes.FX.OriginalCurrency = "GBP"
+
+		err := newService(config).Validate(payment)
+
+		assert.Equal(map[string]string{
+			"attributes.fx.original_currency": "fx_currency",
+			"attributes.fx.exchange_rate":     "fx_rate",
+		}, rules(err))
+		assert.Contains(err.Error(), "must differ from the currency")
+	})
+
+	t.Run("Rates of payments submitted with only the original amount are quoted", func(t *testing.T) {
+		payment := newPayment("", "100.00", "")
+		payment.Attributes.FX.ContractReference = ""
+
+		_, err := newService(config).Add(ctx, payment)
+
+		assert.Nil(err)
+		assert.Equal(domain.FX{ContractReference: "FX42", ExchangeRate: "0.7512", OriginalAmount: "100.00", OriginalCurrency: "USD"}, payment.Attributes.FX)
+		assert.Equal("75.12", payment.Attributes.Amount)
+	})
+
+	t.Run("Rates which cannot be quoted", func(t *testing.T) {
+		ps := newService(config)
+		unquoted := newPayment("", "100.00", "")
+		unquoted.Attributes.FX.OriginalCurrency = "CHF"
+		unavailable := newPayment("", "100.00", "")
+		unavailable.Attributes.FX.OriginalCurrency = "EUR"
+
+		_, unquotedErr := ps.Add(ctx, unquoted)
+		_, unavailableErr := ps.Add(ctx, unavailable)
+		_, withoutProviderErr := newService(FXConfig{}).Add(ctx, newPayment("", "100.00", ""))
+
+		assert.Equal(map[string]string{"attributes.fx.original_currency": "fx_rate"}, rules(unquotedErr))
+		assert.Error(unavailableErr)
+		assert.Nil(rules(unavailableErr), "Provider failures are not the fault of the client")
+		assert.Equal("required", rules(withoutProviderErr)["attributes.fx.exchange_rate"])
+	})
+
+	t.Run("Invalid configurations are rejected", func(t *testing.T) {
+		for _, invalid := range []FXConfig{{Tolerance: "1 cent"}, {Tolerance: "-0.01"}, {Decimals: -1}} {
+			assert.Error(invalid.Validate(), "%+v", invalid)
+			assert.Panics(func() { WithFX(invalid) }, "%+v", invalid)
+		}
+		assert.Nil(config.Validate())
+		assert.Nil(FXConfig{}.Validate(), "Empty tolerances allow no difference")
+	})
+
+	t.Run("Rounding modes", func(t *testing.T) {
+		cases := []struct {
+			number   string
+			rounding Rounding
+			rounded  string
+		}{
+			{"2.345", RoundHalfUp, "2.35"},
+			{"2.345", RoundHalfEven, "2.34"},
+			{"2.355", RoundHalfEven, "2.36"},
+			{"2.349", RoundDown, "2.34"},
+			{"-2.345", RoundHalfUp, "-2.35"},
+			{"-2.349", RoundDown, "-2.34"},
+			{"2.3449", RoundHalfUp, "2.34"},
+		}
+		for _, testCase := range cases {
+			number, _ := new(big.Rat).SetString(testCase.number)
+
+			rounded := round(number, 2, testCase.rounding)
+
+			assert.Equal(testCase.rounded, rounded.FloatString(2), "%+v", testCase)
+		}
+	})
+}
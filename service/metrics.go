@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/mysza/paymentsapi/metrics"
+)
+
+type serviceMetrics struct {
+	operations         *metrics.CounterVec
+	validationFailures *metrics.CounterVec
+}
+
+func newServiceMetrics() *serviceMetrics {
+	return &serviceMetrics{
+		operations: metrics.NewCounterVec(
+			"payments_operations_total",
+			"Number of operations performed by the payments service, by outcome.",
+			"operation", "outcome"),
+		validationFailures: metrics.NewCounterVec(
+			"payments_validation_failures_total",
+			"Number of payment validation failures, by field and violated rule.",
+			"field", "rule"),
+	}
+}
+
+// WithMetrics registers the metrics of the service in the registry.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(ps *PaymentsService) {
+		registry.Register(ps.metrics.operations, ps.metrics.validationFailures)
+	}
+}
+
+// observe counts the operation with the outcome determined by its error.
+func (m *serviceMetrics) observe(operation string, err error) {
+	m.operations.Inc(operation, outcome(err))
+}
+
+// fieldIndex matches the indices of slices in the paths of fields, e.g. [0]
+// in attributes.charges_information.sender_charges[0].amount, which would
+// make the values of the field label unbounded.
+var fieldIndex = regexp.MustCompile(`\[[0-9]+\]`)
+
+// observeValidation counts every rule violated by the payment, by the path
+// of its field without slice indices.
+func (m *serviceMetrics) observeValidation(err error) {
+	invalid, ok := err.(*ValidationError)
+	if !ok {
+		return
+	}
+	for _, violation := range invalid.Violations {
+		m.validationFailures.Inc(fieldIndex.ReplaceAllString(violation.Field, "[]"), violation.Rule)
+	}
+}
+
+func outcome(err error) string {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return "canceled"
+	}
+	switch err.(type) {
+	case nil:
+		return "success"
+	case *InputError, *ValidationError:
+		return "invalid"
+	case *NotFoundError:
+		return "not_found"
+	case *ForbiddenError:
+		return "forbidden"
+	case *ConflictError:
+		return "conflict"
+	default:
+		return "error"
+	}
+}
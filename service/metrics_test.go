@@ -0,0 +1,23 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("Validation failures are counted without slice indices", func(t *testing.T) {
+		m := newServiceMetrics()
+
+		m.observeValidation(&ValidationError{Violations: []Violation{
+			{Field: "attributes.charges_information.sender_charges[0].amount", Rule: "numeric"},
+			{Field: "attributes.charges_information.sender_charges[12].amount", Rule: "numeric"},
+			{Field: "attributes.amount", Rule: "required"},
+		}})
+
+		assert.Equal(t, 2.0, m.validationFailures.Value("attributes.charges_information.sender_charges[].amount", "numeric"))
+		assert.Equal(t, 1.0, m.validationFailures.Value("attributes.amount", "required"))
+		assert.Len(t, m.validationFailures.Collect()[0].Samples, 2)
+	})
+}
@@ -2,6 +2,7 @@
 
 package mocks
 
+import context "context"
 import domain "github.com/mysza/paymentsapi/domain"
 import mock "github.com/stretchr/testify/mock"
 
@@ -10,20 +11,20 @@ type PaymentsRepository struct {
 	mock.Mock
 }
 
-// Add provides a mock function with given fields: _a0
-func (_m *PaymentsRepository) Add(_a0 *domain.Payment) (string, error) {
-	ret := _m.Called(_a0)
+// Add provides a mock function with given fields: _a0, _a1
+func (_m *PaymentsRepository) Add(_a0 context.Context, _a1 *domain.Payment) (string, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 string
-	if rf, ok := ret.Get(0).(func(*domain.Payment) string); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Payment) string); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(string)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(*domain.Payment) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, *domain.Payment) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -31,13 +32,13 @@ func (_m *PaymentsRepository) Add(_a0 *domain.Payment) (string, error) {
 	return r0, r1
 }
 
-// Delete provides a mock function with given fields: _a0
-func (_m *PaymentsRepository) Delete(_a0 string) error {
-	ret := _m.Called(_a0)
+// Delete provides a mock function with given fields: _a0, _a1
+func (_m *PaymentsRepository) Delete(_a0 context.Context, _a1 string) error {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -45,13 +46,13 @@ func (_m *PaymentsRepository) Delete(_a0 string) error {
 	return r0
 }
 
-// Exists provides a mock function with given fields: _a0
-func (_m *PaymentsRepository) Exists(_a0 string) bool {
-	ret := _m.Called(_a0)
+// Exists provides a mock function with given fields: _a0, _a1
+func (_m *PaymentsRepository) Exists(_a0 context.Context, _a1 string) bool {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 bool
-	if rf, ok := ret.Get(0).(func(string) bool); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Get(0).(bool)
 	}
@@ -59,13 +60,13 @@ func (_m *PaymentsRepository) Exists(_a0 string) bool {
 	return r0
 }
 
-// Get provides a mock function with given fields: _a0
-func (_m *PaymentsRepository) Get(_a0 string) (*domain.Payment, error) {
-	ret := _m.Called(_a0)
+// Get provides a mock function with given fields: _a0, _a1
+func (_m *PaymentsRepository) Get(_a0 context.Context, _a1 string) (*domain.Payment, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 *domain.Payment
-	if rf, ok := ret.Get(0).(func(string) *domain.Payment); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) *domain.Payment); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*domain.Payment)
@@ -73,8 +74,8 @@ func (_m *PaymentsRepository) Get(_a0 string) (*domain.Payment, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(_a0, _a1)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -82,13 +83,13 @@ func (_m *PaymentsRepository) Get(_a0 string) (*domain.Payment, error) {
 	return r0, r1
 }
 
-// GetAll provides a mock function with given fields:
-func (_m *PaymentsRepository) GetAll() ([]*domain.Payment, error) {
-	ret := _m.Called()
+// GetAll provides a mock function with given fields: _a0
+func (_m *PaymentsRepository) GetAll(_a0 context.Context) ([]*domain.Payment, error) {
+	ret := _m.Called(_a0)
 
 	var r0 []*domain.Payment
-	if rf, ok := ret.Get(0).(func() []*domain.Payment); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) []*domain.Payment); ok {
+		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]*domain.Payment)
@@ -96,8 +97,8 @@ func (_m *PaymentsRepository) GetAll() ([]*domain.Payment, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(_a0)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -105,13 +106,13 @@ func (_m *PaymentsRepository) GetAll() ([]*domain.Payment, error) {
 	return r0, r1
 }
 
-// Update provides a mock function with given fields: _a0
-func (_m *PaymentsRepository) Update(_a0 *domain.Payment) error {
-	ret := _m.Called(_a0)
+// Update provides a mock function with given fields: _a0, _a1
+func (_m *PaymentsRepository) Update(_a0 context.Context, _a1 *domain.Payment) error {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*domain.Payment) error); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Payment) error); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		r0 = ret.Error(0)
 	}
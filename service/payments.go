@@ -1,9 +1,18 @@
 package service
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/google/uuid"
+	"github.com/mysza/paymentsapi/auth"
+	"github.com/mysza/paymentsapi/calendar"
 	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/tracing"
 	validator "gopkg.in/go-playground/validator.v9"
 )
 
@@ -11,36 +20,293 @@ import (
 // that should be used by the service for Payments storage
 // need to implement.
 type PaymentsRepository interface {
-	Add(*domain.Payment) (string, error)
-	GetAll() ([]*domain.Payment, error)
-	Update(*domain.Payment) error
-	Get(string) (*domain.Payment, error)
-	Delete(string) error
-	Exists(string) bool
+	Add(context.Context, *domain.Payment) (string, error)
+	GetAll(context.Context) ([]*domain.Payment, error)
+	Update(context.Context, *domain.Payment) error
+	Get(context.Context, string) (*domain.Payment, error)
+	Delete(context.Context, string) error
+	Exists(context.Context, string) bool
+}
+
+// EventStore is implemented by repositories storing payments as streams of
+// domain events. The commands of the service on payments append the events
+// they emit to them, rather than writing the payments. The version of the
+// payments they store is the one of the last event of their stream.
+type EventStore interface {
+	// Append appends the events to the stream of the payment with given ID,
+	// setting their versions and the time they occurred. Events with
+	// versions set must be the next ones of the stream, otherwise
+	// domain.ErrVersionConflict is returned.
+	Append(ctx context.Context, id string, events []domain.Event) error
+	// Events returns the events of the payment with given ID in order,
+	// including those of deleted payments.
+	Events(ctx context.Context, id string) ([]domain.Event, error)
 }
 
 // PaymentsService implements all use cases of the Payments API.
 type PaymentsService struct {
 	repo      PaymentsRepository
 	validator *validator.Validate
+	schemes   *schemes
+	calendars *calendars
+	fx        *fx
+	charges   *charges
+	policy    Policy
+	approvals *approvals
+	metrics   *serviceMetrics
+}
+
+// Option configures optional behaviour of the PaymentsService.
+type Option func(*PaymentsService)
+
+// WithPolicy sets the policy authorizing operations on payments.
+// By default all operations are allowed.
+func WithPolicy(policy Policy) Option {
+	return func(ps *PaymentsService) {
+		ps.policy = policy
+	}
 }
 
 // NewPaymentsService creates a new instance of PaymentsService
 // with the provided repository.
-func NewPaymentsService(repo PaymentsRepository) *PaymentsService {
-	return &PaymentsService{
+func NewPaymentsService(repo PaymentsRepository, opts ...Option) *PaymentsService {
+	ps := &PaymentsService{
 		repo:      repo,
-		validator: validator.New(),
+		validator: newValidator(),
+		policy:    AllowAll{},
+		approvals: defaultApprovals(),
+		metrics:   newServiceMetrics(),
+	}
+	for _, opt := range opts {
+		opt(ps)
+	}
+	return ps
+}
+
+// newValidator creates the validator of payments, naming fields as in JSON.
+// It validates ISO 8601 dates, e.g. 2018-06-04, with the date tag.
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		return strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	})
+	v.RegisterValidation("date", func(field validator.FieldLevel) bool {
+		_, err := time.Parse(calendar.DateLayout, field.Field().String())
+		return err == nil
+	})
+	return v
+}
+
+// Validate checks the payment against the rules applied when payments
+// are added or updated, e.g. to verify the stored ones. Violations are
+// returned as a ValidationError. Rules depending on the current date,
+// e.g. processing dates in the past, are only checked on writes.
+func (ps *PaymentsService) Validate(payment *domain.Payment) error {
+	violations, err := ps.violations(payment)
+	if err != nil {
+		return err
+	}
+	return validationError(violations)
+}
+
+// violations returns the rules violated by the payment. The rules of payment
+// schemes and the FX are only checked for payments valid otherwise.
+func (ps *PaymentsService) violations(payment *domain.Payment) ([]Violation, error) {
+	err := ps.validator.Struct(payment)
+	fieldErrors, ok := err.(validator.ValidationErrors)
+	if err != nil && !ok {
+		return nil, err
+	}
+	var violations []Violation
+	for _, fieldError := range fieldErrors {
+		violations = append(violations, Violation{
+			Field:   fieldPath(fieldError.Namespace()),
+			Rule:    fieldError.Tag(),
+			Message: ruleMessage(fieldError),
+		})
+	}
+	if len(violations) > 0 {
+		return violations, nil
+	}
+	if ps.schemes != nil {
+		violations = append(violations, ps.schemes.check(payment)...)
+	}
+	if ps.fx != nil {
+		violations = append(violations, ps.fx.check(payment)...)
+	}
+	return violations, nil
+}
+
+// validate checks the payment being written, completing it first: the FX of
+// payments submitted with only the original amount and currency is quoted,
+// the charges of payments submitted without them are calculated, and
+// processing dates may be rolled to the next business day. Charges are only
+// checked on writes, as the tariffs change over time.
+func (ps *PaymentsService) validate(ctx context.Context, payment *domain.Payment) (err error) {
+	ctx, span := tracing.Start(ctx, "PaymentsService.validate")
+	defer func() {
+		ps.metrics.observeValidation(err)
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	if ps.fx != nil && payment != nil {
+		if err := ps.fx.quote(ctx, payment); err != nil {
+			return err
+		}
+	}
+	if ps.charges != nil && payment != nil {
+		ps.charges.fill(organisationOf(ctx, payment), payment)
+	}
+	violations, err := ps.violations(payment)
+	if err != nil {
+		return NewInputError(err.Error())
+	}
+	if len(violations) == 0 && ps.charges != nil {
+		violations = ps.charges.check(organisationOf(ctx, payment), payment)
+	}
+	if len(violations) == 0 && ps.calendars != nil {
+		violations = ps.calendars.check(payment)
+	}
+	return validationError(violations)
+}
+
+// checkProcessingDate checks the processing date of the payment validated
+// against the rules of its scheme relative to the current date, unless it is
+// the one of the payment before, nil for payments being added.
+func (ps *PaymentsService) checkProcessingDate(before, payment *domain.Payment) error {
+	if ps.schemes == nil {
+		return nil
+	}
+	err := validationError(ps.schemes.checkProcessingDate(before, payment))
+	ps.metrics.observeValidation(err)
+	return err
+}
+
+func validationError(violations []Violation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: violations}
+}
+
+// fieldPath returns the path of the field in the JSON representation of the
+// payment, given its namespace, e.g. attributes.beneficiary_party.name for
+// Payment.attributes.beneficiary_party.PaymentParty.name. The structures
+// named in Go, the payment and the embedded ones, have no JSON names.
+func fieldPath(namespace string) string {
+	var names []string
+	for _, name := range strings.Split(namespace, ".") {
+		if name != "" && !unicode.IsUpper(rune(name[0])) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ".")
+}
+
+// ruleMessage explains the rule of the struct tag violated by the field.
+func ruleMessage(fieldError validator.FieldError) string {
+	switch fieldError.Tag() {
+	case "required":
+		return "is required"
+	case "numeric":
+		return "must be numeric"
+	case "alpha":
+		return "must contain letters only"
+	case "len":
+		return fmt.Sprintf("must be %s characters long", fieldError.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", strings.Replace(fieldError.Param(), " ", ", ", -1))
+	case "isdefault":
+		return "must not be set"
+	case "date":
+		return "must be a date formatted as YYYY-MM-DD"
+	default:
+		return fmt.Sprintf("must satisfy the %s rule", fieldError.Tag())
 	}
 }
 
-func (ps *PaymentsService) validate(payment *domain.Payment) error {
-	return ps.validator.Struct(payment)
+// startSpan starts a span of the service operation, to be finished with the
+// returned function given the result of the operation.
+func startSpan(ctx context.Context, operation string) (context.Context, func(error)) {
+	ctx, span := tracing.Start(ctx, "PaymentsService."+operation)
+	return ctx, func(err error) {
+		tracing.RecordError(span, err)
+		span.End()
+	}
+}
+
+// authorize checks if the principal stored in ctx may perform the action.
+func (ps *PaymentsService) authorize(ctx context.Context, action Action) error {
+	principal, _ := auth.FromContext(ctx)
+	return ps.policy.Authorize(principal, action)
+}
+
+// callerOrganisation returns the organisation the authenticated caller acts
+// for. Callers are restricted to the payments of their organisation; ok is
+// false without authentication, when every organisation is accessible.
+func callerOrganisation(ctx context.Context) (organisation string, ok bool) {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return principal.OrganisationID, true
+}
+
+// accessible checks if the payment belongs to the organisation of the
+// authenticated caller, if any. Callers acting for no organisation have
+// no access to payments.
+func accessible(ctx context.Context, payment *domain.Payment) bool {
+	organisation, restricted := callerOrganisation(ctx)
+	return !restricted || organisation != "" && payment.OrganisationID == organisation
+}
+
+// accessibleHistory checks if the payment the events are the history of
+// belongs to the organisation of the authenticated caller, if any, as
+// recorded by its creation.
+func accessibleHistory(ctx context.Context, events []domain.Event) bool {
+	if _, restricted := callerOrganisation(ctx); !restricted {
+		return true
+	}
+	return events[0].Payment != nil && accessible(ctx, events[0].Payment)
+}
+
+// organisationOf returns the organisation the payment is written for: the
+// one of the authenticated caller, or without authentication the one of the
+// payment. Settings of organisations, e.g. the approvals they require, are
+// looked up by it, so that callers cannot choose them.
+func organisationOf(ctx context.Context, payment *domain.Payment) string {
+	if organisation, restricted := callerOrganisation(ctx); restricted {
+		return organisation
+	}
+	return payment.OrganisationID
+}
+
+// assignOrganisation sets the organisation of the payment written to the one
+// of the authenticated caller, if any.
+func assignOrganisation(ctx context.Context, payment *domain.Payment) error {
+	organisation, restricted := callerOrganisation(ctx)
+	if !restricted || payment == nil {
+		return nil
+	}
+	if organisation == "" {
+		return NewForbiddenError("Callers acting for no organisation cannot write payments")
+	}
+	payment.OrganisationID = organisation
+	return nil
 }
 
 // Add adds a new payment to the service.
-// Before that, it validates the argument.
-func (ps *PaymentsService) Add(payment *domain.Payment) (string, error) {
+// Before that, it validates the argument. Payments added by authenticated
+// callers belong to the organisation of the caller.
+func (ps *PaymentsService) Add(ctx context.Context, payment *domain.Payment) (id string, err error) {
+	ctx, end := startSpan(ctx, "Add")
+	defer func() {
+		ps.metrics.observe("add", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionCreate); err != nil {
+		return "", err
+	}
 	if payment == nil {
 		return "", NewInputError("Payment is nil")
 	}
@@ -48,47 +314,215 @@ func (ps *PaymentsService) Add(payment *domain.Payment) (string, error) {
 	if payment.ID != "" {
 		return "", NewInputError("Payment cannot have ID set when adding to repository")
 	}
-	if err := ps.validate(payment); err != nil {
-		return "", NewInputError(err.Error())
+	if err := assignOrganisation(ctx, payment); err != nil {
+		return "", err
+	}
+	if err := ps.validate(ctx, payment); err != nil {
+		return "", err
+	}
+	if err := ps.checkProcessingDate(nil, payment); err != nil {
+		return "", err
+	}
+	payment.CreatedBy, payment.UpdatedBy = "", ""
+	if principal, ok := auth.FromContext(ctx); ok {
+		payment.CreatedBy = principal.Subject
+	}
+	payment.Approvals = nil
+	ps.approvals.updateStatus(organisationOf(ctx, payment), payment)
+	store, ok := ps.repo.(EventStore)
+	if !ok {
+		return ps.repo.Add(ctx, payment)
+	}
+	payment.ID, payment.Version = uuid.New().String(), 1
+	created := domain.Event{Type: domain.EventPaymentCreated, Version: 1, Payment: payment}
+	if err := store.Append(ctx, payment.ID, []domain.Event{created}); err != nil {
+		return "", err
 	}
-	return ps.repo.Add(payment)
+	return payment.ID, nil
 }
 
-// GetAll simply returns all payments from the repository.
-func (ps *PaymentsService) GetAll() ([]*domain.Payment, error) {
-	return ps.repo.GetAll()
+// GetAll returns all payments from the repository accessible to the caller.
+func (ps *PaymentsService) GetAll(ctx context.Context) (payments []*domain.Payment, err error) {
+	ctx, end := startSpan(ctx, "GetAll")
+	defer func() {
+		ps.metrics.observe("get_all", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionRead); err != nil {
+		return nil, err
+	}
+	all, err := ps.repo.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, restricted := callerOrganisation(ctx); !restricted {
+		return all, nil
+	}
+	payments = []*domain.Payment{}
+	for _, payment := range all {
+		if accessible(ctx, payment) {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
 }
 
-// Update updates existing payment.
-func (ps *PaymentsService) Update(payment *domain.Payment) error {
-	if err := ps.validate(payment); err != nil {
-		return NewInputError(err.Error())
+// Update updates existing payment. Fields managed by the service are
+// preserved, except that any approvals collected so far are discarded, and
+// the caller is recorded as the last modifier, who cannot approve it. The
+// payment is only stored if unchanged since it was read to be updated.
+func (ps *PaymentsService) Update(ctx context.Context, payment *domain.Payment) (err error) {
+	ctx, end := startSpan(ctx, "Update")
+	defer func() {
+		ps.metrics.observe("update", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionUpdate); err != nil {
+		return err
+	}
+	if err := assignOrganisation(ctx, payment); err != nil {
+		return err
 	}
-	if exists := ps.repo.Exists(payment.ID); !exists {
+	if err := ps.validate(ctx, payment); err != nil {
+		return err
+	}
+	existing, getErr := ps.repo.Get(ctx, payment.ID)
+	if getErr != nil || !accessible(ctx, existing) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return NewNotFoundError(fmt.Sprintf("Payment with ID: %v does not exist", payment.ID))
 	}
-	return ps.repo.Update(payment)
+	if err := ps.checkProcessingDate(existing, payment); err != nil {
+		return err
+	}
+	payment.CreatedBy, payment.UpdatedBy = existing.CreatedBy, ""
+	payment.Version = existing.Version
+	if principal, ok := auth.FromContext(ctx); ok {
+		payment.UpdatedBy = principal.Subject
+	}
+	payment.Approvals = nil
+	ps.approvals.updateStatus(organisationOf(ctx, payment), payment)
+	return ps.save(ctx, payment, domain.Amendments(existing, payment))
 }
 
-// Get retrieves a single Payment based on ID
-func (ps *PaymentsService) Get(id string) (*domain.Payment, error) {
+// save stores the changed payment, or appends the events of the change to its
+// stream if the repository is an event store, unless it was changed
+// concurrently since it was read.
+func (ps *PaymentsService) save(ctx context.Context, payment *domain.Payment, events []domain.Event) error {
+	store, ok := ps.repo.(EventStore)
+	if !ok {
+		return ps.writeError(ctx, payment.ID, ps.repo.Update(ctx, payment))
+	}
+	// numbered after the version read, so that they follow no concurrent changes
+	for ix := range events {
+		events[ix].Version = int(payment.Version) + ix + 1
+	}
+	if err := store.Append(ctx, payment.ID, events); err != nil {
+		return ps.writeError(ctx, payment.ID, err)
+	}
+	payment.Version += int64(len(events))
+	return nil
+}
+
+// writeError returns the error of writing the payment with given ID. Payments
+// no longer existing, e.g. deleted concurrently, are reported as not found,
+// and those changed concurrently since they were read as a conflict.
+func (ps *PaymentsService) writeError(ctx context.Context, id string, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if !ps.repo.Exists(ctx, id) {
+		return NewNotFoundError(fmt.Sprintf("Payment with ID: %v does not exist", id))
+	}
+	if err == domain.ErrVersionConflict {
+		return NewConflictError(fmt.Sprintf("Payment with ID %v was changed concurrently", id))
+	}
+	return err
+}
+
+// History returns the events of the payment with given ID in order, if the
+// repository is an event store.
+func (ps *PaymentsService) History(ctx context.Context, id string) (events []domain.Event, err error) {
+	ctx, end := startSpan(ctx, "History")
+	defer func() {
+		ps.metrics.observe("history", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionRead); err != nil {
+		return nil, err
+	}
+	store, ok := ps.repo.(EventStore)
+	if !ok {
+		return nil, NewNotFoundError("Payment history is not recorded by the repository")
+	}
 	if id == "" {
 		return nil, NewInputError("Invalid ID")
 	}
-	payment, err := ps.repo.Get(id)
+	events, err = store.Events(ctx, id)
 	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 || !accessibleHistory(ctx, events) {
+		return nil, NewNotFoundError(fmt.Sprintf("Payment with id %v not found", id))
+	}
+	return events, nil
+}
+
+// Get retrieves a single Payment based on ID
+func (ps *PaymentsService) Get(ctx context.Context, id string) (payment *domain.Payment, err error) {
+	ctx, end := startSpan(ctx, "Get")
+	defer func() {
+		ps.metrics.observe("get", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionRead); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, NewInputError("Invalid ID")
+	}
+	payment, getErr := ps.repo.Get(ctx, id)
+	if getErr != nil || !accessible(ctx, payment) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, NewNotFoundError(fmt.Sprintf("Payment with id %v not found", id))
 	}
 	return payment, nil
 }
 
 // Delete deletes payment with given ID from the repository.
-func (ps *PaymentsService) Delete(id string) error {
+func (ps *PaymentsService) Delete(ctx context.Context, id string) (err error) {
+	ctx, end := startSpan(ctx, "Delete")
+	defer func() {
+		ps.metrics.observe("delete", err)
+		end(err)
+	}()
+	if err := ps.authorize(ctx, ActionDelete); err != nil {
+		return err
+	}
 	if id == "" {
 		return NewInputError("Invalid ID")
 	}
-	if exists := ps.repo.Exists(id); !exists {
+	if !ps.exists(ctx, id) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return NewNotFoundError(fmt.Sprintf("Payment with ID %v does not exist", id))
 	}
-	return ps.repo.Delete(id)
+	if store, ok := ps.repo.(EventStore); ok {
+		return ps.writeError(ctx, id, store.Append(ctx, id, []domain.Event{{Type: domain.EventPaymentDeleted}}))
+	}
+	return ps.repo.Delete(ctx, id)
+}
+
+// exists checks if the payment with given ID exists and is accessible to
+// the caller. Without authentication it is not decoded to check that.
+func (ps *PaymentsService) exists(ctx context.Context, id string) bool {
+	if _, restricted := callerOrganisation(ctx); !restricted {
+		return ps.repo.Exists(ctx, id)
+	}
+	payment, err := ps.repo.Get(ctx, id)
+	return err == nil && accessible(ctx, payment)
 }
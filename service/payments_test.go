@@ -1,18 +1,23 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"path/filepath"
 	"testing"
 
 	"github.com/jinzhu/copier"
+	"github.com/mysza/paymentsapi/auth"
 	"github.com/mysza/paymentsapi/domain"
 	"github.com/mysza/paymentsapi/service/mocks"
 	"github.com/mysza/paymentsapi/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestService(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 	testDataDir := filepath.Join("..", "testdata")
 	validPayment := test.PaymentFromFile(t, filepath.Join(testDataDir, "validPayment.json"))
 	invalidPayment := test.PaymentFromFile(t, filepath.Join(testDataDir, "invalidPayment.json"))
@@ -21,7 +26,7 @@ func TestService(t *testing.T) {
 		t.Run("PaymentsService Add returns error if invalid input passed", func(t *testing.T) {
 			ps := NewPaymentsService(nil)
 
-			_, err := ps.Add(invalidPayment)
+			_, err := ps.Add(ctx, invalidPayment)
 
 			assert.Error(err)
 		})
@@ -31,10 +36,10 @@ func TestService(t *testing.T) {
 			copier.Copy(&payment, validPayment)
 			payment.ID = ""
 			repo := new(mocks.PaymentsRepository)
-			repo.On("Add", &payment).Return("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+			repo.On("Add", mock.Anything, &payment).Return("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
 			ps := NewPaymentsService(repo)
 
-			id, err := ps.Add(&payment)
+			id, err := ps.Add(ctx, &payment)
 
 			assert.Equal("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", id, "Returned ID should equal expected value")
 			assert.Nil(err)
@@ -44,7 +49,7 @@ func TestService(t *testing.T) {
 		t.Run("PaymentsService Add returns error if payment ID was set", func(t *testing.T) {
 			ps := NewPaymentsService(nil)
 
-			id, err := ps.Add(validPayment)
+			id, err := ps.Add(ctx, validPayment)
 
 			assert.Empty(id, "Returned ID should be empty")
 			assert.Error(err, "Error should be set")
@@ -54,10 +59,10 @@ func TestService(t *testing.T) {
 	t.Run("Get all payments", func(t *testing.T) {
 		payments := []*domain.Payment{validPayment, validPayment}
 		repo := new(mocks.PaymentsRepository)
-		repo.On("GetAll").Return(payments, nil)
+		repo.On("GetAll", mock.Anything).Return(payments, nil)
 		ps := NewPaymentsService(repo)
 
-		retPayments, err := ps.GetAll()
+		retPayments, err := ps.GetAll(ctx)
 
 		assert.Equal(payments, retPayments, "Returned payments should be all in repository")
 		assert.Nil(err)
@@ -69,17 +74,17 @@ func TestService(t *testing.T) {
 		t.Run("PaymentsService Update returns error if invalid input passed", func(t *testing.T) {
 			ps := NewPaymentsService(nil)
 
-			err := ps.Update(invalidPayment)
+			err := ps.Update(ctx, invalidPayment)
 
 			assert.Error(err)
 		})
 
 		t.Run("PaymentsService Update returns error if invalid input passed", func(t *testing.T) {
 			repo := new(mocks.PaymentsRepository)
-			repo.On("Exists", validPayment.ID).Return(false)
+			repo.On("Get", mock.Anything, validPayment.ID).Return(nil, errors.New("not found"))
 			ps := NewPaymentsService(repo)
 
-			err := ps.Update(validPayment)
+			err := ps.Update(ctx, validPayment)
 
 			assert.Error(err, "Update with non-existing payment shoud return error")
 			repo.AssertExpectations(t)
@@ -87,22 +92,39 @@ func TestService(t *testing.T) {
 
 		t.Run("PaymentsService Update returns nil if the input was valid", func(t *testing.T) {
 			repo := new(mocks.PaymentsRepository)
-			repo.On("Exists", validPayment.ID).Return(true)
-			repo.On("Update", validPayment).Return(nil)
+			repo.On("Get", mock.Anything, validPayment.ID).Return(validPayment, nil)
+			repo.On("Update", mock.Anything, validPayment).Return(nil)
 			ps := NewPaymentsService(repo)
 
-			err := ps.Update(validPayment)
+			err := ps.Update(ctx, validPayment)
 
 			assert.Nil(err)
 			repo.AssertExpectations(t)
 		})
+
+		t.Run("PaymentsService Update stores the version read and returns ConflictError if it changed", func(t *testing.T) {
+			var stored, payment domain.Payment
+			copier.Copy(&stored, validPayment)
+			copier.Copy(&payment, validPayment)
+			stored.Version, payment.Version = 3, 0
+			repo := new(mocks.PaymentsRepository)
+			repo.On("Get", mock.Anything, validPayment.ID).Return(&stored, nil)
+			repo.On("Update", mock.Anything, mock.MatchedBy(func(p *domain.Payment) bool { return p.Version == 3 })).Return(domain.ErrVersionConflict)
+			repo.On("Exists", mock.Anything, validPayment.ID).Return(true)
+			ps := NewPaymentsService(repo)
+
+			err := ps.Update(ctx, &payment)
+
+			assert.IsType(&ConflictError{}, err)
+			repo.AssertExpectations(t)
+		})
 	})
 
 	t.Run("Get payment", func(t *testing.T) {
 		ps := NewPaymentsService(nil)
 
 		t.Run("PaymentsService Get returns error if invalid ID passed", func(t *testing.T) {
-			retPayment, err := ps.Get("")
+			retPayment, err := ps.Get(ctx, "")
 
 			assert.Error(err)
 			assert.Empty(retPayment)
@@ -110,10 +132,10 @@ func TestService(t *testing.T) {
 
 		t.Run("PaymentsService Get returns payment if the input was its ID", func(t *testing.T) {
 			repo := new(mocks.PaymentsRepository)
-			repo.On("Get", validPayment.ID).Return(validPayment, nil)
+			repo.On("Get", mock.Anything, validPayment.ID).Return(validPayment, nil)
 			ps := NewPaymentsService(repo)
 
-			retPayment, err := ps.Get(validPayment.ID)
+			retPayment, err := ps.Get(ctx, validPayment.ID)
 
 			assert.Nil(err)
 			assert.Equal(validPayment, retPayment, "Retrieved payment differs from expected payment after Get")
@@ -125,7 +147,7 @@ func TestService(t *testing.T) {
 		t.Run("Error if invalid ID", func(t *testing.T) {
 			ps := NewPaymentsService(nil)
 
-			err := ps.Delete("")
+			err := ps.Delete(ctx, "")
 
 			assert.Error(err)
 		})
@@ -133,10 +155,10 @@ func TestService(t *testing.T) {
 		t.Run("Error if not exists", func(t *testing.T) {
 			repo := new(mocks.PaymentsRepository)
 			id := "non-existing-id"
-			repo.On("Exists", id).Return(false)
+			repo.On("Exists", mock.Anything, id).Return(false)
 			ps := NewPaymentsService(repo)
 
-			err := ps.Delete(id)
+			err := ps.Delete(ctx, id)
 
 			assert.Error(err)
 			repo.AssertExpectations(t)
@@ -145,14 +167,175 @@ func TestService(t *testing.T) {
 		t.Run("Deletes if input valid", func(t *testing.T) {
 			repo := new(mocks.PaymentsRepository)
 			id := "existing-id"
-			repo.On("Exists", id).Return(true)
-			repo.On("Delete", id).Return(nil)
+			repo.On("Exists", mock.Anything, id).Return(true)
+			repo.On("Delete", mock.Anything, id).Return(nil)
 			ps := NewPaymentsService(repo)
 
-			err := ps.Delete(id)
+			err := ps.Delete(ctx, id)
 
 			assert.Empty(err)
 			repo.AssertExpectations(t)
 		})
 	})
+	t.Run("Cancelled requests are not reported as missing payments", func(t *testing.T) {
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, validPayment.ID).Return(nil, context.Canceled)
+		ps := NewPaymentsService(repo)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := ps.Get(cancelled, validPayment.ID)
+
+		assert.Equal(context.Canceled, err)
+	})
+	t.Run("Authorization", func(t *testing.T) {
+		policy, _ := NewRolePolicy(DefaultRoles)
+		viewer := auth.NewContext(ctx, &auth.Principal{Subject: "viewer", OrganisationID: validPayment.OrganisationID, Roles: []string{"viewer"}})
+
+		t.Run("Allowed operations reach the repository", func(t *testing.T) {
+			repo := new(mocks.PaymentsRepository)
+			repo.On("Get", mock.Anything, validPayment.ID).Return(validPayment, nil)
+			ps := NewPaymentsService(repo, WithPolicy(policy))
+
+			_, err := ps.Get(viewer, validPayment.ID)
+
+			assert.Nil(err)
+			repo.AssertExpectations(t)
+		})
+
+		t.Run("Denied operations return ForbiddenError", func(t *testing.T) {
+			repo := new(mocks.PaymentsRepository)
+			ps := NewPaymentsService(repo, WithPolicy(policy))
+
+			err := ps.Delete(viewer, validPayment.ID)
+
+			assert.IsType(&ForbiddenError{}, err)
+			repo.AssertExpectations(t)
+		})
+	})
+	t.Run("Event stores", func(t *testing.T) {
+		t.Run("Commands append their events after the version read", func(t *testing.T) {
+			var stored, payment domain.Payment
+			copier.Copy(&stored, validPayment)
+			copier.Copy(&payment, validPayment)
+			stored.Version = 3
+			payment.Attributes.Amount = "1000.00"
+			repo := &eventStore{PaymentsRepository: new(mocks.PaymentsRepository)}
+			repo.On("Get", mock.Anything, validPayment.ID).Return(&stored, nil)
+			repo.On("Exists", mock.Anything, validPayment.ID).Return(true)
+			ps := NewPaymentsService(repo)
+
+			id, addErr := ps.Add(ctx, &domain.Payment{OrganisationID: validPayment.OrganisationID, Attributes: validPayment.Attributes})
+			updateErr := ps.Update(ctx, &payment)
+			deleteErr := ps.Delete(ctx, validPayment.ID)
+
+			assert.Nil(addErr)
+			assert.Nil(updateErr)
+			assert.Nil(deleteErr)
+			if assert.Len(repo.appended, 3) {
+				assert.Equal(domain.Event{Type: domain.EventPaymentCreated, Version: 1, Payment: repo.appended[0].Payment}, repo.appended[0])
+				assert.Equal(id, repo.appended[0].Payment.ID)
+				assert.Equal(domain.EventAmountAmended, repo.appended[1].Type)
+				assert.Equal(4, repo.appended[1].Version, "Events must follow the version read")
+				assert.Equal(domain.Event{Type: domain.EventPaymentDeleted}, repo.appended[2])
+			}
+			assert.Equal(int64(4), payment.Version)
+			repo.AssertNotCalled(t, "Add", mock.Anything, mock.Anything)
+			repo.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+			repo.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+		})
+
+		t.Run("Events appended after concurrent changes conflict", func(t *testing.T) {
+			repo := &eventStore{PaymentsRepository: new(mocks.PaymentsRepository), appendErr: domain.ErrVersionConflict}
+			repo.On("Get", mock.Anything, validPayment.ID).Return(validPayment, nil)
+			repo.On("Exists", mock.Anything, validPayment.ID).Return(true)
+			ps := NewPaymentsService(repo)
+			var payment domain.Payment
+			copier.Copy(&payment, validPayment)
+			payment.Attributes.Amount = "1000.00"
+
+			err := ps.Update(ctx, &payment)
+
+			assert.IsType(&ConflictError{}, err)
+		})
+
+		t.Run("Payments deleted while updated are not found", func(t *testing.T) {
+			repo := &eventStore{PaymentsRepository: new(mocks.PaymentsRepository), appendErr: domain.ErrVersionConflict}
+			repo.On("Get", mock.Anything, validPayment.ID).Return(validPayment, nil)
+			repo.On("Exists", mock.Anything, validPayment.ID).Return(false)
+			ps := NewPaymentsService(repo)
+
+			err := ps.Update(ctx, validPayment)
+
+			assert.IsType(&NotFoundError{}, err)
+			repo.AssertExpectations(t)
+		})
+
+		t.Run("History returns the events of the payment", func(t *testing.T) {
+			events := []domain.Event{{Type: domain.EventPaymentCreated, PaymentID: validPayment.ID, Version: 1}}
+			repo := &eventStore{PaymentsRepository: new(mocks.PaymentsRepository), events: events}
+			ps := NewPaymentsService(repo)
+
+			history, err := ps.History(ctx, validPayment.ID)
+			_, missingErr := NewPaymentsService(&eventStore{PaymentsRepository: new(mocks.PaymentsRepository)}).History(ctx, "missing")
+			_, unsupportedErr := NewPaymentsService(new(mocks.PaymentsRepository)).History(ctx, validPayment.ID)
+
+			assert.Nil(err)
+			assert.Equal(events, history)
+			assert.IsType(&NotFoundError{}, missingErr)
+			assert.IsType(&NotFoundError{}, unsupportedErr)
+		})
+	})
+}
+
+func TestOrganisations(t *testing.T) {
+	assert := assert.New(t)
+	validPayment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	other := auth.NewContext(context.Background(), &auth.Principal{Subject: "other", OrganisationID: "other-org"})
+	repo := &eventStore{
+		PaymentsRepository: new(mocks.PaymentsRepository),
+		events:             []domain.Event{{Type: domain.EventPaymentCreated, PaymentID: validPayment.ID, Version: 1, Payment: validPayment}},
+	}
+	repo.On("Get", mock.Anything, validPayment.ID).Return(validPayment, nil)
+	repo.On("GetAll", mock.Anything).Return([]*domain.Payment{validPayment}, nil)
+	ps := NewPaymentsService(repo)
+	var update domain.Payment
+	copier.Copy(&update, validPayment)
+
+	all, getAllErr := ps.GetAll(other)
+	_, getErr := ps.Get(other, validPayment.ID)
+	updateErr := ps.Update(other, &update)
+	deleteErr := ps.Delete(other, validPayment.ID)
+	_, approveErr := ps.Approve(other, validPayment.ID)
+	_, historyErr := ps.History(other, validPayment.ID)
+
+	assert.Nil(getAllErr)
+	assert.Empty(all)
+	assert.IsType(&NotFoundError{}, getErr)
+	assert.IsType(&NotFoundError{}, updateErr)
+	assert.IsType(&NotFoundError{}, deleteErr)
+	assert.IsType(&NotFoundError{}, approveErr)
+	assert.IsType(&NotFoundError{}, historyErr)
+	assert.Empty(repo.appended)
+	repo.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+// eventStore is a mocked repository which is an event store.
+type eventStore struct {
+	*mocks.PaymentsRepository
+	appended  []domain.Event
+	events    []domain.Event
+	appendErr error
+}
+
+func (s *eventStore) Append(_ context.Context, _ string, events []domain.Event) error {
+	if s.appendErr != nil {
+		return s.appendErr
+	}
+	s.appended = append(s.appended, events...)
+	return nil
+}
+
+func (s *eventStore) Events(context.Context, string) ([]domain.Event, error) {
+	return s.events, nil
 }
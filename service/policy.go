@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/mysza/paymentsapi/auth"
+)
+
+// Action is an operation on payments subject to authorization.
+type Action string
+
+// Actions which can be granted to roles.
+const (
+	ActionRead    Action = "read"
+	ActionCreate  Action = "create"
+	ActionUpdate  Action = "update"
+	ActionApprove Action = "approve"
+	ActionDelete  Action = "delete"
+)
+
+var allActions = []Action{ActionRead, ActionCreate, ActionUpdate, ActionApprove, ActionDelete}
+
+// Policy decides whether a principal is allowed to perform an action.
+// The principal is nil for unauthenticated callers.
+type Policy interface {
+	Authorize(principal *auth.Principal, action Action) error
+}
+
+// AllowAll is a Policy allowing every action to everyone.
+type AllowAll struct{}
+
+// Authorize always allows the action.
+func (AllowAll) Authorize(*auth.Principal, Action) error {
+	return nil
+}
+
+// RolePolicy is a Policy granting actions to principals based on their roles.
+type RolePolicy struct {
+	roles map[string]map[Action]bool
+}
+
+// DefaultRoles are the roles used when no role definitions are configured.
+var DefaultRoles = map[string][]string{
+	"viewer":   {string(ActionRead)},
+	"operator": {string(ActionRead), string(ActionCreate), string(ActionUpdate)},
+	"approver": {string(ActionRead), string(ActionApprove)},
+	"admin":    {string(ActionRead), string(ActionCreate), string(ActionUpdate), string(ActionApprove), string(ActionDelete)},
+}
+
+// NewRolePolicy creates a RolePolicy from role definitions,
+// mapping each role name to the names of the actions it is granted.
+func NewRolePolicy(definitions map[string][]string) (*RolePolicy, error) {
+	roles := make(map[string]map[Action]bool, len(definitions))
+	for role, actions := range definitions {
+		roles[role] = make(map[Action]bool, len(actions))
+		for _, name := range actions {
+			action, err := parseAction(name)
+			if err != nil {
+				return nil, fmt.Errorf("role %v: %v", role, err)
+			}
+			roles[role][action] = true
+		}
+	}
+	return &RolePolicy{roles}, nil
+}
+
+// Authorize allows the action if any of the principal's roles grants it.
+func (p *RolePolicy) Authorize(principal *auth.Principal, action Action) error {
+	if principal != nil {
+		for _, role := range principal.Roles {
+			if p.roles[role][action] {
+				return nil
+			}
+		}
+	}
+	return NewForbiddenError(fmt.Sprintf("Not allowed to %v payments", action))
+}
+
+func parseAction(name string) (Action, error) {
+	for _, action := range allActions {
+		if string(action) == name {
+			return action, nil
+		}
+	}
+	return "", fmt.Errorf("unknown action %q", name)
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mysza/paymentsapi/auth"
+)
+
+func TestRolePolicy(t *testing.T) {
+	policy, err := NewRolePolicy(DefaultRoles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		role    string
+		allowed []Action
+		denied  []Action
+	}{
+		{"viewer", []Action{ActionRead}, []Action{ActionCreate, ActionUpdate, ActionApprove, ActionDelete}},
+		{"operator", []Action{ActionRead, ActionCreate, ActionUpdate}, []Action{ActionApprove, ActionDelete}},
+		{"approver", []Action{ActionRead, ActionApprove}, []Action{ActionCreate, ActionUpdate, ActionDelete}},
+		{"admin", []Action{ActionRead, ActionCreate, ActionUpdate, ActionApprove, ActionDelete}, nil},
+		{"unknown", nil, []Action{ActionRead, ActionCreate, ActionUpdate, ActionApprove, ActionDelete}},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.role, func(t *testing.T) {
+			assert := assert.New(t)
+			principal := &auth.Principal{Subject: "user", Roles: []string{testCase.role}}
+			for _, action := range testCase.allowed {
+				assert.Nilf(policy.Authorize(principal, action), "%v should be allowed to %v", testCase.role, action)
+			}
+			for _, action := range testCase.denied {
+				assert.IsTypef(&ForbiddenError{}, policy.Authorize(principal, action), "%v should not be allowed to %v", testCase.role, action)
+			}
+		})
+	}
+
+	t.Run("Unauthenticated callers are denied", func(t *testing.T) {
+		assert.IsType(t, &ForbiddenError{}, policy.Authorize(nil, ActionRead))
+	})
+
+	t.Run("Unknown actions in definitions are rejected", func(t *testing.T) {
+		_, err := NewRolePolicy(map[string][]string{"viewer": {"read", "print"}})
+
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mysza/paymentsapi/calendar"
+	"github.com/mysza/paymentsapi/domain"
+)
+
+// SchemeRules are the rules payments of a payment scheme must follow.
+// Rules left empty are not checked.
+type SchemeRules struct {
+	Currencies                 []string `mapstructure:"currencies"`                      // Currencies are the currencies allowed
+	MaxAmount                  string   `mapstructure:"max_amount"`                      // MaxAmount is the largest amount allowed
+	MaxReferenceLength         int      `mapstructure:"max_reference_length"`            // MaxReferenceLength limits the reference
+	MaxEndToEndReferenceLength int      `mapstructure:"max_end_to_end_reference_length"` // MaxEndToEndReferenceLength limits the end to end reference
+	AccountNumberCodes         []string `mapstructure:"account_number_codes"`            // AccountNumberCodes are the account identifiers allowed: BBAN or IBAN
+	BankIDCodes                []string `mapstructure:"bank_id_codes"`                   // BankIDCodes are the bank identifiers allowed: GBDSC (sort codes) or SWBIC (BICs)
+	SchemePaymentTypes         []string `mapstructure:"scheme_payment_types"`            // SchemePaymentTypes are the scheme payment types allowed
+	SchemePaymentSubTypes      []string `mapstructure:"scheme_payment_sub_types"`        // SchemePaymentSubTypes are the scheme payment sub types allowed
+	MinDaysAhead               int      `mapstructure:"min_days_ahead"`                  // MinDaysAhead is how many days after today the processing date must be at least
+	MaxDaysAhead               int      `mapstructure:"max_days_ahead"`                  // MaxDaysAhead is how many days after today the processing date can be at most; zero is no limit
+}
+
+// DefaultSchemeRules are the rules of the payment schemes used unless
+// configured otherwise.
+var DefaultSchemeRules = map[string]SchemeRules{
+	"FPS": {
+		Currencies:                 []string{"GBP"},
+		MaxAmount:                  "1000000.00",
+		MaxReferenceLength:         18,
+		MaxEndToEndReferenceLength: 35,
+		AccountNumberCodes:         []string{"BBAN", "IBAN"},
+		BankIDCodes:                []string{"GBDSC"},
+		SchemePaymentTypes:         []string{"ImmediatePayment", "ForwardDatedPayment", "StandingOrder"},
+		SchemePaymentSubTypes:      []string{"TelephoneBanking", "InternetBanking", "BranchInstruction", "Letter", "Email", "MobilePaymentsService"},
+		MaxDaysAhead:               365,
+	},
+	"BACS": {
+		Currencies:                 []string{"GBP"},
+		MaxAmount:                  "20000000.00",
+		MaxReferenceLength:         18,
+		MaxEndToEndReferenceLength: 35,
+		AccountNumberCodes:         []string{"BBAN", "IBAN"},
+		BankIDCodes:                []string{"GBDSC"},
+		SchemePaymentTypes:         []string{"Credit", "DirectDebit"},
+		MinDaysAhead:               2, // the three-day cycle settles two days after submission
+		MaxDaysAhead:               31,
+	},
+	"CHAPS": {
+		Currencies:                 []string{"GBP"},
+		MaxReferenceLength:         140,
+		MaxEndToEndReferenceLength: 35,
+		AccountNumberCodes:         []string{"BBAN", "IBAN"},
+		BankIDCodes:                []string{"GBDSC", "SWBIC"},
+		SchemePaymentTypes:         []string{"CustomerTransfer", "FinancialInstitutionTransfer"},
+		MaxDaysAhead:               31,
+	},
+	"SEPA": {
+		Currencies:                 []string{"EUR"},
+		MaxReferenceLength:         140,
+		MaxEndToEndReferenceLength: 35,
+		AccountNumberCodes:         []string{"IBAN"},
+		BankIDCodes:                []string{"SWBIC"},
+		SchemePaymentTypes:         []string{"CreditTransfer", "InstantCreditTransfer"},
+		MaxDaysAhead:               365,
+	},
+}
+
+type schemes struct {
+	rules map[string]schemeRules
+	now   func() time.Time
+}
+
+// schemeRules are SchemeRules with the maximum amount parsed, nil for no limit.
+type schemeRules struct {
+	SchemeRules
+	maxAmount *big.Rat
+}
+
+// ValidateSchemeRules checks the maximum amounts of the rules are amounts,
+// and the days ahead are not negative.
+func ValidateSchemeRules(rules map[string]SchemeRules) error {
+	_, err := newSchemes(rules)
+	return err
+}
+
+// WithSchemeRules enables the rules of the payment schemes, by scheme name.
+// Payments of other schemes are rejected. It panics if the rules are
+// invalid, as reported by ValidateSchemeRules.
+func WithSchemeRules(rules map[string]SchemeRules) Option {
+	s, err := newSchemes(rules)
+	if err != nil {
+		panic(err)
+	}
+	return func(ps *PaymentsService) {
+		ps.schemes = s
+	}
+}
+
+func newSchemes(rules map[string]SchemeRules) (*schemes, error) {
+	s := &schemes{rules: make(map[string]schemeRules, len(rules)), now: time.Now}
+	for scheme, configured := range rules {
+		parsed := schemeRules{SchemeRules: configured}
+		if configured.MaxAmount != "" {
+			limit, ok := new(big.Rat).SetString(configured.MaxAmount)
+			if !ok || limit.Sign() < 0 {
+				return nil, fmt.Errorf("maximum amount of scheme %v: invalid amount %q", scheme, configured.MaxAmount)
+			}
+			parsed.maxAmount = limit
+		}
+		if configured.MinDaysAhead < 0 || configured.MaxDaysAhead < 0 {
+			return nil, fmt.Errorf("days ahead of scheme %v: %d to %d is negative", scheme, configured.MinDaysAhead, configured.MaxDaysAhead)
+		}
+		s.rules[strings.ToUpper(scheme)] = parsed
+	}
+	return s, nil
+}
+
+var (
+	sortCodePattern  = regexp.MustCompile(`^[0-9]{6}$`)
+	ukAccountPattern = regexp.MustCompile(`^[0-9]{8}$`)
+	bbanPattern      = regexp.MustCompile(`^[A-Z0-9]{1,30}$`)
+	ibanPattern      = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	bicPattern       = regexp.MustCompile(`^[A-Z]{6}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+)
+
+// check returns the violations of the rules of the payment scheme which do
+// not depend on the current date.
+func (s *schemes) check(payment *domain.Payment) []Violation {
+	attributes := &payment.Attributes
+	rules, found := s.rules[strings.ToUpper(attributes.PaymentScheme)]
+	if !found {
+		return []Violation{{
+			Field:   "attributes.payment_scheme",
+			Rule:    "scheme",
+			Message: fmt.Sprintf("must be one of %s", strings.Join(s.names(), ", ")),
+		}}
+	}
+	var v violations
+	if len(rules.Currencies) > 0 && !contains(rules.Currencies, attributes.Currency) {
+		v.add("attributes.currency", "currency", "must be one of %s", strings.Join(rules.Currencies, ", "))
+	}
+	if rules.maxAmount != nil {
+		amount, valid := new(big.Rat).SetString(attributes.Amount)
+		if valid && amount.Cmp(rules.maxAmount) > 0 {
+			v.add("attributes.amount", "max_amount", "must be at most %s", rules.MaxAmount)
+		}
+	}
+	v.maxLength("attributes.reference", attributes.Reference, rules.MaxReferenceLength)
+	v.maxLength("attributes.end_to_end_reference", attributes.EndToEndReference, rules.MaxEndToEndReferenceLength)
+	v.party("attributes.beneficiary_party", &attributes.Beneficiary.PaymentParty, &rules.SchemeRules)
+	v.party("attributes.debtor_party", &attributes.Debtor, &rules.SchemeRules)
+	v.bank("attributes.sponsor_party", &attributes.Sponsor, &rules.SchemeRules)
+	if len(rules.SchemePaymentTypes) > 0 && !contains(rules.SchemePaymentTypes, attributes.SchemePaymentType) {
+		v.add("attributes.scheme_payment_type", "scheme_payment_type", "must be one of %s", strings.Join(rules.SchemePaymentTypes, ", "))
+	}
+	if len(rules.SchemePaymentSubTypes) > 0 && !contains(rules.SchemePaymentSubTypes, attributes.SchemePaymentSubType) {
+		v.add("attributes.scheme_payment_sub_type", "scheme_payment_sub_type", "must be one of %s", strings.Join(rules.SchemePaymentSubTypes, ", "))
+	}
+	return v
+}
+
+// checkProcessingDate returns the violations of the processing date rules of
+// the payment scheme, relative to the current date. The processing date of
+// the payment before, nil for payments being added, is not checked again, so
+// that payments can be updated after their processing date passed.
+func (s *schemes) checkProcessingDate(before, payment *domain.Payment) []Violation {
+	if before != nil && before.Attributes.ProcessingDate == payment.Attributes.ProcessingDate {
+		return nil
+	}
+	rules := s.rules[strings.ToUpper(payment.Attributes.PaymentScheme)]
+	date, err := time.Parse(calendar.DateLayout, payment.Attributes.ProcessingDate)
+	if err != nil {
+		return nil
+	}
+	days := int(date.Sub(calendar.Day(s.now())).Hours() / 24)
+	var v violations
+	if days < rules.MinDaysAhead {
+		v.add("attributes.processing_date", "min_days_ahead", "must be at least %d days after today", rules.MinDaysAhead)
+	}
+	if rules.MaxDaysAhead > 0 && days > rules.MaxDaysAhead {
+		v.add("attributes.processing_date", "max_days_ahead", "must be at most %d days after today", rules.MaxDaysAhead)
+	}
+	return v
+}
+
+func (s *schemes) names() []string {
+	var names []string
+	for scheme := range s.rules {
+		names = append(names, scheme)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type violations []Violation
+
+func (v *violations) add(field, rule, format string, args ...interface{}) {
+	*v = append(*v, Violation{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *violations) maxLength(field, value string, max int) {
+	if max > 0 && utf8.RuneCountInString(value) > max {
+		v.add(field, "max_length", "must be at most %d characters long", max)
+	}
+}
+
+// party checks the identifiers of the bank and the account of the party.
+func (v *violations) party(field string, party *domain.PaymentParty, rules *SchemeRules) {
+	v.bank(field, &party.Account, rules)
+	if len(rules.AccountNumberCodes) > 0 && !contains(rules.AccountNumberCodes, party.AccountNumberCode) {
+		v.add(field+".account_number_code", "account_number_code", "must be one of %s", strings.Join(rules.AccountNumberCodes, ", "))
+	}
+	switch {
+	case party.AccountNumberCode == "IBAN" && !validIBAN(party.AccountNumber):
+		v.add(field+".account_number", "iban", "must be a valid IBAN")
+	case party.AccountNumberCode == "BBAN" && party.BankIDCode == "GBDSC" && !ukAccountPattern.MatchString(party.AccountNumber):
+		v.add(field+".account_number", "account_number", "must be an account number of 8 digits")
+	case party.AccountNumberCode == "BBAN" && !bbanPattern.MatchString(party.AccountNumber):
+		v.add(field+".account_number", "account_number", "must be an account number of up to 30 letters and digits")
+	}
+}
+
+// bank checks the identifiers of the bank of the account. The account number
+// itself is only checked for parties, as accounts without an account number
+// code, e.g. of sponsors, do not tell its format.
+func (v *violations) bank(field string, account *domain.Account, rules *SchemeRules) {
+	if len(rules.BankIDCodes) > 0 && !contains(rules.BankIDCodes, account.BankIDCode) {
+		v.add(field+".bank_id_code", "bank_id_code", "must be one of %s", strings.Join(rules.BankIDCodes, ", "))
+	}
+	switch account.BankIDCode {
+	case "GBDSC":
+		if !sortCodePattern.MatchString(account.BankID) {
+			v.add(field+".bank_id", "sort_code", "must be a sort code of 6 digits")
+		}
+	case "SWBIC":
+		if !bicPattern.MatchString(account.BankID) {
+			v.add(field+".bank_id", "bic", "must be a BIC of 8 or 11 characters")
+		}
+	}
+}
+
+// validIBAN checks the format and the check digits of the IBAN.
+func validIBAN(iban string) bool {
+	if !ibanPattern.MatchString(iban) {
+		return false
+	}
+	// the check digits make the number, with the country and check digits
+	// moved to the end and letters replaced with 10 to 35, equal 1 modulo 97
+	remainder := 0
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' {
+			remainder = (remainder*100 + int(c-'A'+10)) % 97
+		} else {
+			remainder = (remainder*10 + int(c-'0')) % 97
+		}
+	}
+	return remainder == 1
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
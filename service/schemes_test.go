@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/copier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mysza/paymentsapi/domain"
+	"github.com/mysza/paymentsapi/service/mocks"
+	"github.com/mysza/paymentsapi/test"
+)
+
+func TestSchemeRules(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	validPayment := test.PaymentFromFile(t, filepath.Join("..", "testdata", "validPayment.json"))
+	today := time.Date(2018, 6, 4, 15, 0, 0, 0, time.UTC)
+	// newPayment returns a payment following the default rules of FPS
+	newPayment := func() *domain.Payment {
+		payment := &domain.Payment{}
+		copier.Copy(payment, validPayment)
+		payment.ID = ""
+		payment.Attributes.Reference = "Piano lessons"
+		payment.Attributes.Debtor.AccountNumber = "GB29NWBK60161331926819"
+		payment.Attributes.ProcessingDate = "2018-06-04"
+		return payment
+	}
+	newService := func() *PaymentsService {
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Add", mock.Anything, mock.Anything).Return("id", nil)
+		ps := NewPaymentsService(repo, WithSchemeRules(DefaultSchemeRules))
+		ps.schemes.now = func() time.Time { return today }
+		return ps
+	}
+	fields := func(err error) map[string]string {
+		invalid, ok := err.(*ValidationError)
+		if !ok {
+			return nil
+		}
+		rules := map[string]string{}
+		for _, violation := range invalid.Violations {
+			rules[violation.Field] = violation.Rule
+		}
+		return rules
+	}
+
+	t.Run("Payments following the rules of their scheme are valid", func(t *testing.T) {
+		_, err := newService().Add(ctx, newPayment())
+
+		assert.Nil(err)
+	})
+
+	t.Run("Violations are reported per field", func(t *testing.T) {
+		payment := newPayment()
+		payment.Attributes.Currency = "EUR"
+		payment.Attributes.Amount = "1000000.01"
+		payment.Attributes.Reference = "Payment for Em's piano lessons"
+		payment.Attributes.SchemePaymentType = "Cheque"
+		payment.Attributes.Beneficiary.BankID = "40-30-00"
+		payment.Attributes.Beneficiary.AccountNumber = "3192681"
+		payment.Attributes.Debtor.AccountNumber = "GB29XABC10161234567801"
+		payment.Attributes.Sponsor.BankID = "1231"
+
+		_, err := newService().Add(ctx, payment)
+
+		assert.Equal(map[string]string{
+			"attributes.currency":                         "currency",
+			"attributes.amount":                           "max_amount",
+			"attributes.reference":                        "max_length",
+			"attributes.scheme_payment_type":              "scheme_payment_type",
+			"attributes.beneficiary_party.bank_id":        "sort_code",
+			"attributes.beneficiary_party.account_number": "account_number",
+			"attributes.debtor_party.account_number":      "iban",
+			"attributes.sponsor_party.bank_id":            "sort_code",
+		}, fields(err))
+	})
+
+	t.Run("Identifier formats depend on the scheme", func(t *testing.T) {
+		payment := newPayment()
+		payment.Attributes.PaymentScheme = "SEPA"
+		payment.Attributes.Currency = "EUR"
+		payment.Attributes.SchemePaymentType = "CreditTransfer"
+		payment.Attributes.Beneficiary.AccountNumberCode = "IBAN"
+		payment.Attributes.Beneficiary.AccountNumber = "DE89370400440532013000"
+		payment.Attributes.Beneficiary.BankIDCode = "SWBIC"
+		payment.Attributes.Beneficiary.BankID = "COBADEFFXXX"
+		payment.Attributes.Debtor.BankIDCode = "SWBIC"
+		payment.Attributes.Debtor.BankID = "NWBKGB2"
+		payment.Attributes.Sponsor.BankIDCode = "SWBIC"
+		payment.Attributes.Sponsor.BankID = "DEUTDEFF"
+
+		_, err := newService().Add(ctx, payment)
+
+		assert.Equal(map[string]string{"attributes.debtor_party.bank_id": "bic"}, fields(err))
+	})
+
+	t.Run("Processing dates must be within the window of the scheme", func(t *testing.T) {
+		ps := newService()
+		cases := []struct {
+			scheme, date, rule string
+		}{
+			{"FPS", "2018-06-03", "min_days_ahead"},
+			{"FPS", "2019-06-05", "max_days_ahead"},
+			{"Bacs", "2018-06-05", "min_days_ahead"},
+			{"FPS", "4 June 2018", "date"},
+		}
+		for _, testCase := range cases {
+			payment := newPayment()
+			payment.Attributes.PaymentScheme = testCase.scheme
+			payment.Attributes.SchemePaymentType = "Credit"
+			payment.Attributes.ProcessingDate = testCase.date
+			if testCase.scheme == "FPS" {
+				payment.Attributes.SchemePaymentType = "ImmediatePayment"
+			}
+
+			_, err := ps.Add(ctx, payment)
+
+			assert.Equal(map[string]string{"attributes.processing_date": testCase.rule}, fields(err), testCase.date)
+		}
+		assert.Nil(ps.Validate(func() *domain.Payment {
+			payment := newPayment()
+			payment.Attributes.ProcessingDate = "2017-01-18"
+			return payment
+		}()), "Stored payments must not be invalidated by the passing of time")
+	})
+
+	t.Run("Processing dates are only checked when added or changed", func(t *testing.T) {
+		stored := newPayment()
+		stored.ID = validPayment.ID
+		stored.Attributes.ProcessingDate = "2018-05-30"
+		repo := new(mocks.PaymentsRepository)
+		repo.On("Get", mock.Anything, stored.ID).Return(stored, nil)
+		repo.On("Update", mock.Anything, mock.Anything).Return(nil)
+		ps := NewPaymentsService(repo, WithSchemeRules(DefaultSchemeRules))
+		ps.schemes.now = func() time.Time { return today }
+		amended := &domain.Payment{}
+		copier.Copy(amended, stored)
+		amended.Attributes.Reference = "Violin lessons"
+		moved := &domain.Payment{}
+		copier.Copy(moved, stored)
+		moved.Attributes.ProcessingDate = "2018-05-31"
+
+		amendedErr := ps.Update(ctx, amended)
+		movedErr := ps.Update(ctx, moved)
+
+		assert.Nil(amendedErr)
+		assert.Equal(map[string]string{"attributes.processing_date": "min_days_ahead"}, fields(movedErr))
+	})
+
+	t.Run("Invalid rules are rejected", func(t *testing.T) {
+		invalid := []SchemeRules{{MaxAmount: "1,000"}, {MaxAmount: "-1"}, {MinDaysAhead: -1}}
+		for _, rules := range invalid {
+			assert.Error(ValidateSchemeRules(map[string]SchemeRules{"FPS": rules}), "%+v", rules)
+			assert.Panics(func() { WithSchemeRules(map[string]SchemeRules{"FPS": rules}) }, "%+v", rules)
+		}
+		assert.Nil(ValidateSchemeRules(DefaultSchemeRules))
+	})
+
+	t.Run("Payments of unknown schemes are rejected", func(t *testing.T) {
+		payment := newPayment()
+		payment.Attributes.PaymentScheme = "SWIFT"
+
+		err := newService().Update(ctx, payment)
+
+		assert.Equal(map[string]string{"attributes.payment_scheme": "scheme"}, fields(err))
+		assert.Contains(err.Error(), "must be one of BACS, CHAPS, FPS, SEPA")
+	})
+
+	t.Run("Struct violations are reported by the path of their field", func(t *testing.T) {
+		payment := newPayment()
+		payment.Attributes.Beneficiary.Name = ""
+		payment.Attributes.Currency = "GB"
+
+		_, err := NewPaymentsService(nil).Add(ctx, payment)
+
+		assert.Equal(map[string]string{
+			"attributes.beneficiary_party.name": "required",
+			"attributes.currency":               "len",
+		}, fields(err))
+	})
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/mysza/paymentsapi/domain"
 )
 
-func loadBytes(t *testing.T, path string) []byte {
+func loadBytes(t testing.TB, path string) []byte {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		t.Fatal(err)
@@ -15,7 +15,7 @@ func loadBytes(t *testing.T, path string) []byte {
 	return bytes
 }
 
-func PaymentFromFile(t *testing.T, path string) *domain.Payment {
+func PaymentFromFile(t testing.TB, path string) *domain.Payment {
 	bytes := loadBytes(t, path)
 	payment, err := domain.PaymentFromByteSlice(bytes)
 	if err != nil {
@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// WriterExporter writes spans as JSON lines, e.g. to stdout.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterExporter creates a WriterExporter writing to w.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+type spanJSON struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Start        time.Time              `json:"start"`
+	Duration     string                 `json:"duration"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *WriterExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		out := spanJSON{
+			TraceID:  span.SpanContext().TraceID().String(),
+			SpanID:   span.SpanContext().SpanID().String(),
+			Name:     span.Name(),
+			Start:    span.StartTime(),
+			Duration: span.EndTime().Sub(span.StartTime()).String(),
+		}
+		if span.Parent().IsValid() {
+			out.ParentSpanID = span.Parent().SpanID().String()
+		}
+		if attributes := span.Attributes(); len(attributes) > 0 {
+			out.Attributes = map[string]interface{}{}
+			for _, a := range attributes {
+				out.Attributes[string(a.Key)] = a.Value.AsInterface()
+			}
+		}
+		if span.Status().Code == codes.Error {
+			out.Error = span.Status().Description
+		}
+		if err := encoder.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *WriterExporter) Shutdown(context.Context) error {
+	return nil
+}
@@ -0,0 +1,222 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// DefaultOTLPEndpoint is the traces endpoint of a local OpenTelemetry collector.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// otlpTimeout limits exports to unresponsive collectors, as the default
+// timeout of the exporters of the OpenTelemetry SDKs.
+const otlpTimeout = 10 * time.Second
+
+// OTLPExporter sends spans to an OpenTelemetry collector using the OTLP/HTTP
+// protocol with JSON encoding, with their events and links. Spans are exported with the resource of the
+// first span of the batch, as all spans of a provider share it.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter creates an OTLPExporter posting to the endpoint,
+// e.g. DefaultOTLPEndpoint.
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{endpoint: endpoint, client: &http.Client{Timeout: otlpTimeout}}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+
+	DroppedAttributesCount int `json:"droppedAttributesCount,omitempty"`
+	DroppedEventsCount     int `json:"droppedEventsCount,omitempty"`
+	DroppedLinksCount      int `json:"droppedLinksCount,omitempty"`
+}
+
+// otlpEvent is an event of a span, e.g. an exception recorded by RecordError.
+type otlpEvent struct {
+	TimeUnixNano           string         `json:"timeUnixNano"`
+	Name                   string         `json:"name"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	TraceState             string         `json:"traceState,omitempty"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+}
+
+// otlpStatus codes of spans, which differ from the codes of the SDK.
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attributes []attribute.KeyValue) []otlpKeyValue {
+	var out []otlpKeyValue
+	for _, a := range attributes {
+		var v map[string]interface{}
+		switch a.Value.Type() {
+		case attribute.BOOL:
+			v = map[string]interface{}{"boolValue": a.Value.AsBool()}
+		case attribute.INT64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(a.Value.AsInt64(), 10)}
+		case attribute.FLOAT64:
+			v = map[string]interface{}{"doubleValue": a.Value.AsFloat64()}
+		default:
+			v = map[string]interface{}{"stringValue": a.Value.Emit()}
+		}
+		out = append(out, otlpKeyValue{Key: string(a.Key), Value: v})
+	}
+	return out
+}
+
+func otlpSpanOf(span sdktrace.ReadOnlySpan) otlpSpan {
+	out := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime().UnixNano(), 10),
+		Attributes:        otlpAttributes(span.Attributes()),
+
+		DroppedAttributesCount: span.DroppedAttributes(),
+		DroppedEventsCount:     span.DroppedEvents(),
+		DroppedLinksCount:      span.DroppedLinks(),
+	}
+	for _, event := range span.Events() {
+		out.Events = append(out.Events, otlpEvent{
+			TimeUnixNano:           strconv.FormatInt(event.Time.UnixNano(), 10),
+			Name:                   event.Name,
+			Attributes:             otlpAttributes(event.Attributes),
+			DroppedAttributesCount: event.DroppedAttributeCount,
+		})
+	}
+	for _, link := range span.Links() {
+		out.Links = append(out.Links, otlpLink{
+			TraceID:                link.SpanContext.TraceID().String(),
+			SpanID:                 link.SpanContext.SpanID().String(),
+			TraceState:             link.SpanContext.TraceState().String(),
+			Attributes:             otlpAttributes(link.Attributes),
+			DroppedAttributesCount: link.DroppedAttributeCount,
+		})
+	}
+	if span.Parent().IsValid() {
+		out.ParentSpanID = span.Parent().SpanID().String()
+	}
+	switch status := span.Status(); status.Code {
+	case codes.Ok:
+		out.Status.Code = otlpStatusOK
+	case codes.Error:
+		out.Status = otlpStatus{Code: otlpStatusError, Message: status.Description}
+	}
+	return out
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	var scopes []otlpScopeSpans
+	index := map[string]int{} // indices of scopes by name
+	for _, span := range spans {
+		scope := span.InstrumentationScope()
+		ix, found := index[scope.Name]
+		if !found {
+			ix = len(scopes)
+			index[scope.Name] = ix
+			scopes = append(scopes, otlpScopeSpans{Scope: otlpScope{Name: scope.Name, Version: scope.Version}})
+		}
+		scopes[ix].Spans = append(scopes[ix].Spans, otlpSpanOf(span))
+	}
+	resource := spans[0].Resource()
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(resource.Attributes())},
+		ScopeSpans: scopes,
+		SchemaURL:  resource.SchemaURL(),
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting spans to %s: %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+// Package tracing records spans of work done by the service with the
+// OpenTelemetry SDK, propagates trace context in W3C traceparent headers and
+// exports finished spans, e.g. to an OpenTelemetry collector over OTLP.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceparentHeader is the W3C Trace Context header carrying the span context.
+const TraceparentHeader = "traceparent"
+
+// instrumentationScope names the tracer of the service.
+const instrumentationScope = "github.com/mysza/paymentsapi"
+
+// NewProvider creates a provider of tracers sampling the given ratio of new
+// traces and passing finished spans to the processor. Traces started by
+// remote callers follow the caller's sampling decision.
+func NewProvider(processor sdktrace.SpanProcessor, serviceName string, sampleRatio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+}
+
+// SetProvider sets the provider of the tracer used by Start. Until set,
+// spans are not recorded. Failures of the provider, e.g. to export spans,
+// are logged.
+func SetProvider(provider trace.TracerProvider) {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logrus.WithFields(logrus.Fields{
+			"location": "tracing",
+			"error":    err,
+		}).Warn("Tracing failed")
+	}))
+	otel.SetTracerProvider(provider)
+}
+
+// Start starts a span as the child of the span in ctx, if any, and returns
+// a copy of ctx carrying the new span.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationScope).Start(ctx, name, opts...)
+}
+
+// RecordError marks the span as failed with the error, if err is not nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Extract returns a copy of ctx with the remote span context from the headers,
+// if they carry a valid one.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the traceparent header to the current span context in ctx.
+func Inject(ctx context.Context, header http.Header) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+}
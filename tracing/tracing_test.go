@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestProvider(t *testing.T) {
+	assert := assert.New(t)
+	recorder := tracetest.NewSpanRecorder()
+	SetProvider(NewProvider(recorder, "paymentsapi", 1))
+	defer SetProvider(noop.NewTracerProvider())
+	remote := http.Header{}
+	remote.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	t.Run("Child spans share the trace of the remote parent", func(t *testing.T) {
+		recorder.Reset()
+
+		ctx, parent := Start(Extract(context.Background(), remote), "parent", trace.WithSpanKind(trace.SpanKindServer))
+		_, child := Start(ctx, "child")
+		RecordError(child, errors.New("failed"))
+		child.End()
+		parent.End()
+
+		spans := recorder.Ended()
+		if assert.Len(spans, 2) {
+			assert.Equal("child", spans[0].Name())
+			assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+			assert.Equal(spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+			assert.Equal(sdktrace.Status{Code: codes.Error, Description: "failed"}, spans[0].Status())
+			assert.Equal("00f067aa0ba902b7", spans[1].Parent().SpanID().String())
+			assert.Equal(trace.SpanKindServer, spans[1].SpanKind())
+		}
+	})
+
+	t.Run("Unsampled remote parents are not recorded", func(t *testing.T) {
+		recorder.Reset()
+		unsampled := http.Header{}
+		unsampled.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+		_, span := Start(Extract(context.Background(), unsampled), "ignored")
+		span.End()
+
+		assert.Empty(recorder.Ended())
+	})
+
+	t.Run("Span context is injected into headers", func(t *testing.T) {
+		ctx, span := Start(context.Background(), "client")
+		header := http.Header{}
+
+		Inject(ctx, header)
+
+		assert.Contains(header.Get(TraceparentHeader), span.SpanContext().SpanID().String())
+	})
+}
+
+func TestOTLPExporter(t *testing.T) {
+	assert := assert.New(t)
+	requests := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+	}))
+	defer collector.Close()
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	parentID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	linkedTraceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	linkedSpanID, _ := trace.SpanIDFromHex("b9c7c989f97918e1")
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	span := tracetest.SpanStub{
+		Name:        "PaymentsService.Get",
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled}),
+		Parent:      trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: parentID, TraceFlags: trace.FlagsSampled, Remote: true}),
+		SpanKind:    trace.SpanKindInternal,
+		StartTime:   start,
+		EndTime:     start.Add(1500 * time.Microsecond),
+		Attributes: []attribute.KeyValue{
+			attribute.String("db.system", "badger"),
+			attribute.Int("http.status_code", 404),
+		},
+		Events: []sdktrace.Event{{
+			Name: "exception",
+			Time: start.Add(time.Millisecond),
+			Attributes: []attribute.KeyValue{
+				attribute.String("exception.type", "*errors.errorString"),
+				attribute.String("exception.message", "not found"),
+			},
+		}},
+		Links: []sdktrace.Link{{
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: linkedTraceID, SpanID: linkedSpanID}),
+			Attributes:  []attribute.KeyValue{attribute.String("link.kind", "batch")},
+		}},
+		Status:               sdktrace.Status{Code: codes.Error, Description: "not found"},
+		Resource:             resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("paymentsapi")),
+		InstrumentationScope: instrumentation.Scope{Name: instrumentationScope},
+	}.Snapshot()
+
+	err := NewOTLPExporter(collector.URL).ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span})
+
+	assert.Nil(err)
+	// the payload accepted by the OTLP/HTTP receiver of an OpenTelemetry collector
+	recorded, _ := ioutil.ReadFile(filepath.Join("testdata", "otlp_traces.json"))
+	select {
+	case body := <-requests:
+		assert.JSONEq(string(recorded), string(body))
+	default:
+		t.Fatal("No spans were exported")
+	}
+}